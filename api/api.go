@@ -5,41 +5,71 @@ package api
 	GET requests return a message history.
 	POST requests send any messages into the chat.
 	The acceptedKeys variable is a slice of all form keys for either GET or POST that will be accepted. These reference the chat table columns.
+	Every /chat and /api/v1 request must send an API token as "Authorization: Bearer <token>". See auth.go.
+	GET /terminal serves a browser based terminal which connects to the chat through a WebSocket on /terminal/ws. See terminal.go.
 */
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"team-cymru-telnet/auth"
 	"team-cymru-telnet/config"
 	"team-cymru-telnet/db"
-	"team-cymru-telnet/models/chat"
+	"team-cymru-telnet/models/token"
 	"team-cymru-telnet/server"
 	"time"
 )
 
 var mux = http.NewServeMux()
+var httpServer *http.Server
 
-func Start() {
+//Start - serves the API in the background. requests are given ctx, the root context, so long running ones such as exports stop when it is cancelled
+func Start(ctx context.Context) {
 	mux.HandleFunc("/chat", messageHandler)
+	mux.HandleFunc("/api/v1/tokens", tokenHandler)
+	mux.HandleFunc("/api/v1/webhooks", webhookHandler)
+	mux.HandleFunc("/api/v1/webhooks/deliveries", webhookDeliveryHandler)
+	mux.HandleFunc("/api/v1/integrations", integrationHandler)
+	mux.HandleFunc("/api/v1/search", searchHandler)
+	mux.HandleFunc("/api/v1/metrics", metricsHandler)
+	mux.HandleFunc("/api/v1/retention", retentionHandler)
+	mux.HandleFunc("/api/v1/export", exportHandler)
+	mux.HandleFunc("/api/v1/config/reload", reloadHandler)
+	mux.HandleFunc("/hooks/", incomingHookHandler)
+	mux.HandleFunc("/terminal", terminalHandler)
+	mux.HandleFunc("/terminal/ws", terminalSocketHandler)
 
 	port := fmt.Sprintf(":%s", config.Cfg.HTTPPort)
-	serve := &http.Server{
+	httpServer = &http.Server{
 		Addr:    port,
 		Handler: mux,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
 	}
 
 	go func() {
-		if err := serve.ListenAndServe(); err != nil {
-			config.Logs().Fatal(err.Error())
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			config.Log("api").Fatal("HTTP server failed", config.Err(err))
 		}
 	}()
 
 	server.AddUniqueClient("web")
 
-	config.Logs().Info("api server has started")
+	config.Log("api").Info("api server has started")
+}
+
+//Shutdown - stops accepting requests and waits for the running ones until ctx expires
+func Shutdown(ctx context.Context) error {
+	if httpServer == nil {
+		return nil
+	}
+	return httpServer.Shutdown(ctx)
 }
 
 func messageHandler(res http.ResponseWriter, req *http.Request) {
@@ -48,43 +78,72 @@ func messageHandler(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	tok, ok := authenticate(res, req)
+	if !ok {
+		return
+	}
+
 	res.Header().Set("Content-Type", "application/json")
 
-	//calls to ParseForm() would return an empty req.Form variable when sending POST while ParseMultiPartForm(int) successfully initializes the variable
-	if err := req.ParseMultipartForm(1024); err != nil {
-		config.Logs().Fatal(err.Error())
+	//calls to ParseForm() would return an empty req.Form variable when sending POST while ParseMultiPartForm(int) successfully initializes the variable.
+	//a request without a multipart body, e.g. a GET with a query string, still has its form parsed
+	err := req.ParseMultipartForm(1024)
+	if err == http.ErrNotMultipart {
+		err = req.ParseForm()
+	}
+	if err != nil {
+		http.Error(res, "400 Bad Request", http.StatusBadRequest)
+		return
 	}
 
 	if req.Method == "GET" {
-		get(res, req, req.Form)
+		get(res, req, req.Form, tok)
 	} else if req.Method == "POST" {
-		post(res, req, req.Form)
+		post(res, req, req.Form, tok)
 	}
 }
 
-func get(res http.ResponseWriter, req *http.Request, formValues url.Values) {
+func get(res http.ResponseWriter, req *http.Request, formValues url.Values, tok *token.Token) {
 	acceptedQueryStringParameters := []string{"id", "user", "channel", "message", "recipient", "message_type", "limit"}
 	if !validateForm(formValues, acceptedQueryStringParameters) {
 		http.Error(res, "400 Bad Request", http.StatusBadRequest)
 		return
 	}
+	if !requireScope(res, tok, auth.ScopeReadHistory) {
+		return
+	}
+	//private messages are only returned to tokens that were explicitly granted read:pm
+	readPM := auth.HasScope(tok, auth.ScopeReadPM)
+	if !readPM && (formValues.Get("message_type") == "pm" || formValues.Get("recipient") != "") {
+		requireScope(res, tok, auth.ScopeReadPM)
+		return
+	}
 
-	chatHistory := []chat.Chat{}
-	query := queryBuilder(req.Form)
-	db.DB.Conn.Raw(query).Scan(&chatHistory)
+	filter, err := filterBuilder(req.Form, readPM)
+	if err != nil {
+		http.Error(res, "400 Bad Request", http.StatusBadRequest)
+		return
+	}
+	chatHistory, err := db.Messages.Query(filter)
+	if err != nil {
+		config.Log("api").Error("failed to query chat history", config.Remote(clientAddr(req)), config.Err(err))
+		http.Error(res, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
 	res.WriteHeader(200)
 	json.NewEncoder(res).Encode(chatHistory)
 }
 
-func post(res http.ResponseWriter, req *http.Request, formValues url.Values) {
+func post(res http.ResponseWriter, req *http.Request, formValues url.Values, tok *token.Token) {
 	acceptedPostParameters := []string{"channel", "message"}
 	if !validateForm(formValues, acceptedPostParameters) {
 		http.Error(res, "400 Bad Request", http.StatusBadRequest)
 		return
 	}
 
+	//messages are attributed to the identity the token was issued to
 	user := server.User{
-		Name:      "web",
+		Name:      tok.Identity,
 		TimeStamp: time.Now().Local().Format(time.Stamp),
 	}
 	if _, ok := formValues["message"]; !ok {
@@ -94,8 +153,14 @@ func post(res http.ResponseWriter, req *http.Request, formValues url.Values) {
 	user.Message = formValues.Get("message")
 
 	if _, ok := formValues["channel"]; ok {
+		if !requireScope(res, tok, auth.ScopePostChannel) {
+			return
+		}
 		channelNum, err := strconv.Atoi(formValues.Get("channel"))
-		config.CheckError(err)
+		if err != nil {
+			http.Error(res, "400 Bad Request", http.StatusBadRequest)
+			return
+		}
 		user.Channel = channelNum
 		if !server.SendToChannel(user) {
 			res.WriteHeader(400)
@@ -103,6 +168,9 @@ func post(res http.ResponseWriter, req *http.Request, formValues url.Values) {
 			return
 		}
 	} else {
+		if !requireScope(res, tok, auth.ScopePostBroadcast) {
+			return
+		}
 		if !server.SendBroadcast(user) {
 			res.WriteHeader(400)
 			http.Error(res, "500 Internal Server Error", http.StatusInternalServerError)
@@ -129,49 +197,39 @@ func validateForm(formValues map[string][]string, parameters []string) bool {
 	return found
 }
 
-func queryBuilder(formValues url.Values) string {
-	query := "SELECT * FROM chat c "
-	and := false
+//the most messages a GET /chat returns, a larger limit is a bad request
+const maxHistoryLimit = 1000
+
+//translates the GET /chat parameters into a filter for the message store
+func filterBuilder(formValues url.Values, readPM bool) (db.MessageFilter, error) {
+	filter := db.MessageFilter{ExcludePM: !readPM, Limit: 100}
+	var err error
 
 	if _, ok := formValues["id"]; ok {
-		query += fmt.Sprintf("WHERE id = %s", formValues.Get("id"))
-		return query
+		filter.ID, err = strconv.Atoi(formValues.Get("id"))
+		return filter, err
 	}
 
 	if _, ok := formValues["user"]; ok {
-		checkAnd(&query, and)
-		//user is a unique variable to postgres so in order to query for this column we have to create an alias for the table
-		query += fmt.Sprintf("c.user = '%s' ", formValues.Get("user"))
-		and = true
+		filter.User = formValues.Get("user")
 	}
 	if _, ok := formValues["channel"]; ok {
-		checkAnd(&query, and)
-		query += fmt.Sprintf("channel = '%s' ", formValues.Get("channel"))
-		and = true
+		filter.Channel, err = strconv.Atoi(formValues.Get("channel"))
+		if err != nil {
+			return filter, err
+		}
 	}
 	if _, ok := formValues["message_type"]; ok {
-		checkAnd(&query, and)
-		query += fmt.Sprintf("message_type = '%s' ", formValues.Get("message_type"))
-		and = true
+		filter.MessageType = formValues.Get("message_type")
 	}
 	if _, ok := formValues["recipient"]; ok {
-		checkAnd(&query, and)
-		query += fmt.Sprintf("pm_recipient = '%s' ", formValues.Get("recipient"))
-		and = true
+		filter.Recipient = formValues.Get("recipient")
 	}
-
-	limit := 100
 	if _, ok := formValues["limit"]; ok {
-		limit = 100
-	}
-	return query + fmt.Sprintf("limit %d", limit)
-}
-
-//And -
-func checkAnd(query *string, and bool) {
-	if and {
-		*query += "and "
-	} else {
-		*query += "WHERE "
+		filter.Limit, err = strconv.Atoi(formValues.Get("limit"))
+		if err != nil || filter.Limit < 1 || filter.Limit > maxHistoryLimit {
+			return filter, fmt.Errorf("limit must be a number between 1 and %d", maxHistoryLimit)
+		}
 	}
+	return filter, nil
 }
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"team-cymru-telnet/auth"
+	"team-cymru-telnet/config"
+	"team-cymru-telnet/db"
+	"team-cymru-telnet/models/token"
+	"testing"
+)
+
+func TestPostInvalidChannel(t *testing.T) {
+	config.Cfg.LogFile = t.TempDir() + "/ChatServer"
+	config.Logs()
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/chat", nil)
+	post(res, req, url.Values{"channel": {"seven"}, "message": {"hi"}}, &token.Token{Identity: "ci", Scopes: "post:channel"})
+	if res.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a channel that is not a number, got %d", res.Code)
+	}
+}
+
+func TestFilterLimit(t *testing.T) {
+	if filter, err := filterBuilder(url.Values{}, false); err != nil || filter.Limit != 100 {
+		t.Fatalf("expected the default limit of 100, got %d %v", filter.Limit, err)
+	}
+	if filter, err := filterBuilder(url.Values{"limit": {"1000"}}, false); err != nil || filter.Limit != 1000 {
+		t.Fatalf("expected a limit of 1000, got %d %v", filter.Limit, err)
+	}
+	for _, limit := range []string{"100000000", "1001", "0", "-5", "ten"} {
+		if _, err := filterBuilder(url.Values{"limit": {limit}}, false); err == nil {
+			t.Errorf("limit %q was accepted", limit)
+		}
+	}
+}
+
+func TestIntegrationsWithoutDatabase(t *testing.T) {
+	config.Cfg.LogFile = t.TempDir() + "/ChatServer"
+	config.Logs()
+	res := httptest.NewRecorder()
+	incomingHookHandler(res, httptest.NewRequest("POST", "/hooks/0123abcd", strings.NewReader(`{"text": "build failed"}`)))
+	if res.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a hook without a database, got %d", res.Code)
+	}
+
+	_, err := db.ListIntegrations()
+	res = httptest.NewRecorder()
+	integrationStoreFailed(res, httptest.NewRequest("GET", "/api/v1/integrations", nil), "failed to list integrations", err)
+	if res.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 without a database, got %d", res.Code)
+	}
+}
+
+func TestConfigTokenWithoutDatabase(t *testing.T) {
+	config.Cfg.LogFile = t.TempDir() + "/ChatServer"
+	config.Logs()
+	messages := db.Messages
+	db.Messages = db.NewMemoryStore()
+	defer func() {
+		db.Messages = messages
+		config.Cfg.APITokens = nil
+	}()
+	config.Cfg.APITokens = []config.APIToken{{Identity: "ci", Scopes: "read:history, post:broadcast", Hash: auth.Hash("s3cret")}}
+
+	for _, test := range []struct {
+		token string
+		code  int
+	}{{"s3cret", http.StatusOK}, {"wrong", http.StatusUnauthorized}} {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/chat", nil)
+		req.Header.Set("Authorization", "Bearer "+test.token)
+		messageHandler(res, req)
+		if res.Code != test.code {
+			t.Errorf("expected %d for token %s without a database, got %d", test.code, test.token, res.Code)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package api
+
+/*
+	OVERVIEW: Bearer token authentication for the API and the admin endpoint used to manage tokens.
+	authenticate() must be called at the top of every handler that exposes chat data. It writes the 401 response itself so the handler only has to return.
+	/api/v1/tokens requires the admin scope. GET lists tokens, POST creates one from the "identity" and "scopes" form values and DELETE revokes the token in "id".
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"team-cymru-telnet/auth"
+	"team-cymru-telnet/config"
+	"team-cymru-telnet/models/token"
+)
+
+func authenticate(res http.ResponseWriter, req *http.Request) (*token.Token, bool) {
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		res.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(res, "401 Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	tok, err := auth.Authenticate(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")))
+	if err != nil {
+		config.Log("api").Error("rejected API request", config.Remote(clientAddr(req)), config.Err(err))
+		res.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(res, "401 Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	return tok, true
+}
+
+func requireScope(res http.ResponseWriter, tok *token.Token, scope string) bool {
+	if !auth.HasScope(tok, scope) {
+		http.Error(res, fmt.Sprintf("403 Forbidden. token is missing scope %s", scope), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+//tokenResponse is the JSON representation of a token. Token is only set in the response to the request which created it
+type tokenResponse struct {
+	ID       int    `json:"id"`
+	Identity string `json:"identity"`
+	Scopes   string `json:"scopes"`
+	Revoked  bool   `json:"revoked"`
+	Token    string `json:"token,omitempty"`
+}
+
+func tokenHandler(res http.ResponseWriter, req *http.Request) {
+	tok, ok := authenticate(res, req)
+	if !ok || !requireScope(res, tok, auth.ScopeAdmin) {
+		return
+	}
+
+	if err := req.ParseForm(); err != nil {
+		http.Error(res, "400 Bad Request", http.StatusBadRequest)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+
+	switch req.Method {
+	case "GET":
+		tokens, err := auth.ListTokens()
+		if err != nil {
+			config.Log("api").Error("failed to list tokens", config.Remote(clientAddr(req)), config.Err(err))
+			http.Error(res, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		list := []tokenResponse{}
+		for _, t := range tokens {
+			list = append(list, tokenResponse{ID: t.ID, Identity: t.Identity, Scopes: t.Scopes, Revoked: t.Revoked})
+		}
+		res.WriteHeader(200)
+		json.NewEncoder(res).Encode(list)
+	case "POST":
+		plain, created, err := auth.CreateToken(req.Form.Get("identity"), auth.ParseScopes(req.Form.Get("scopes")))
+		if err != nil {
+			http.Error(res, fmt.Sprintf("400 Bad Request. %v", err), http.StatusBadRequest)
+			return
+		}
+		config.Log("api").Info("token created", config.F("token", created.ID), config.F("identity", tok.Identity), config.F("token_identity", created.Identity))
+		res.WriteHeader(201)
+		json.NewEncoder(res).Encode(tokenResponse{ID: created.ID, Identity: created.Identity, Scopes: created.Scopes, Token: plain})
+	case "DELETE":
+		id, err := strconv.Atoi(req.Form.Get("id"))
+		if err != nil {
+			http.Error(res, "400 Bad Request", http.StatusBadRequest)
+			return
+		}
+		if err := auth.RevokeToken(id); err != nil {
+			http.Error(res, fmt.Sprintf("404 not found. %v", err), http.StatusNotFound)
+			return
+		}
+		config.Log("api").Info("token revoked", config.F("token", id), config.F("identity", tok.Identity))
+		res.WriteHeader(200)
+		json.NewEncoder(res).Encode(map[string]string{"Success": fmt.Sprintf("revoked token %d", id)})
+	default:
+		http.Error(res, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,93 @@
+package api
+
+/*
+	OVERVIEW: GET /api/v1/export streams chat history as a download. It accepts the GET /chat filters plus
+	"format" (ndjson, csv or transcript, default ndjson), "tz" (an IANA time zone such as Europe/London, default UTC)
+	and "after" and "before" (RFC 3339). Unlike GET /chat there is no default limit.
+	The same scopes as GET /chat apply, private messages need read:pm.
+*/
+
+import (
+	"fmt"
+	"net/http"
+	"team-cymru-telnet/auth"
+	"team-cymru-telnet/config"
+	"team-cymru-telnet/export"
+	"time"
+)
+
+func exportHandler(res http.ResponseWriter, req *http.Request) {
+	tok, ok := authenticate(res, req)
+	if !ok {
+		return
+	}
+	if req.Method != "GET" {
+		http.Error(res, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		http.Error(res, "400 Bad Request", http.StatusBadRequest)
+		return
+	}
+	acceptedParameters := []string{"id", "user", "channel", "recipient", "message_type", "limit", "format", "tz", "after", "before"}
+	if !validateForm(req.Form, acceptedParameters) {
+		http.Error(res, "400 Bad Request", http.StatusBadRequest)
+		return
+	}
+	if !requireScope(res, tok, auth.ScopeReadHistory) {
+		return
+	}
+	readPM := auth.HasScope(tok, auth.ScopeReadPM)
+	if !readPM && (req.Form.Get("message_type") == "pm" || req.Form.Get("recipient") != "") {
+		requireScope(res, tok, auth.ScopeReadPM)
+		return
+	}
+
+	format := req.Form.Get("format")
+	if format == "" {
+		format = "ndjson"
+	}
+	contentType, ok := export.Formats[format]
+	if !ok {
+		http.Error(res, "400 Bad Request. format must be ndjson, csv or transcript", http.StatusBadRequest)
+		return
+	}
+	loc, err := time.LoadLocation(req.Form.Get("tz"))
+	if err != nil {
+		http.Error(res, "400 Bad Request. unknown time zone", http.StatusBadRequest)
+		return
+	}
+
+	filter, err := filterBuilder(req.Form, readPM)
+	if err != nil {
+		http.Error(res, "400 Bad Request", http.StatusBadRequest)
+		return
+	}
+	if req.Form.Get("limit") == "" {
+		filter.Limit = 0
+	}
+	for key, value := range map[string]*time.Time{"after": &filter.After, "before": &filter.Before} {
+		if req.Form.Get(key) == "" {
+			continue
+		}
+		if *value, err = time.Parse(time.RFC3339, req.Form.Get(key)); err != nil {
+			http.Error(res, fmt.Sprintf("400 Bad Request. %s must be an RFC 3339 time", key), http.StatusBadRequest)
+			return
+		}
+	}
+
+	res.Header().Set("Content-Type", contentType)
+	res.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chat-export.%s"`, fileExtension(format)))
+	res.WriteHeader(200)
+	//the status has been sent, an error part way through can only be logged
+	if err := export.Write(res, format, filter, loc); err != nil {
+		config.Log("api").Error("export failed", config.F("identity", tok.Identity), config.Remote(clientAddr(req)), config.Err(err))
+	}
+}
+
+func fileExtension(format string) string {
+	if format == "transcript" {
+		return "txt"
+	}
+	return format
+}
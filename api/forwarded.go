@@ -0,0 +1,93 @@
+package api
+
+/*
+	OVERVIEW: The client address of requests that came through a reverse proxy. When the peer is one of trustedProxies its Forwarded (RFC 7239)
+	or, without one, X-Forwarded-For header is read from right to left, skipping the addresses of trusted proxies. The first other address is the
+	client. Headers sent by anyone else are ignored, so a client cannot pretend to be someone else.
+	clientAddr is used in the logs and as the RemoteAddr of web terminal sessions, which the per IP limits count by.
+*/
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"team-cymru-telnet/config"
+)
+
+//forwardedAddr is a client address taken from a header. it is an IP address, with the port when the Forwarded header gave one
+type forwardedAddr string
+
+func (f forwardedAddr) Network() string { return "tcp" }
+func (f forwardedAddr) String() string  { return string(f) }
+
+//clientAddr is the address of the client that sent req
+func clientAddr(req *http.Request) net.Addr {
+	peer := forwardedAddr(req.RemoteAddr)
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil || !config.Cfg.TrustedProxy(net.ParseIP(host)) {
+		return peer
+	}
+
+	chain := forwardedFor(req.Header)
+	if len(chain) == 0 {
+		chain = forwardedForList(req.Header)
+	}
+	var client net.Addr = peer
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip, addr := parseForwardedNode(chain[i])
+		if ip == nil {
+			//an obfuscated or malformed entry, the hops before it cannot be trusted either
+			break
+		}
+		client = addr
+		if !config.Cfg.TrustedProxy(ip) {
+			break
+		}
+	}
+	return client
+}
+
+//forwardedFor returns the for= parameters of the Forwarded headers, in order
+func forwardedFor(header http.Header) []string {
+	nodes := []string{}
+	for _, value := range header["Forwarded"] {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				name, node, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if found && strings.EqualFold(name, "for") {
+					nodes = append(nodes, strings.Trim(node, `"`))
+				}
+			}
+		}
+	}
+	return nodes
+}
+
+//forwardedForList returns the addresses of the X-Forwarded-For headers, in order
+func forwardedForList(header http.Header) []string {
+	nodes := []string{}
+	for _, value := range header["X-Forwarded-For"] {
+		for _, node := range strings.Split(value, ",") {
+			if node = strings.TrimSpace(node); node != "" {
+				nodes = append(nodes, node)
+			}
+		}
+	}
+	return nodes
+}
+
+//parseForwardedNode parses "192.0.2.1", "192.0.2.1:4711", "2001:db8::1" or "[2001:db8::1]:4711". ip is nil for anything else, e.g. "unknown"
+func parseForwardedNode(node string) (net.IP, net.Addr) {
+	if ip := net.ParseIP(node); ip != nil {
+		return ip, forwardedAddr(ip.String())
+	}
+	host, port, err := net.SplitHostPort(node)
+	if err != nil {
+		return nil, nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, nil
+	}
+	return ip, forwardedAddr(net.JoinHostPort(ip.String(), port))
+}
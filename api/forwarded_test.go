@@ -0,0 +1,31 @@
+package api
+
+import (
+	"net/http"
+	"team-cymru-telnet/config"
+	"testing"
+)
+
+func TestClientAddr(t *testing.T) {
+	config.Cfg.TrustedProxies = []string{"10.0.0.0/8", "2001:db8::1"}
+	defer func() { config.Cfg.TrustedProxies = nil }()
+
+	for _, test := range []struct {
+		peer     string
+		header   http.Header
+		expected string
+	}{
+		{peer: "10.0.0.2:5000", header: http.Header{"X-Forwarded-For": {"203.0.113.7"}}, expected: "203.0.113.7"},
+		{peer: "10.0.0.2:5000", header: http.Header{"X-Forwarded-For": {"198.51.100.1, 203.0.113.7", "10.0.0.3"}}, expected: "203.0.113.7"},
+		{peer: "10.0.0.2:5000", header: http.Header{"X-Forwarded-For": {"unknown, 10.0.0.3"}}, expected: "10.0.0.3"},
+		{peer: "[2001:db8::1]:5000", header: http.Header{"Forwarded": {`for="[2001:db8::7]:4711";proto=https, for=10.0.0.3`}}, expected: "[2001:db8::7]:4711"},
+		{peer: "10.0.0.2:5000", header: http.Header{"Forwarded": {"For=203.0.113.9"}, "X-Forwarded-For": {"203.0.113.7"}}, expected: "203.0.113.9"},
+		{peer: "10.0.0.2:5000", header: http.Header{}, expected: "10.0.0.2:5000"},
+		{peer: "192.0.2.50:6000", header: http.Header{"X-Forwarded-For": {"203.0.113.7"}}, expected: "192.0.2.50:6000"},
+	} {
+		req := &http.Request{RemoteAddr: test.peer, Header: test.header}
+		if addr := clientAddr(req).String(); addr != test.expected {
+			t.Errorf("peer %s with %v: expected %s, got %s", test.peer, test.header, test.expected, addr)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package api
+
+/*
+	OVERVIEW: Incoming webhooks for CI and alerting. Every integration has its own URL, /hooks/<secret>, which accepts a JSON POST such as
+	{"text": "build 42 failed", "channel": 3, "username": "deploy"}. Only text is required, channel defaults to the integration setting.
+	Notices are always shown under the integration name, a username is added after it, e.g. "ci/deploy", so a payload cannot pose as a user.
+	The secret in the URL is the credential so these requests do not use a bearer token.
+	/api/v1/integrations requires the admin scope. GET lists integrations, POST creates one from "name" and "channel" and returns its URL once,
+	DELETE removes the integration in "id".
+*/
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"team-cymru-telnet/auth"
+	"team-cymru-telnet/config"
+	"team-cymru-telnet/db"
+	"team-cymru-telnet/models/integration"
+	"team-cymru-telnet/server"
+	"time"
+	"unicode"
+)
+
+//largest notice accepted from an integration, same as the number of bytes the telnet server accepts per entry
+const maxIntegrationText = 1024
+
+type integrationPayload struct {
+	Text     string `json:"text"`
+	Channel  int    `json:"channel"`
+	Username string `json:"username"`
+}
+
+type integrationResponse struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	Channel *int64 `json:"channel,omitempty"`
+	URL     string `json:"url,omitempty"`
+}
+
+func incomingHookHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(res, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	secret := strings.TrimPrefix(req.URL.Path, "/hooks/")
+	if secret == "" {
+		http.Error(res, "404 not found", http.StatusNotFound)
+		return
+	}
+	//with the memory and file dialects there are no integrations
+	hook, err := db.FindIntegration(auth.Hash(secret))
+	if err != nil && err != db.ErrNoDatabase {
+		config.Log("api").Error("failed to look up an integration", config.Remote(clientAddr(req)), config.Err(err))
+		http.Error(res, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if hook == nil {
+		http.Error(res, "404 not found", http.StatusNotFound)
+		return
+	}
+
+	payload := integrationPayload{}
+	if err := json.NewDecoder(http.MaxBytesReader(res, req.Body, 16*1024)).Decode(&payload); err != nil {
+		http.Error(res, "400 Bad Request. body must be JSON", http.StatusBadRequest)
+		return
+	}
+	payload.Text = sanitizeNotice(payload.Text)
+	if payload.Text == "" {
+		http.Error(res, "400 Bad Request. text is required", http.StatusBadRequest)
+		return
+	}
+	if len(payload.Text) > maxIntegrationText {
+		http.Error(res, fmt.Sprintf("400 Bad Request. text is longer than %d bytes", maxIntegrationText), http.StatusBadRequest)
+		return
+	}
+
+	user := server.User{
+		Name:      hook.Name,
+		Channel:   int(hook.Channel.Int64),
+		Message:   payload.Text,
+		TimeStamp: time.Now().Local().Format(time.Stamp),
+	}
+	//display names are shown as a single word like any other user name, after the integration name the admin chose
+	if name := strings.Join(strings.Fields(sanitizeNotice(payload.Username)), "_"); name != "" {
+		user.Name = hook.Name + "/" + name
+	}
+	if payload.Channel != 0 {
+		user.Channel = payload.Channel
+	}
+
+	server.SendIntegration(user)
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(200)
+	json.NewEncoder(res).Encode(map[string]string{"Success": "successfully submitted notice"})
+}
+
+//removes control characters so a payload cannot move the cursor or fake a prompt in the telnet clients. new lines become spaces
+func sanitizeNotice(text string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			return ' '
+		}
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, text))
+}
+
+func integrationHandler(res http.ResponseWriter, req *http.Request) {
+	tok, ok := authenticate(res, req)
+	if !ok || !requireScope(res, tok, auth.ScopeAdmin) {
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		http.Error(res, "400 Bad Request", http.StatusBadRequest)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+
+	switch req.Method {
+	case "GET":
+		hooks, err := db.ListIntegrations()
+		if err != nil {
+			integrationStoreFailed(res, req, "failed to list integrations", err)
+			return
+		}
+		list := []integrationResponse{}
+		for _, hook := range hooks {
+			list = append(list, newIntegrationResponse(hook, ""))
+		}
+		res.WriteHeader(200)
+		json.NewEncoder(res).Encode(list)
+	case "POST":
+		name := req.Form.Get("name")
+		if name == "" || strings.Contains(name, " ") {
+			http.Error(res, "400 Bad Request. name must be a single word", http.StatusBadRequest)
+			return
+		}
+		plain, hash, err := auth.NewSecret()
+		if err != nil {
+			config.Log("api").Error("failed to generate the secret of an integration", config.F("name", name), config.Remote(clientAddr(req)), config.Err(err))
+			http.Error(res, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		hook := &integration.Integration{Name: name, Hash: hash}
+		if req.Form.Get("channel") != "" {
+			channelNum, err := strconv.Atoi(req.Form.Get("channel"))
+			if err != nil {
+				http.Error(res, "400 Bad Request. channel must be a number", http.StatusBadRequest)
+				return
+			}
+			hook.Channel = sql.NullInt64{Valid: true, Int64: int64(channelNum)}
+		}
+		if err := db.CreateIntegration(hook); err != nil {
+			integrationStoreFailed(res, req, fmt.Sprintf("failed to save integration %s", name), err)
+			return
+		}
+		config.Log("api").Info("integration created", config.F("integration", hook.ID), config.F("name", hook.Name), config.F("identity", tok.Identity))
+		res.WriteHeader(201)
+		json.NewEncoder(res).Encode(newIntegrationResponse(*hook, "/hooks/"+plain))
+	case "DELETE":
+		id, err := strconv.Atoi(req.Form.Get("id"))
+		if err != nil {
+			http.Error(res, "400 Bad Request", http.StatusBadRequest)
+			return
+		}
+		if err := db.DeleteIntegration(id); err == db.ErrNoDatabase {
+			integrationStoreFailed(res, req, "failed to delete an integration", err)
+			return
+		} else if err != nil {
+			http.Error(res, fmt.Sprintf("404 not found. %v", err), http.StatusNotFound)
+			return
+		}
+		config.Log("api").Info("integration deleted", config.F("integration", id), config.F("identity", tok.Identity))
+		res.WriteHeader(200)
+		json.NewEncoder(res).Encode(map[string]string{"Success": fmt.Sprintf("deleted integration %d", id)})
+	default:
+		http.Error(res, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+//integrationStoreFailed answers a request the integrations could not be read or written for. without a database that is 503
+func integrationStoreFailed(res http.ResponseWriter, req *http.Request, message string, err error) {
+	if err == db.ErrNoDatabase {
+		http.Error(res, fmt.Sprintf("503 Service Unavailable. integrations are %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	config.Log("api").Error(message, config.Remote(clientAddr(req)), config.Err(err))
+	http.Error(res, "500 Internal Server Error", http.StatusInternalServerError)
+}
+
+func newIntegrationResponse(hook integration.Integration, url string) integrationResponse {
+	response := integrationResponse{ID: hook.ID, Name: hook.Name, URL: url}
+	if hook.Channel.Valid {
+		channelNum := hook.Channel.Int64
+		response.Channel = &channelNum
+	}
+	return response
+}
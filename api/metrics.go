@@ -0,0 +1,36 @@
+package api
+
+/*
+	OVERVIEW: GET /api/v1/metrics returns operational counters as JSON: the persistence pipeline and the telnet and web terminal sessions. Requires the admin scope.
+*/
+
+import (
+	"encoding/json"
+	"net/http"
+	"team-cymru-telnet/auth"
+	"team-cymru-telnet/db"
+	"team-cymru-telnet/server"
+)
+
+type metricsResponse struct {
+	Persistence db.PipelineStats       `json:"persistence"`
+	Connections server.ConnectionStats `json:"connections"`
+}
+
+func metricsHandler(res http.ResponseWriter, req *http.Request) {
+	tok, ok := authenticate(res, req)
+	if !ok || !requireScope(res, tok, auth.ScopeAdmin) {
+		return
+	}
+	if req.Method != "GET" {
+		http.Error(res, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(200)
+	json.NewEncoder(res).Encode(metricsResponse{
+		Persistence: db.PersistenceStats(),
+		Connections: server.Connections(),
+	})
+}
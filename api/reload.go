@@ -0,0 +1,35 @@
+package api
+
+/*
+	OVERVIEW: POST /api/v1/config/reload reloads the config like SIGHUP does and returns the applied and rejected fields.
+	An invalid config is not applied and the problems are returned with status 422. Requires the admin scope.
+*/
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"team-cymru-telnet/auth"
+	"team-cymru-telnet/server"
+)
+
+func reloadHandler(res http.ResponseWriter, req *http.Request) {
+	tok, ok := authenticate(res, req)
+	if !ok || !requireScope(res, tok, auth.ScopeAdmin) {
+		return
+	}
+	if req.Method != "POST" {
+		http.Error(res, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	result, err := server.ReloadConfig(tok.Identity)
+	res.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		res.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(res).Encode(map[string][]string{"errors": strings.Split(err.Error(), "\n")})
+		return
+	}
+	res.WriteHeader(200)
+	json.NewEncoder(res).Encode(result)
+}
@@ -0,0 +1,35 @@
+package api
+
+/*
+	OVERVIEW: GET /api/v1/retention is a dry run of the retention janitor. It returns, per rule, how many messages are expired and would be deleted
+	by the next run, without deleting anything. Requires the admin scope.
+*/
+
+import (
+	"encoding/json"
+	"net/http"
+	"team-cymru-telnet/auth"
+	"team-cymru-telnet/config"
+	"team-cymru-telnet/retention"
+)
+
+func retentionHandler(res http.ResponseWriter, req *http.Request) {
+	tok, ok := authenticate(res, req)
+	if !ok || !requireScope(res, tok, auth.ScopeAdmin) {
+		return
+	}
+	if req.Method != "GET" {
+		http.Error(res, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report, err := retention.DryRun()
+	if err != nil {
+		config.Log("api").Error("retention dry run failed", config.Remote(clientAddr(req)), config.Err(err))
+		http.Error(res, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(200)
+	json.NewEncoder(res).Encode(report)
+}
@@ -0,0 +1,80 @@
+package api
+
+/*
+	OVERVIEW: GET /api/v1/search?q=<query>&limit=<n> searches message bodies with the same query syntax as the /search telnet command.
+	Requires the read:history scope, private messages are only searched for tokens with read:pm. Matches are wrapped in <mark></mark> in the snippet.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"team-cymru-telnet/auth"
+	"team-cymru-telnet/config"
+	"team-cymru-telnet/search"
+	"time"
+)
+
+type searchResult struct {
+	ID          int       `json:"id"`
+	User        string    `json:"user"`
+	Channel     *int64    `json:"channel,omitempty"`
+	MessageType string    `json:"message_type"`
+	Message     string    `json:"message"`
+	Snippet     string    `json:"snippet"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func searchHandler(res http.ResponseWriter, req *http.Request) {
+	tok, ok := authenticate(res, req)
+	if !ok || !requireScope(res, tok, auth.ScopeReadHistory) {
+		return
+	}
+	if req.Method != "GET" {
+		http.Error(res, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	values := req.URL.Query()
+	query, err := search.ParseQuery(values.Get("q"))
+	if err != nil {
+		http.Error(res, fmt.Sprintf("400 Bad Request. %v", err), http.StatusBadRequest)
+		return
+	}
+	query.IncludePM = auth.HasScope(tok, auth.ScopeReadPM)
+	query.Viewer = tok.Identity
+
+	limit := 50
+	if n, err := strconv.Atoi(values.Get("limit")); err == nil && n > 0 && n <= 100 {
+		limit = n
+	}
+
+	messages, err := search.Search(query, limit)
+	if err != nil {
+		config.Log("api").Error("search failed", config.Remote(clientAddr(req)), config.Err(err))
+		http.Error(res, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	results := []searchResult{}
+	for _, message := range messages {
+		result := searchResult{
+			ID:          message.ID,
+			User:        message.User,
+			MessageType: message.MessageType,
+			Message:     message.Message,
+			Snippet:     search.HTMLSnippet(message.Message, query, 80),
+			CreatedAt:   message.CreatedAt,
+		}
+		if message.Channel.Valid {
+			channelNum := message.Channel.Int64
+			result.Channel = &channelNum
+		}
+		results = append(results, result)
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(200)
+	json.NewEncoder(res).Encode(results)
+}
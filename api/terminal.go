@@ -0,0 +1,119 @@
+package api
+
+/*
+	OVERVIEW: Web terminal for users without a telnet client. GET /terminal serves a single page which opens a WebSocket to /terminal/ws.
+	The WebSocket is bridged byte for byte into server.ServeConn so prompts, commands, and output are the same as a real telnet session.
+	The page behaves like a line mode telnet client: typed characters are echoed and edited locally and the line is sent with "\r\n" on enter.
+*/
+
+import (
+	"net/http"
+	"team-cymru-telnet/config"
+	"team-cymru-telnet/server"
+)
+
+func terminalHandler(res http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/terminal" {
+		http.Error(res, "404 not found", http.StatusNotFound)
+		return
+	}
+	if req.Method != "GET" {
+		http.Error(res, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.WriteHeader(200)
+	res.Write([]byte(terminalPage))
+}
+
+func terminalSocketHandler(res http.ResponseWriter, req *http.Request) {
+	conn, err := upgradeWebsocket(res, req)
+	if err == errForbiddenOrigin {
+		config.Log("api").Warning("web terminal upgrade refused for its origin", config.Remote(clientAddr(req)), config.F("origin", req.Header.Get("Origin")))
+		http.Error(res, "403 Forbidden", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		config.Log("api").Error("web terminal upgrade failed", config.Remote(clientAddr(req)), config.Err(err))
+		http.Error(res, "400 Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	config.Log("api").Info("web terminal opened", config.Remote(clientAddr(req)))
+	//the http server runs every handler in its own go routine so the session can block here until the user leaves
+	server.ServeConn(conn)
+}
+
+const terminalPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Telnet Chat</title>
+<style>
+	body { margin: 0; background: #000; }
+	#screen { margin: 0; padding: 8px; min-height: 100vh; box-sizing: border-box; color: #ddd; font: 14px monospace; white-space: pre-wrap; word-break: break-all; outline: none; }
+	#cursor { background: #ddd; }
+</style>
+</head>
+<body>
+<pre id="screen" tabindex="0"><span id="output"></span><span id="line"></span><span id="cursor"> </span></pre>
+<script>
+(function () {
+	var screen = document.getElementById("screen");
+	var output = document.getElementById("output");
+	var lineView = document.getElementById("line");
+	var line = "";
+	var encoder = new TextEncoder();
+	var decoder = new TextDecoder();
+
+	var scheme = location.protocol === "https:" ? "wss://" : "ws://";
+	var socket = new WebSocket(scheme + location.host + "/terminal/ws");
+	socket.binaryType = "arraybuffer";
+
+	function write(text) {
+		//the telnet session pads some writes with NUL bytes and ends lines with \r\n
+		output.textContent += text.replace(/\u0000/g, "").replace(/\r/g, "");
+		window.scrollTo(0, document.body.scrollHeight);
+	}
+
+	socket.onmessage = function (event) {
+		write(decoder.decode(new Uint8Array(event.data), { stream: true }));
+	};
+	socket.onclose = function () {
+		write("\n[connection closed]\n");
+	};
+
+	screen.addEventListener("keydown", function (event) {
+		if (event.ctrlKey || event.metaKey || event.altKey) {
+			return;
+		}
+		if (event.key === "Enter") {
+			output.textContent += line + "\n";
+			if (socket.readyState === WebSocket.OPEN) {
+				socket.send(encoder.encode(line + "\r\n"));
+			}
+			line = "";
+		} else if (event.key === "Backspace") {
+			line = line.slice(0, -1);
+		} else if (event.key.length === 1) {
+			line += event.key;
+		} else {
+			return;
+		}
+		lineView.textContent = line;
+		event.preventDefault();
+	});
+
+	screen.addEventListener("paste", function (event) {
+		line += event.clipboardData.getData("text").replace(/[\r\n]/g, "");
+		lineView.textContent = line;
+		event.preventDefault();
+	});
+
+	screen.focus();
+})();
+</script>
+</body>
+</html>
+`
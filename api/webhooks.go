@@ -0,0 +1,157 @@
+package api
+
+/*
+	OVERVIEW: Admin endpoints for outgoing webhooks. Both require a token with the admin scope.
+	/api/v1/webhooks: GET lists subscriptions, POST creates one from "url", "events", "channel", "keywords" and "secret", DELETE removes the subscription in "id".
+	/api/v1/webhooks/deliveries: GET returns the latest deliveries and their status. Accepts the optional "subscription", "status" and "limit" parameters.
+*/
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"team-cymru-telnet/auth"
+	"team-cymru-telnet/config"
+	"team-cymru-telnet/models/webhook"
+	"team-cymru-telnet/webhooks"
+	"time"
+)
+
+//subscriptionResponse never includes the secret
+type subscriptionResponse struct {
+	ID       int    `json:"id"`
+	URL      string `json:"url"`
+	Events   string `json:"events"`
+	Channel  *int64 `json:"channel,omitempty"`
+	Keywords string `json:"keywords,omitempty"`
+}
+
+type deliveryResponse struct {
+	ID             int       `json:"id"`
+	SubscriptionID int       `json:"subscription_id"`
+	Event          string    `json:"event"`
+	Status         string    `json:"status"`
+	Attempts       int       `json:"attempts"`
+	ResponseCode   int       `json:"response_code,omitempty"`
+	LastError      string    `json:"last_error,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+func webhookHandler(res http.ResponseWriter, req *http.Request) {
+	tok, ok := authenticate(res, req)
+	if !ok || !requireScope(res, tok, auth.ScopeAdmin) {
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		http.Error(res, "400 Bad Request", http.StatusBadRequest)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+
+	switch req.Method {
+	case "GET":
+		subscriptions, err := webhooks.ListSubscriptions()
+		if err != nil {
+			config.Log("api").Error("failed to list webhook subscriptions", config.Remote(clientAddr(req)), config.Err(err))
+			http.Error(res, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		list := []subscriptionResponse{}
+		for _, sub := range subscriptions {
+			list = append(list, newSubscriptionResponse(sub))
+		}
+		res.WriteHeader(200)
+		json.NewEncoder(res).Encode(list)
+	case "POST":
+		sub := &webhook.Subscription{
+			URL:      req.Form.Get("url"),
+			Events:   req.Form.Get("events"),
+			Keywords: req.Form.Get("keywords"),
+			Secret:   req.Form.Get("secret"),
+		}
+		if req.Form.Get("channel") != "" {
+			channelNum, err := strconv.Atoi(req.Form.Get("channel"))
+			if err != nil {
+				http.Error(res, "400 Bad Request. channel must be a number", http.StatusBadRequest)
+				return
+			}
+			sub.Channel = sql.NullInt64{Valid: true, Int64: int64(channelNum)}
+		}
+		if err := webhooks.CreateSubscription(sub); err != nil {
+			http.Error(res, fmt.Sprintf("400 Bad Request. %v", err), http.StatusBadRequest)
+			return
+		}
+		config.Log("api").Info("webhook subscription created", config.F("subscription", sub.ID), config.F("url", sub.URL), config.F("identity", tok.Identity))
+		res.WriteHeader(201)
+		json.NewEncoder(res).Encode(newSubscriptionResponse(*sub))
+	case "DELETE":
+		id, err := strconv.Atoi(req.Form.Get("id"))
+		if err != nil {
+			http.Error(res, "400 Bad Request", http.StatusBadRequest)
+			return
+		}
+		if err := webhooks.DeleteSubscription(id); err != nil {
+			http.Error(res, fmt.Sprintf("404 not found. %v", err), http.StatusNotFound)
+			return
+		}
+		config.Log("api").Info("webhook subscription deleted", config.F("subscription", id), config.F("identity", tok.Identity))
+		res.WriteHeader(200)
+		json.NewEncoder(res).Encode(map[string]string{"Success": fmt.Sprintf("deleted subscription %d", id)})
+	default:
+		http.Error(res, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func webhookDeliveryHandler(res http.ResponseWriter, req *http.Request) {
+	tok, ok := authenticate(res, req)
+	if !ok || !requireScope(res, tok, auth.ScopeAdmin) {
+		return
+	}
+	if req.Method != "GET" {
+		http.Error(res, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	values := req.URL.Query()
+	subscriptionID, _ := strconv.Atoi(values.Get("subscription"))
+	limit := 100
+	if n, err := strconv.Atoi(values.Get("limit")); err == nil && n > 0 && n < limit {
+		limit = n
+	}
+
+	deliveries, err := webhooks.ListDeliveries(subscriptionID, values.Get("status"), limit)
+	if err != nil {
+		config.Log("api").Error("failed to list webhook deliveries", config.Remote(clientAddr(req)), config.Err(err))
+		http.Error(res, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	list := []deliveryResponse{}
+	for _, d := range deliveries {
+		list = append(list, deliveryResponse{
+			ID:             d.ID,
+			SubscriptionID: d.SubscriptionID,
+			Event:          d.Event,
+			Status:         d.Status,
+			Attempts:       d.Attempts,
+			ResponseCode:   d.ResponseCode,
+			LastError:      d.LastError,
+			CreatedAt:      d.CreatedAt,
+			UpdatedAt:      d.UpdatedAt,
+		})
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(200)
+	json.NewEncoder(res).Encode(list)
+}
+
+func newSubscriptionResponse(sub webhook.Subscription) subscriptionResponse {
+	response := subscriptionResponse{ID: sub.ID, URL: sub.URL, Events: sub.Events, Keywords: sub.Keywords}
+	if sub.Channel.Valid {
+		channelNum := sub.Channel.Int64
+		response.Channel = &channelNum
+	}
+	return response
+}
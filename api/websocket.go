@@ -0,0 +1,280 @@
+package api
+
+/*
+	OVERVIEW: Minimal server side WebSocket (RFC 6455) implementation used by the web terminal. Only the net/http package is used so no third party
+	router or websocket package is required.
+	wsConn implements net.Conn so the upgraded connection can be handed straight to server.ServeConn. Every Write is sent as a single binary frame
+	and Read returns the payload of the data frames sent by the browser, which are the raw bytes typed into the terminal.
+	Browsers send the Origin of the page that opens a WebSocket. Only the server's own host and terminalOrigins are accepted, so a page on another
+	site cannot open a session from the browser of someone visiting it. A frame that breaks the protocol closes the connection with status 1002.
+*/
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"team-cymru-telnet/config"
+	"time"
+)
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+//frame opcodes
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+//largest frame payload accepted from a browser. the telnet session only reads 1024 bytes at a time so anything bigger is not a terminal
+const maxFramePayload = 64 * 1024
+
+//largest payload of a control frame allowed by RFC 6455
+const maxControlPayload = 125
+
+//close status sent for a frame that breaks the protocol
+const closeProtocolError = 1002
+
+var errWebsocketClosed = errors.New("websocket connection is closed")
+
+//errForbiddenOrigin is returned for an upgrade from a page that is not allowed to open the terminal
+var errForbiddenOrigin = errors.New("websocket origin is not allowed")
+
+//protocolError is a frame the client must not send. the connection is closed with closeProtocolError
+type protocolError string
+
+func (p protocolError) Error() string {
+	return string(p)
+}
+
+type wsConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	pending []byte
+	//both the session and its listener goroutine write to the connection so frames have to be written one at a time
+	writeMutex sync.Mutex
+	closed     bool
+	//the client, which is not the peer of conn behind a reverse proxy, see forwarded.go
+	remoteAddr net.Addr
+}
+
+func upgradeWebsocket(res http.ResponseWriter, req *http.Request) (*wsConn, error) {
+	if req.Method != "GET" {
+		return nil, errors.New("websocket upgrade requires a GET request")
+	}
+	if !headerContains(req.Header, "Connection", "upgrade") || !headerContains(req.Header, "Upgrade", "websocket") {
+		return nil, errors.New("missing websocket upgrade headers")
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, errors.New("missing Sec-WebSocket-Key header")
+	}
+	//clients that are not browsers, e.g. scripts, do not send an Origin
+	if origin := req.Header.Get("Origin"); origin != "" && !allowedOrigin(origin, req.Host) {
+		return nil, errForbiddenOrigin
+	}
+
+	hijacker, ok := res.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("response writer does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\n")
+	rw.WriteString("Connection: Upgrade\r\n")
+	rw.WriteString(fmt.Sprintf("Sec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(hash[:])))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &wsConn{conn: conn, reader: rw.Reader, remoteAddr: clientAddr(req)}, nil
+}
+
+//allowedOrigin is true for a page served by host, the Host header of the upgrade request, or one of terminalOrigins
+func allowedOrigin(origin string, host string) bool {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, host) {
+		return true
+	}
+	for _, allowed := range config.Cfg.TerminalOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+//headers like Connection can hold a comma separated list of tokens, e.g. "keep-alive, Upgrade"
+func headerContains(header http.Header, name string, token string) bool {
+	for _, value := range header[name] {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (ws *wsConn) Read(p []byte) (int, error) {
+	for len(ws.pending) == 0 {
+		opcode, payload, err := ws.readFrame()
+		if _, ok := err.(protocolError); ok {
+			status := [2]byte{}
+			binary.BigEndian.PutUint16(status[:], closeProtocolError)
+			ws.writeFrame(opClose, status[:])
+		}
+		if err != nil {
+			return 0, err
+		}
+		switch opcode {
+		case opText, opBinary, opContinuation:
+			ws.pending = payload
+		case opPing:
+			ws.writeFrame(opPong, payload)
+		case opPong:
+		case opClose:
+			ws.writeFrame(opClose, nil)
+			return 0, io.EOF
+		default:
+			return 0, fmt.Errorf("unsupported websocket opcode %d", opcode)
+		}
+	}
+
+	n := copy(p, ws.pending)
+	ws.pending = ws.pending[n:]
+	return n, nil
+}
+
+func (ws *wsConn) readFrame() (byte, []byte, error) {
+	header := [2]byte{}
+	if _, err := io.ReadFull(ws.reader, header[:]); err != nil {
+		return 0, nil, err
+	}
+	final := header[0]&0x80 != 0
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		ext := [2]byte{}
+		if _, err := io.ReadFull(ws.reader, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		ext := [8]byte{}
+		if _, err := io.ReadFull(ws.reader, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > maxFramePayload {
+		return 0, nil, fmt.Errorf("websocket frame of %d bytes is too large", length)
+	}
+	//RFC 6455 requires every frame sent by a client to be masked
+	if !masked {
+		return 0, nil, protocolError("received unmasked websocket frame from client")
+	}
+	//control frames, close, ping and pong, cannot be fragmented or carry more than 125 bytes
+	if opcode&0x8 != 0 && (!final || length > maxControlPayload) {
+		return 0, nil, protocolError(fmt.Sprintf("invalid websocket control frame of %d bytes", length))
+	}
+
+	mask := [4]byte{}
+	if _, err := io.ReadFull(ws.reader, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.reader, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+func (ws *wsConn) Write(p []byte) (int, error) {
+	if err := ws.writeFrame(opBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	ws.writeMutex.Lock()
+	defer ws.writeMutex.Unlock()
+	if ws.closed {
+		return errWebsocketClosed
+	}
+
+	//FIN bit is always set, messages are never fragmented by the server
+	frame := []byte{0x80 | opcode}
+	length := len(payload)
+	switch {
+	case length < 126:
+		frame = append(frame, byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, 126, byte(length>>8), byte(length))
+	default:
+		ext := [8]byte{}
+		binary.BigEndian.PutUint64(ext[:], uint64(length))
+		frame = append(frame, 127)
+		frame = append(frame, ext[:]...)
+	}
+	frame = append(frame, payload...)
+
+	_, err := ws.conn.Write(frame)
+	return err
+}
+
+func (ws *wsConn) Close() error {
+	ws.writeFrame(opClose, nil)
+	ws.writeMutex.Lock()
+	ws.closed = true
+	ws.writeMutex.Unlock()
+	return ws.conn.Close()
+}
+
+func (ws *wsConn) LocalAddr() net.Addr {
+	return ws.conn.LocalAddr()
+}
+
+func (ws *wsConn) RemoteAddr() net.Addr {
+	return ws.remoteAddr
+}
+
+func (ws *wsConn) SetDeadline(t time.Time) error {
+	return ws.conn.SetDeadline(t)
+}
+
+func (ws *wsConn) SetReadDeadline(t time.Time) error {
+	return ws.conn.SetReadDeadline(t)
+}
+
+func (ws *wsConn) SetWriteDeadline(t time.Time) error {
+	return ws.conn.SetWriteDeadline(t)
+}
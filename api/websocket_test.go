@@ -0,0 +1,163 @@
+package api
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"team-cymru-telnet/config"
+	"testing"
+)
+
+func TestWebsocketEcho(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		ws, err := upgradeWebsocket(res, req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer ws.Close()
+		buf := [1024]byte{}
+		n, err := ws.Read(buf[0:])
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ws.Write(buf[0:n])
+	}))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	key := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: " + key + "\r\n\r\n"))
+
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101 got %d", res.StatusCode)
+	}
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	if res.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(hash[:]) {
+		t.Fatalf("unexpected Sec-WebSocket-Accept %s", res.Header.Get("Sec-WebSocket-Accept"))
+	}
+
+	payload := []byte("/help\r\n")
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opBinary, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	conn.Write(frame)
+
+	header := make([]byte, 2)
+	if _, err := reader.Read(header); err != nil {
+		t.Fatal(err)
+	}
+	if header[0] != 0x80|opBinary || int(header[1]) != len(payload) {
+		t.Fatalf("unexpected frame header %v", header)
+	}
+	echo := make([]byte, len(payload))
+	if _, err := reader.Read(echo); err != nil {
+		t.Fatal(err)
+	}
+	if string(echo) != string(payload) {
+		t.Fatalf("expected %q got %q", payload, echo)
+	}
+}
+
+// dialWebsocket sends an upgrade request with origin, when it is set, and returns the response
+func dialWebsocket(t *testing.T, srv *httptest.Server, origin string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := "GET / HTTP/1.1\r\nHost: " + strings.TrimPrefix(srv.URL, "http://") + "\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: " + base64.StdEncoding.EncodeToString([]byte("0123456789abcdef")) + "\r\n"
+	if origin != "" {
+		request += "Origin: " + origin + "\r\n"
+	}
+	conn.Write([]byte(request + "\r\n"))
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, reader, res
+}
+
+func TestWebsocketOrigin(t *testing.T) {
+	config.Cfg.LogFile = t.TempDir() + "/ChatServer"
+	config.Logs()
+	config.Cfg.TerminalOrigins = []string{"https://chat.example.com"}
+	defer func() { config.Cfg.TerminalOrigins = nil }()
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		ws, err := upgradeWebsocket(res, req)
+		if err == errForbiddenOrigin {
+			http.Error(res, "403 Forbidden", http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ws.Close()
+	}))
+	defer srv.Close()
+
+	for origin, status := range map[string]int{
+		"":                              http.StatusSwitchingProtocols,
+		srv.URL:                         http.StatusSwitchingProtocols,
+		"https://chat.example.com":      http.StatusSwitchingProtocols,
+		"https://attacker.example.com":  http.StatusForbidden,
+		"http://chat.example.com.other": http.StatusForbidden,
+	} {
+		conn, _, res := dialWebsocket(t, srv, origin)
+		conn.Close()
+		if res.StatusCode != status {
+			t.Errorf("origin %q: expected %d got %d", origin, status, res.StatusCode)
+		}
+	}
+}
+
+func TestWebsocketControlFrameTooLarge(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		ws, err := upgradeWebsocket(res, req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer ws.Close()
+		buf := [1024]byte{}
+		if _, err := ws.Read(buf[0:]); err == nil {
+			t.Error("a ping of 126 bytes was accepted")
+		}
+	}))
+	defer srv.Close()
+
+	conn, reader, _ := dialWebsocket(t, srv, "")
+	defer conn.Close()
+	payload := make([]byte, maxControlPayload+1)
+	frame := []byte{0x80 | opPing, 0x80 | 126, 0, byte(len(payload)), 0, 0, 0, 0}
+	conn.Write(append(frame, payload...))
+
+	closeFrame := make([]byte, 4)
+	if _, err := io.ReadFull(reader, closeFrame); err != nil {
+		t.Fatal(err)
+	}
+	if closeFrame[0] != 0x80|opClose || closeFrame[1] != 2 || int(closeFrame[2])<<8|int(closeFrame[3]) != closeProtocolError {
+		t.Fatalf("expected a close frame with status 1002, got %v", closeFrame)
+	}
+}
@@ -0,0 +1,166 @@
+package auth
+
+/*
+	OVERVIEW: API token management shared by the HTTP API and the telnet admin commands.
+	A token is 32 random bytes encoded as hex. Only its SHA-256 hash is saved in the database so a leaked database does not leak usable tokens.
+	Every token is bound to an identity, the name messages posted with the token are attributed to, and a set of scopes limiting what it can do.
+	Tokens need a database, with the memory and file dialects every function returns db.ErrNoDatabase. The exception is Authenticate, which
+	also accepts the tokens listed in the apiTokens config parameter so the API works without a database. Those are revoked by removing them
+	from the config and reloading it.
+*/
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"team-cymru-telnet/config"
+	"team-cymru-telnet/db"
+	"team-cymru-telnet/models/token"
+)
+
+const (
+	ScopeReadHistory   = "read:history"
+	ScopeReadPM        = "read:pm"
+	ScopePostBroadcast = "post:broadcast"
+	ScopePostChannel   = "post:channel"
+	//admin allows managing tokens through the API
+	ScopeAdmin = "admin"
+)
+
+var validScopes []string = []string{ScopeReadHistory, ScopeReadPM, ScopePostBroadcast, ScopePostChannel, ScopeAdmin}
+
+var ErrInvalidToken = errors.New("invalid or revoked token")
+
+//CreateToken - generates a new token for identity. The returned string is the only copy of the token, it cannot be recovered later
+func CreateToken(identity string, scopes []string) (string, *token.Token, error) {
+	if identity == "" || strings.Contains(identity, " ") {
+		return "", nil, errors.New("identity must be a single word")
+	}
+	if len(scopes) == 0 {
+		return "", nil, errors.New("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !validScope(scope) {
+			return "", nil, fmt.Errorf("unknown scope %s. valid scopes are %s", scope, strings.Join(validScopes, ", "))
+		}
+	}
+
+	if !db.DB.Connected {
+		return "", nil, db.ErrNoDatabase
+	}
+	plain, hash, err := NewSecret()
+	if err != nil {
+		return "", nil, err
+	}
+
+	tok := &token.Token{
+		Identity: identity,
+		Scopes:   strings.Join(scopes, ","),
+		Hash:     hash,
+	}
+	if err := db.DB.Conn.Save(tok).Error; err != nil {
+		return "", nil, err
+	}
+	return plain, tok, nil
+}
+
+func RevokeToken(id int) error {
+	if !db.DB.Connected {
+		return db.ErrNoDatabase
+	}
+	result := db.DB.Conn.Model(&token.Token{}).Where("id = ?", id).Update("revoked", true)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("token %d does not exist", id)
+	}
+	return nil
+}
+
+func ListTokens() ([]token.Token, error) {
+	if !db.DB.Connected {
+		return nil, db.ErrNoDatabase
+	}
+	tokens := []token.Token{}
+	err := db.DB.Conn.Order("id").Find(&tokens).Error
+	return tokens, err
+}
+
+//Authenticate - returns the token matching the plain text value if it is in the config, or in the database and has not been revoked
+func Authenticate(plain string) (*token.Token, error) {
+	if plain == "" {
+		return nil, ErrInvalidToken
+	}
+	hash := Hash(plain)
+	if tok := configToken(hash); tok != nil {
+		return tok, nil
+	}
+	if !db.DB.Connected {
+		return nil, ErrInvalidToken
+	}
+	tok := &token.Token{}
+	if db.DB.Conn.Where("hash = ? AND revoked = ?", hash, false).First(tok).RecordNotFound() {
+		return nil, ErrInvalidToken
+	}
+	return tok, nil
+}
+
+//configToken - the apiTokens entry with the hash. config tokens have no id
+func configToken(hash string) *token.Token {
+	for _, configured := range config.Cfg.APITokens {
+		if subtle.ConstantTimeCompare([]byte(strings.ToLower(configured.Hash)), []byte(hash)) == 1 {
+			return &token.Token{Identity: configured.Identity, Scopes: strings.Join(ParseScopes(configured.Scopes), ","), Hash: hash}
+		}
+	}
+	return nil
+}
+
+func HasScope(tok *token.Token, scope string) bool {
+	for _, s := range strings.Split(tok.Scopes, ",") {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+//ParseScopes - splits a comma separated scope list, e.g. "read:history,post:broadcast"
+func ParseScopes(scopes string) []string {
+	parsed := []string{}
+	for _, scope := range strings.Split(scopes, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope != "" {
+			parsed = append(parsed, scope)
+		}
+	}
+	return parsed
+}
+
+func validScope(scope string) bool {
+	for _, s := range validScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+//NewSecret - returns a random secret and the hash that should be stored in its place. used for API tokens and incoming webhook URLs
+func NewSecret() (string, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	plain := hex.EncodeToString(raw)
+	return plain, Hash(plain), nil
+}
+
+func Hash(plain string) string {
+	sum := sha256.Sum256([]byte(plain))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,161 @@
+package auth
+
+/*
+	OVERVIEW: Public keys for the SSH listener. A key belongs to one user and logs that user in, the SSH user name has to match.
+	Keys are registered in the database with the /sshkey admin commands, or listed in the file named by sshAuthorizedKeysFile.
+	That file uses the authorized_keys format with the user name as the comment, e.g. "ssh-ed25519 AAAAC3Nza... stuart". Options are ignored.
+	The file is read on every login so edits apply straight away. The database keys need a database, the file does not.
+	A user with a registered key can only log in with it, SSHKeyOwner keeps the name from being typed at the telnet prompt.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"team-cymru-telnet/config"
+	"team-cymru-telnet/db"
+	"team-cymru-telnet/models/sshkey"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var ErrUnknownKey = errors.New("unknown public key")
+
+//AddSSHKey - registers the public key, in authorized_keys format, for user
+func AddSSHKey(user string, authorizedKey string) (*sshkey.SSHKey, error) {
+	if user == "" || strings.Contains(user, " ") {
+		return nil, errors.New("user must be a single word")
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if err != nil {
+		return nil, fmt.Errorf("not a public key in authorized_keys format. %v", err)
+	}
+	if !db.DB.Connected {
+		return nil, db.ErrNoDatabase
+	}
+
+	key := &sshkey.SSHKey{
+		User:        user,
+		PublicKey:   strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))),
+		Fingerprint: ssh.FingerprintSHA256(publicKey),
+	}
+	existing := &sshkey.SSHKey{}
+	if !db.DB.Conn.Where("fingerprint = ?", key.Fingerprint).First(existing).RecordNotFound() {
+		return nil, fmt.Errorf("the key is already registered for %s", existing.User)
+	}
+	if err := db.DB.Conn.Save(key).Error; err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func RemoveSSHKey(id int) error {
+	if !db.DB.Connected {
+		return db.ErrNoDatabase
+	}
+	result := db.DB.Conn.Where("id = ?", id).Delete(&sshkey.SSHKey{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("ssh key %d does not exist", id)
+	}
+	return nil
+}
+
+func ListSSHKeys() ([]sshkey.SSHKey, error) {
+	if !db.DB.Connected {
+		return nil, db.ErrNoDatabase
+	}
+	keys := []sshkey.SSHKey{}
+	err := db.DB.Conn.Order("id").Find(&keys).Error
+	return keys, err
+}
+
+//SSHKeyUser - the user the public key is registered for, in the authorized keys file or the database. ErrUnknownKey when it is in neither
+func SSHKeyUser(publicKey ssh.PublicKey) (string, error) {
+	if path := config.Cfg.SSHAuthorizedKeysFile; path != "" {
+		user, err := authorizedKeysUser(path, publicKey)
+		if err != ErrUnknownKey {
+			return user, err
+		}
+	}
+	if !db.DB.Connected {
+		return "", ErrUnknownKey
+	}
+	key := &sshkey.SSHKey{}
+	if db.DB.Conn.Where("fingerprint = ?", ssh.FingerprintSHA256(publicKey)).First(key).RecordNotFound() {
+		return "", ErrUnknownKey
+	}
+	return key.User, nil
+}
+
+//SSHKeyOwner - true when a public key is registered for user, in the authorized keys file or the database. such a user can only log in
+//with the key
+func SSHKeyOwner(user string) (bool, error) {
+	if path := config.Cfg.SSHAuthorizedKeysFile; path != "" {
+		found := false
+		err := authorizedKeys(path, func(listed ssh.PublicKey, owner string) bool {
+			found = owner == user
+			return found
+		})
+		if err != nil || found {
+			return found, err
+		}
+	}
+	if !db.DB.Connected {
+		return false, nil
+	}
+	count := 0
+	if err := db.DB.Conn.Model(&sshkey.SSHKey{}).Where("user_name = ?", user).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+//authorizedKeysUser looks the key up in an authorized_keys style file
+func authorizedKeysUser(path string, publicKey ssh.PublicKey) (string, error) {
+	wanted := publicKey.Marshal()
+	user := ""
+	err := authorizedKeys(path, func(listed ssh.PublicKey, owner string) bool {
+		if bytes.Equal(listed.Marshal(), wanted) {
+			user = owner
+		}
+		return user != ""
+	})
+	if err != nil {
+		return "", err
+	}
+	if user == "" {
+		return "", ErrUnknownKey
+	}
+	return user, nil
+}
+
+//authorizedKeys calls found with every key of an authorized_keys style file and its user until found returns true. lines which cannot be
+//parsed or have no single word user name are skipped
+func authorizedKeys(path string, found func(listed ssh.PublicKey, user string) bool) error {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		listed, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		user := strings.TrimSpace(comment)
+		if err != nil || user == "" || strings.Contains(user, " ") {
+			continue
+		}
+		if found(listed, user) {
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package cli
+
+/*
+	OVERVIEW: Subcommands run instead of the servers, e.g. "team-cymru-telnet -file config.json migrate status".
+	Run receives the arguments left after the flags and returns the exit code.
+	The config is loaded, and logging started, before a command runs. The config command loads the config itself so it can report an invalid one,
+	the token command does not need it.
+*/
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"team-cymru-telnet/config"
+)
+
+type command struct {
+	usage string
+	run   func(args []string, out io.Writer) int
+	//ownConfig commands call config.Load themselves, if they need the config, instead of config.Init
+	ownConfig bool
+}
+
+var commands = map[string]command{
+	"config":  {usage: "config print|check", run: configCommand, ownConfig: true},
+	"migrate": {usage: "migrate status|up|down|to <version>", run: migrateCommand},
+	"export":  {usage: "export [-format ndjson|csv|transcript] [-tz zone] [-out file] [filters]", run: exportCommand},
+	"import":  {usage: "import [-format server|irc|ndjson] [-tz zone] [-channel number] file...", run: importCommand},
+	"token":   {usage: "token new", run: tokenCommand, ownConfig: true},
+}
+
+func Run(args []string) int {
+	if len(args) == 0 {
+		return usage(os.Stderr)
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		return usage(os.Stderr)
+	}
+	if !cmd.ownConfig {
+		config.Init()
+	}
+	return cmd.run(args[1:], os.Stdout)
+}
+
+func usage(out io.Writer) int {
+	fmt.Fprintln(out, "commands:")
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %s\n", commands[name].usage)
+	}
+	return 2
+}
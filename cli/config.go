@@ -0,0 +1,40 @@
+package cli
+
+/*
+	OVERVIEW: The config subcommand. "config print" writes the effective configuration, after the config file, CHAT_* environment variables and
+	flags have been applied, as JSON. Secrets such as the password in connectionString are redacted.
+	"config check" validates the configuration without starting the servers and lists every problem. Both exit with 1 when the config is invalid.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"team-cymru-telnet/config"
+)
+
+func configCommand(args []string, out io.Writer) int {
+	if len(args) != 1 || (args[0] != "print" && args[0] != "check") {
+		fmt.Fprintln(out, "usage: config print|check")
+		return 2
+	}
+	err := config.Load()
+
+	if args[0] == "print" {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "    ")
+		if encodeErr := encoder.Encode(config.Redacted(*config.Cfg)); encodeErr != nil {
+			fmt.Fprintln(os.Stderr, encodeErr)
+			return 1
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration\n%v\n", err)
+		return 1
+	}
+	if args[0] == "check" {
+		fmt.Fprintln(out, "configuration is valid")
+	}
+	return 0
+}
@@ -0,0 +1,85 @@
+package cli
+
+/*
+	OVERVIEW: The export subcommand writes chat history to stdout or -out in ndjson, csv or transcript format.
+	It takes the same filters as GET /api/v1/export, e.g. "export -format transcript -tz Europe/London -channel 3 -after 2020-11-02T00:00:00Z".
+	Private messages are included, the subcommand runs with the access of whoever can read config.json.
+*/
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"team-cymru-telnet/db"
+	"team-cymru-telnet/export"
+	"time"
+)
+
+//the export itself may go to stdout so errors are written to stderr
+func exportCommand(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.SetOutput(os.Stderr)
+	format := flags.String("format", "ndjson", "ndjson, csv or transcript")
+	tz := flags.String("tz", "UTC", "time zone of the timestamps, e.g. Europe/London or Local")
+	outFile := flags.String("out", "", "file to write, stdout when empty")
+	user := flags.String("user", "", "only messages sent by this user")
+	channel := flags.Int("channel", 0, "only messages sent to this channel")
+	messageType := flags.String("message_type", "", "broadcast, channel, pm or integration")
+	recipient := flags.String("recipient", "", "only private messages sent to this user")
+	after := flags.String("after", "", "only messages sent after this RFC 3339 time")
+	before := flags.String("before", "", "only messages sent before this RFC 3339 time")
+	limit := flags.Int("limit", 0, "maximum number of messages, 0 for all")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if _, ok := export.Formats[*format]; !ok {
+		fmt.Fprintf(os.Stderr, "unknown format %q. use ndjson, csv or transcript\n", *format)
+		return 2
+	}
+	loc, err := time.LoadLocation(*tz)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unknown time zone %q\n", *tz)
+		return 2
+	}
+	filter := db.MessageFilter{User: *user, Channel: *channel, MessageType: *messageType, Recipient: *recipient, Limit: *limit}
+	if filter.After, err = parseTime(*after); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if filter.Before, err = parseTime(*before); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	var w io.Writer = out
+	if *outFile != "" {
+		file, err := os.OpenFile(*outFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer file.Close()
+		w = file
+	}
+
+	db.Connect()
+	if err := export.Write(w, *format, filter, loc); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+//parseTime - the zero time when value is empty
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf("%q is not an RFC 3339 time", value)
+	}
+	return t, nil
+}
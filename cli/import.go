@@ -0,0 +1,72 @@
+package cli
+
+/*
+	OVERVIEW: The import subcommand loads existing chat logs into the message store, e.g.
+	"import -format server config/ChatServer_2020-November-2.log" or "import -format irc -channel 3 -tz Europe/London #ops.log".
+	Every file is imported on its own and reported with the number of imported and duplicate messages. Lines that could not be parsed are listed
+	as file:line and the exit code is 1, the other lines of the file are still imported.
+*/
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"team-cymru-telnet/db"
+	"team-cymru-telnet/importer"
+	"time"
+)
+
+func importCommand(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	flags.SetOutput(out)
+	format := flags.String("format", "server", strings.Join(importer.Formats, ", "))
+	tz := flags.String("tz", "Local", "time zone of timestamps without one, e.g. Europe/London")
+	channel := flags.Int("channel", 0, "channel for messages from irc logs, broadcast when 0")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		fmt.Fprintln(out, "usage: import [-format server|irc|ndjson] [-tz zone] [-channel number] file...")
+		return 2
+	}
+	loc, err := time.LoadLocation(*tz)
+	if err != nil {
+		fmt.Fprintf(out, "unknown time zone %q\n", *tz)
+		return 2
+	}
+	if _, err := importer.NewParser(*format, loc, *channel); err != nil {
+		fmt.Fprintln(out, err)
+		return 2
+	}
+
+	db.Connect()
+	code := 0
+	for _, path := range flags.Args() {
+		//irssi parsers carry the date from line to line so every file gets a new one
+		parser, _ := importer.NewParser(*format, loc, *channel)
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintln(out, err)
+			code = 1
+			continue
+		}
+		result, err := importer.Import(file, parser, db.Messages)
+		file.Close()
+
+		for _, parseErr := range result.Errors {
+			fmt.Fprintf(out, "%s:%d: %v\n", path, parseErr.Line, parseErr.Err)
+		}
+		fmt.Fprintf(out, "%s: %d lines, %d messages, %d imported, %d duplicates, %d errors\n",
+			path, result.Lines, result.Parsed, result.Imported, result.Duplicates, len(result.Errors))
+		if err != nil {
+			fmt.Fprintf(out, "%s: %v\n", path, err)
+			code = 1
+		}
+		if len(result.Errors) > 0 {
+			code = 1
+		}
+	}
+	return code
+}
@@ -0,0 +1,80 @@
+package cli
+
+/*
+	OVERVIEW: The migrate subcommand. status lists every migration and when it was applied, up applies the pending ones,
+	down reverts the latest one and to <version> moves the schema up or down to that version. 0 reverts every migration.
+*/
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"team-cymru-telnet/config"
+	"team-cymru-telnet/db"
+	"time"
+)
+
+func migrateCommand(args []string, out io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprintln(out, "usage: migrate status|up|down|to <version>")
+		return 2
+	}
+	if config.Cfg.Dialect == "memory" || config.Cfg.Dialect == "file" {
+		fmt.Fprintf(out, "the %s dialect has no schema to migrate\n", config.Cfg.Dialect)
+		return 1
+	}
+	db.Open()
+
+	var ran []db.Migration
+	var err error
+	switch args[0] {
+	case "status":
+		return migrationStatus(out)
+	case "up":
+		ran, err = db.MigrateUp()
+	case "down":
+		ran, err = db.MigrateDown()
+	case "to":
+		if len(args) != 2 {
+			fmt.Fprintln(out, "usage: migrate to <version>")
+			return 2
+		}
+		version, convErr := strconv.Atoi(args[1])
+		if convErr != nil {
+			fmt.Fprintf(out, "version must be a number, got %q\n", args[1])
+			return 2
+		}
+		ran, err = db.MigrateTo(version)
+	default:
+		fmt.Fprintf(out, "unknown migrate command %q\n", args[0])
+		return 2
+	}
+
+	for _, migration := range ran {
+		fmt.Fprintf(out, "%4d  %s\n", migration.Version, migration.Name)
+	}
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	if len(ran) == 0 {
+		fmt.Fprintln(out, "nothing to migrate")
+	}
+	return 0
+}
+
+func migrationStatus(out io.Writer) int {
+	states, err := db.MigrationStatus()
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	for _, state := range states {
+		applied := "pending"
+		if state.Applied {
+			applied = state.AppliedAt.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(out, "%4d  %-30s %s\n", state.Version, state.Name, applied)
+	}
+	return 0
+}
@@ -0,0 +1,27 @@
+package cli
+
+/*
+	OVERVIEW: The token subcommand. "token new" generates an API token for the apiTokens config parameter. It prints the token, which is
+	given to the client, and its hash, which goes in the config. It needs neither the config nor a database.
+*/
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"team-cymru-telnet/auth"
+)
+
+func tokenCommand(args []string, out io.Writer) int {
+	if len(args) != 1 || args[0] != "new" {
+		fmt.Fprintln(out, "usage: token new")
+		return 2
+	}
+	plain, hash, err := auth.NewSecret()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(out, "token: %s\nhash: %s\n", plain, hash)
+	return 0
+}
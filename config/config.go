@@ -2,8 +2,10 @@ package config
 
 /*
 	OVERVIEW: The config package receives the application configuration from config.json. Initializes the app flags, config file, and logging.
-	The only command flag that can be used is -file. This specifies the file name and path for the configuration file.
-	Logs() initializes the fLogger (file logger) variable and returns a pointer to the Logger struct. Sever Logger methods were created to output to file and stdOut.
+	-file specifies the file name and path for the configuration file. When it is not given and config/config.json does not exist the defaults are used.
+	Every field can be overridden by a CHAT_* environment variable or a flag of the same name, see overrides.go.
+	Fields tagged reload:"true" are updated by Reload while the server runs, see reload.go.
+	Logs() initializes the fLogger (file logger) variable and returns a pointer to the Logger struct. Log(component) is the logger of a package, see logging.go for levels, fields and JSON output.
 */
 
 import (
@@ -11,24 +13,169 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"net"
 	"os"
 )
 
 type Config struct {
 	TelnetPort       string `json:"telnetPort"`
 	HTTPPort         string `json:"httpPort"`
-	MaxClients       int    `json:"maxClients"`
-	LogFile          string `json:"logFile"`
+	MaxClients       int    `json:"maxClients" reload:"true"`
+	LogFile          string `json:"logFile" reload:"true"`
 	Dialect          string `json:"dialect"`
-	ConnectionString string `json:"connectionString"`
+	ConnectionString string `json:"connectionString" secret:"true"`
+	//fsync policy of the file dialect: always, interval or never
+	FileSync string `json:"fileSync"`
+	//asynchronous persistence of chat messages. zero values use the defaults in db/pipeline.go
+	PersistQueueSize   int    `json:"persistQueueSize"`
+	PersistBatchSize   int    `json:"persistBatchSize"`
+	PersistFlushMillis int    `json:"persistFlushMillis"`
+	SpillFile          string `json:"spillFile"`
+	//user names allowed to run the admin commands, e.g. /token
+	Admins []string `json:"admins" reload:"true"`
+	//origins, e.g. "https://chat.example.com", of pages allowed to open the web terminal WebSocket besides the server's own host
+	TerminalOrigins []string `json:"terminalOrigins" reload:"true"`
+	//API tokens defined here instead of the database, so the API also works with the memory and file dialects
+	APITokens []APIToken `json:"apiTokens" reload:"true"`
+	//retention rules and the janitor that applies them, see the retention package. read on every pass of the janitor
+	Retention                []RetentionRule `json:"retention" reload:"true"`
+	RetentionIntervalMinutes int             `json:"retentionIntervalMinutes" reload:"true"`
+	RetentionBatchSize       int             `json:"retentionBatchSize" reload:"true"`
+	ArchiveDir               string          `json:"archiveDir" reload:"true"`
+	//graceful shutdown: the notice and countdown sent to every session, then the time allowed for closing sessions and HTTP requests
+	ShutdownNotice         string `json:"shutdownNotice" reload:"true"`
+	ShutdownGraceSeconds   int    `json:"shutdownGraceSeconds" reload:"true"`
+	ShutdownTimeoutSeconds int    `json:"shutdownTimeoutSeconds" reload:"true"`
+	//connection limits, see server/connections.go. 0 disables a limit
+	MaxClientsPerIP     int `json:"maxClientsPerIP" reload:"true"`
+	AcceptRatePerSecond int `json:"acceptRatePerSecond" reload:"true"`
+	AcceptBurst         int `json:"acceptBurst" reload:"true"`
+	//session timeouts and keepalive, see server/timeouts.go. 0 disables a timeout
+	LoginTimeoutSeconds int `json:"loginTimeoutSeconds" reload:"true"`
+	IdleTimeoutSeconds  int `json:"idleTimeoutSeconds" reload:"true"`
+	IdleWarningSeconds  int `json:"idleWarningSeconds" reload:"true"`
+	KeepaliveSeconds    int `json:"keepaliveSeconds" reload:"true"`
+	//how long the session of a dropped connection can be resumed and how many writes are kept for it, see server/resume.go
+	ResumeGraceSeconds int `json:"resumeGraceSeconds" reload:"true"`
+	ResumeBufferSize   int `json:"resumeBufferSize" reload:"true"`
+	//allows one user to be connected from several places at once, see server/resume.go
+	MultiSession bool `json:"multiSession" reload:"true"`
+	//telnet over TLS, see server/tls.go. the listener runs when tlsCertFile is set. the files are reloaded when they change
+	TLSPort              string `json:"tlsPort"`
+	TLSCertFile          string `json:"tlsCertFile" reload:"true"`
+	TLSKeyFile           string `json:"tlsKeyFile" reload:"true"`
+	TLSClientCAFile      string `json:"tlsClientCAFile" reload:"true"`
+	TLSRequireClientCert bool   `json:"tlsRequireClientCert" reload:"true"`
+	//user names of client certificates by common name. without an entry the common name is the user name
+	TLSClientUsers map[string]string `json:"tlsClientUsers" reload:"true"`
+	//the SSH listener, see server/ssh.go. it runs when sshHostKeyFile is set, a missing host key is generated
+	SSHPort               string `json:"sshPort"`
+	SSHHostKeyFile        string `json:"sshHostKeyFile"`
+	SSHAuthorizedKeysFile string `json:"sshAuthorizedKeysFile" reload:"true"`
+	//the addresses the chat is served on. when set telnetPort, tlsPort and sshPort are not used, see ListenerList
+	Listeners []Listener `json:"listeners"`
+	//addresses or CIDRs of the load balancers and reverse proxies whose PROXY protocol header, X-Forwarded-For or Forwarded header is believed
+	TrustedProxies []string `json:"trustedProxies" reload:"true"`
+	//leveled logging, see logging.go. logLevels sets the level of single components, e.g. {"db": "debug"}
+	LogLevel                string            `json:"logLevel" reload:"true"`
+	LogLevels               map[string]string `json:"logLevels" reload:"true"`
+	LogFormat               string            `json:"logFormat" reload:"true"`
+	LogExcludeMessageBodies bool              `json:"logExcludeMessageBodies" reload:"true"`
 }
 
-func Init() {
-	if cfgFile == "" {
-		GetFlags()
+//RetentionRule - messages matching MessageType and Channel are deleted Days after they were sent. empty values match everything and 0 days keeps messages forever
+type RetentionRule struct {
+	MessageType string `json:"messageType"`
+	Channel     int    `json:"channel"`
+	Days        int    `json:"days"`
+}
+
+//APIToken - an API token defined in the config. Hash is the SHA-256 of the token as hex, as printed by "token new", so the config does
+//not hold usable tokens. Scopes is a comma separated list like the scopes of /token create
+type APIToken struct {
+	Identity string `json:"identity"`
+	Scopes   string `json:"scopes"`
+	Hash     string `json:"hash"`
+}
+
+//Listener - an address the chat is served on. Address is an IP address or host name, empty for every interface (IPv4 and IPv6), or the
+//path of the socket for the unix protocol. MaxClients limits the sessions of this listener on top of maxClients, 0 disables the limit.
+//ProxyProtocol reads the PROXY protocol header sent by the load balancers in trustedProxies, see server/proxy.go
+type Listener struct {
+	Protocol      string `json:"protocol"`
+	Address       string `json:"address"`
+	Port          string `json:"port"`
+	MaxClients    int    `json:"maxClients"`
+	ProxyProtocol bool   `json:"proxyProtocol"`
+}
+
+//the protocols of a Listener. unix is telnet over a unix domain socket
+const (
+	ProtocolTelnet  = "telnet"
+	ProtocolTelnets = "telnets"
+	ProtocolSSH     = "ssh"
+	ProtocolUnix    = "unix"
+)
+
+func (l Listener) String() string {
+	if l.Protocol == ProtocolUnix {
+		return fmt.Sprintf("%s %s", l.Protocol, l.Address)
+	}
+	return fmt.Sprintf("%s %s", l.Protocol, net.JoinHostPort(l.Address, l.Port))
+}
+
+//ListenerList - the listeners field, or when it is empty the listeners of telnetPort, tlsPort (when tlsCertFile is set) and sshPort
+//(when sshHostKeyFile is set) on every interface
+func (c Config) ListenerList() []Listener {
+	if len(c.Listeners) > 0 {
+		return c.Listeners
+	}
+	list := []Listener{}
+	if c.TelnetPort != "" {
+		list = append(list, Listener{Protocol: ProtocolTelnet, Port: c.TelnetPort})
+	}
+	if c.TLSCertFile != "" {
+		list = append(list, Listener{Protocol: ProtocolTelnets, Port: c.TLSPort})
+	}
+	if c.SSHHostKeyFile != "" {
+		list = append(list, Listener{Protocol: ProtocolSSH, Port: c.SSHPort})
+	}
+	return list
+}
+
+//TrustedProxy - true when ip is one of trustedProxies
+func (c Config) TrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, entry := range c.TrustedProxies {
+		if network, err := ParseNetwork(entry); err == nil && network.Contains(ip) {
+			return true
+		}
 	}
+	return false
+}
+
+//ParseNetwork - a CIDR, or a single IP address as a network of one address
+func ParseNetwork(entry string) (*net.IPNet, error) {
+	if ip := net.ParseIP(entry); ip != nil {
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(entry)
+	return network, err
+}
 
-	GetConfig()
+//Init - loads the config and starts logging. an invalid config stops the process with every problem listed
+func Init() {
+	if err := Load(); err != nil {
+		//the log file may be the problem so this goes to stderr only
+		log.Fatalf("Fatal: invalid configuration\n%v\n", err)
+	}
 
 	if Logs() == nil {
 		Logs()
@@ -36,25 +183,73 @@ func Init() {
 
 }
 
-func GetConfig() {
-	cfgBody, err := ioutil.ReadFile(cfgFile)
-	CheckError(err)
-	err = json.Unmarshal(cfgBody, Cfg)
-	CheckError(err)
+//Load - reads and validates the config without starting logging, used by the config check subcommand
+func Load() error {
+	if cfgFile == "" {
+		GetFlags()
+	}
+	return GetConfig()
+}
+
+//GetConfig - Cfg is set even when the config is invalid so the problems can be shown next to the values
+func GetConfig() error {
+	cfg, err := load(cfgFile, fileRequired(), os.LookupEnv, flag.CommandLine, flagValues)
+	*Cfg = cfg
+	return err
 }
 
 func GetFlags() {
 	flag.StringVar(&cfgFile, "file", "config/config.json", "config file location")
+	flagValues = registerFlags(flag.CommandLine)
 
 	flag.Parse()
 }
 
+//the default config file is optional so the server can be configured by the environment alone, a file named with -file is not
+func fileRequired() bool {
+	required := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "file" {
+			required = true
+		}
+	})
+	return required
+}
+
+//load builds the config from the defaults, the file, the environment and the flags, each one overriding the one before, and validates it.
+//a file that cannot be read stops there, every other problem is collected in a ValidationError
+func load(path string, required bool, lookup func(string) (string, bool), flags *flag.FlagSet, values map[string]*string) (Config, error) {
+	cfg := Defaults()
+	cfgBody, err := ioutil.ReadFile(path)
+	if err != nil && (required || !os.IsNotExist(err)) {
+		return cfg, ValidationError{{Field: "-file", Message: err.Error()}}
+	}
+	if err == nil {
+		if err := json.Unmarshal(cfgBody, &cfg); err != nil {
+			return cfg, ValidationError{{Field: path, Message: err.Error()}}
+		}
+	}
+
+	errs := applyEnv(&cfg, lookup)
+	errs = append(errs, applyFlags(&cfg, flags, values)...)
+	if err := Validate(cfg); err != nil {
+		errs = append(errs, err.(ValidationError)...)
+	}
+	if len(errs) > 0 {
+		return cfg, errs
+	}
+	return cfg, nil
+}
+
 func CheckError(err error) {
 	if err != nil {
-		Logs().Fatal(fmt.Sprintf("%v. %s", os.Stderr, err.Error()))
+		Log("config").Fatal("unrecoverable error", Err(err))
 	}
 }
 
 var cfgFile string
 
+//flag values for the config fields, set by GetFlags
+var flagValues map[string]*string
+
 var Cfg *Config = &Config{}
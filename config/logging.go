@@ -1,25 +1,147 @@
 package config
 
+/*
+	OVERVIEW: Leveled, structured logging to the log file and stdout. Entries have a level (debug, info, warn, error, fatal), a component,
+	a message and fields such as the user, channel, remote address, session id or message id. logFormat selects text, the
+	"Info: [server] message user=alice" lines, or JSON objects with one entry per line.
+	Log(component) returns the logger of a package. Its level is logLevels[component], or logLevel when the component has none, so e.g.
+	"logLevels": {"db": "debug"} turns on debug logging for the database only. Logs() is the logger without a component.
+	Chat writes the transcript of chat messages to the log file, which is what the import subcommand reads. Message bodies are only logged
+	as Body fields and the transcript, logExcludeMessageBodies leaves out both.
+	Every setting is read from Cfg on each entry so a reload applies straight away.
+*/
+
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+	LevelFatal
+)
+
+//levelNames are the names used in the config and JSON entries, levelPrefixes start the text lines
+var levelNames = []string{"debug", "info", "warn", "error", "fatal"}
+var levelPrefixes = []string{"Debug", "Info", "Warning", "Error", "Fatal"}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+//ParseLevel - debug, info, warn (or warning) and error. an empty name is info
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarning, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q, use debug, info, warn or error", name)
+}
+
+//Components - the components that log, the keys accepted in logLevels
+var Components = []string{"main", "config", "server", "api", "db", "auth", "webhooks", "retention", "search", "export", "importer", "chat"}
+
+var logFormats = []string{"text", "json"}
+
+//Field - a key and value added to a log entry
+type Field struct {
+	Key   string
+	Value interface{}
+	//body marks the text of a chat message, left out with logExcludeMessageBodies
+	body bool
+}
+
+//F - a field with any value. errors, net.Addr and other fmt.Stringer values are logged as their string
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+func User(name string) Field {
+	return F("user", name)
+}
+
+func Channel(channel int) Field {
+	return F("channel", channel)
+}
+
+func Remote(addr net.Addr) Field {
+	return F("remote", addr)
+}
+
+func Session(id uint64) Field {
+	return F("session", id)
+}
+
+func MessageID(id int) Field {
+	return F("message_id", id)
+}
+
+func Err(err error) Field {
+	return F("error", err)
+}
+
+//Body - the text of a chat message
+func Body(text string) Field {
+	return Field{Key: "body", Value: text, body: true}
+}
+
 type Logger struct {
 	FileLogger *log.Logger
+	component  string
+	fields     []Field
 }
 
 func Logs() *Logger {
 	if flogger == nil {
-		flogger = log.New(LogFile(), fmt.Sprintf("%s ", logFile), log.Ldate)
+		logOutput = LogFile()
+		flogger = log.New(logOutput, fmt.Sprintf("%s ", logFile), log.Ldate)
 	}
 	return &Logger{
 		FileLogger: flogger,
 	}
 }
 
+//Log - the logger of component, one of Components
+func Log(component string) *Logger {
+	l := Logs()
+	l.component = component
+	return l
+}
+
+//With - a logger which adds fields to every entry
+func (l *Logger) With(fields ...Field) *Logger {
+	return &Logger{FileLogger: l.FileLogger, component: l.component, fields: append(l.fields[:len(l.fields):len(l.fields)], fields...)}
+}
+
+//Enabled - true when entries of level are written for the component
+func (l *Logger) Enabled(level Level) bool {
+	name, ok := Cfg.LogLevels[l.component]
+	if !ok || l.component == "" {
+		name = Cfg.LogLevel
+	}
+	minimum, _ := ParseLevel(name)
+	return level >= minimum
+}
+
 func LogFile() *os.File {
 	year, month, day := time.Now().Local().Date()
 	file, err := os.OpenFile(fmt.Sprintf("%s_%d-%s-%d.log", Cfg.LogFile, year, month.String(), day), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
@@ -27,20 +149,147 @@ func LogFile() *os.File {
 	return file
 }
 
-func (l *Logger) Info(info string) {
-	l.FileLogger.Printf("Info: %s\n", info)
-	log.Printf("Info: %s\n", info)
+func (l *Logger) Debug(debug string, fields ...Field) {
+	l.write(LevelDebug, debug, fields)
+}
+
+func (l *Logger) Info(info string, fields ...Field) {
+	l.write(LevelInfo, info, fields)
+}
+
+func (l *Logger) Warning(warning string, fields ...Field) {
+	l.write(LevelWarning, warning, fields)
+}
+
+func (l *Logger) Error(err string, fields ...Field) {
+	l.write(LevelError, err, fields)
+}
+
+func (l *Logger) Fatal(fatal string, fields ...Field) {
+	l.write(LevelFatal, fatal, fields)
+	os.Exit(1)
+}
+
+//Chat - writes a chat message to the log file only. in text the transcript line is written, e.g. "BROADCAST MESSAGE - alice Oct 19 12:00:00#: hi",
+//in JSON an entry with the fields. nothing is written in text with logExcludeMessageBodies, in JSON the entry is written without its body
+func (l *Logger) Chat(transcript string, fields ...Field) {
+	if Cfg.LogFormat == "json" {
+		outputMutex.Lock()
+		defer outputMutex.Unlock()
+		l.FileLogger.Writer().Write(l.json(LevelInfo, "chat message", fields, time.Now()))
+		return
+	}
+	if !Cfg.LogExcludeMessageBodies {
+		l.FileLogger.Print(transcript)
+	}
+}
+
+//write sends an entry to the log file and stdout
+func (l *Logger) write(level Level, msg string, fields []Field) {
+	if level < LevelFatal && !l.Enabled(level) {
+		return
+	}
+	if Cfg.LogFormat == "json" {
+		line := l.json(level, msg, fields, time.Now())
+		outputMutex.Lock()
+		defer outputMutex.Unlock()
+		l.FileLogger.Writer().Write(line)
+		log.Writer().Write(line)
+		return
+	}
+	line := l.text(level, msg, fields)
+	l.FileLogger.Print(line)
+	log.Print(line)
 }
 
-func (l *Logger) Error(err string) {
-	l.FileLogger.Printf("Error: %s\n", err)
-	log.Printf("Error: %s\n", err)
+//text renders "Info: [server] message key=value", values with spaces or quotes are quoted
+func (l *Logger) text(level Level, msg string, fields []Field) string {
+	buf := &strings.Builder{}
+	buf.WriteString(levelPrefixes[level] + ": ")
+	if l.component != "" {
+		buf.WriteString("[" + l.component + "] ")
+	}
+	buf.WriteString(msg)
+	for _, field := range l.entryFields(fields) {
+		value := fieldString(field.Value)
+		if value == "" || strings.ContainsAny(value, " \t\r\n\"=") {
+			value = strconv.Quote(value)
+		}
+		buf.WriteString(" " + field.Key + "=" + value)
+	}
+	return buf.String()
 }
 
-func (l *Logger) Fatal(fatal string) {
-	l.FileLogger.Printf("Fatal: %s\n", fatal)
-	log.Fatalf("Fatal: %s\n", fatal)
+//json renders the entry as one line: time, level, component, msg and then the fields in order
+func (l *Logger) json(level Level, msg string, fields []Field, now time.Time) []byte {
+	buf := &bytes.Buffer{}
+	add := func(key string, value interface{}) {
+		if buf.Len() > 0 {
+			buf.WriteByte(',')
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			encoded, _ = json.Marshal(fmt.Sprint(value))
+		}
+		keyJSON, _ := json.Marshal(key)
+		buf.Write(keyJSON)
+		buf.WriteByte(':')
+		buf.Write(encoded)
+	}
+	add("time", now.Format(time.RFC3339Nano))
+	add("level", level.String())
+	if l.component != "" {
+		add("component", l.component)
+	}
+	add("msg", msg)
+	for _, field := range l.entryFields(fields) {
+		switch field.Value.(type) {
+		case error, fmt.Stringer:
+			add(field.Key, fieldString(field.Value))
+		default:
+			add(field.Key, field.Value)
+		}
+	}
+	return append(append([]byte{'{'}, buf.Bytes()...), '}', '\n')
+}
+
+//entryFields are the fields of the logger and the entry, without message bodies when they are excluded
+func (l *Logger) entryFields(fields []Field) []Field {
+	all := []Field{}
+	for _, field := range append(l.fields[:len(l.fields):len(l.fields)], fields...) {
+		if field.body && Cfg.LogExcludeMessageBodies {
+			continue
+		}
+		all = append(all, field)
+	}
+	return all
+}
+
+func fieldString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprint(value)
 }
 
 var logFile string = fmt.Sprintf("ChatServer_%d", time.Now().Unix())
 var flogger *log.Logger
+var logOutput *os.File
+
+//outputMutex keeps JSON entries, which bypass the loggers, from interleaving
+var outputMutex sync.Mutex
+
+//reopenLog moves the file logger to the file named by Cfg.LogFile
+func reopenLog() {
+	previous := logOutput
+	logOutput = LogFile()
+	Logs().FileLogger.SetOutput(logOutput)
+	if previous != nil {
+		previous.Close()
+	}
+}
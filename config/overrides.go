@@ -0,0 +1,202 @@
+package config
+
+/*
+	OVERVIEW: Overrides for the config file. Every Config field can also be set by an environment variable and a command flag, both named after
+	its json key: telnetPort is CHAT_TELNET_PORT and -telnetPort. Fields added to Config later get both without any change here.
+	The precedence is flag > environment > config file > defaults.
+	Numbers are written as they are, lists of strings (admins) are comma separated and any other list or object (retention) is JSON.
+	Fields tagged secret:"true" are redacted by Redacted, which is what the config print subcommand shows.
+*/
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//envPrefix is prepended to the upper snake case json key, e.g. CHAT_HTTP_PORT
+const envPrefix = "CHAT_"
+
+//redactedValue replaces secrets, or the password inside them, in Redacted
+const redactedValue = "REDACTED"
+
+//Defaults - used for every field that is not set by the config file, the environment or a flag
+func Defaults() Config {
+	return Config{
+		TelnetPort: "23",
+		HTTPPort:   "80",
+		TLSPort:    "992",
+		SSHPort:    "2222",
+		MaxClients: 4,
+		LogFile:    "config/ChatServer",
+		Dialect:    "postgres",
+		FileSync:   "interval",
+		LogLevel:   "info",
+		LogFormat:  "text",
+
+		LoginTimeoutSeconds: 60,
+		IdleWarningSeconds:  60,
+		KeepaliveSeconds:    60,
+		ResumeGraceSeconds:  120,
+
+		ShutdownNotice:         "the server is shutting down",
+		ShutdownGraceSeconds:   10,
+		ShutdownTimeoutSeconds: 10,
+	}
+}
+
+type field struct {
+	key   string
+	value reflect.Value
+	tag   reflect.StructField
+}
+
+//fields returns every json field of cfg, in declaration order
+func fields(cfg *Config) []field {
+	list := []field{}
+	value := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		tag := value.Type().Field(i)
+		key := strings.Split(tag.Tag.Get("json"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		list = append(list, field{key: key, value: value.Field(i), tag: tag})
+	}
+	return list
+}
+
+//EnvName - the environment variable for a json key, telnetPort is CHAT_TELNET_PORT
+func EnvName(key string) string {
+	name := strings.Builder{}
+	runes := []rune(key)
+	for i, r := range runes {
+		//a new word starts at an upper case letter that follows a lower case one or starts a new word after an acronym, e.g. HTTPPort
+		if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]))) {
+			name.WriteRune('_')
+		}
+		name.WriteRune(unicode.ToUpper(r))
+	}
+	return envPrefix + name.String()
+}
+
+//set parses raw into the field according to its type
+func (f field) set(raw string) error {
+	switch f.value.Kind() {
+	case reflect.String:
+		f.value.SetString(raw)
+	case reflect.Int, reflect.Int64:
+		number, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+		if err != nil {
+			return fmt.Errorf("must be a number, got %q", raw)
+		}
+		f.value.SetInt(number)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("must be true or false, got %q", raw)
+		}
+		f.value.SetBool(b)
+	case reflect.Slice:
+		if f.value.Type().Elem().Kind() == reflect.String {
+			list := []string{}
+			for _, item := range strings.Split(raw, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			f.value.Set(reflect.ValueOf(list))
+			return nil
+		}
+		fallthrough
+	default:
+		target := reflect.New(f.value.Type())
+		if err := json.Unmarshal([]byte(raw), target.Interface()); err != nil {
+			return fmt.Errorf("must be JSON, %v", err)
+		}
+		f.value.Set(target.Elem())
+	}
+	return nil
+}
+
+//applyEnv sets every field that has an environment variable. lookup is os.LookupEnv outside of tests
+func applyEnv(cfg *Config, lookup func(string) (string, bool)) ValidationError {
+	errs := ValidationError{}
+	for _, f := range fields(cfg) {
+		raw, ok := lookup(EnvName(f.key))
+		if !ok {
+			continue
+		}
+		if err := f.set(raw); err != nil {
+			errs = append(errs, FieldError{Field: EnvName(f.key), Message: err.Error()})
+		}
+	}
+	return errs
+}
+
+//registerFlags adds a string flag for every field to flags. the values are applied by applyFlags once the flags have been parsed
+func registerFlags(flags *flag.FlagSet) map[string]*string {
+	values := map[string]*string{}
+	for _, f := range fields(&Config{}) {
+		values[f.key] = flags.String(f.key, "", fmt.Sprintf("overrides %s in the config file and %s", f.key, EnvName(f.key)))
+	}
+	return values
+}
+
+//applyFlags sets the fields of the flags that were given on the command line
+func applyFlags(cfg *Config, flags *flag.FlagSet, values map[string]*string) ValidationError {
+	errs := ValidationError{}
+	given := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	for _, f := range fields(cfg) {
+		if !given[f.key] {
+			continue
+		}
+		if err := f.set(*values[f.key]); err != nil {
+			errs = append(errs, FieldError{Field: "-" + f.key, Message: err.Error()})
+		}
+	}
+	return errs
+}
+
+var dsnPassword = regexp.MustCompile(`(password=)('[^']*'|\S*)`)
+var userPassword = regexp.MustCompile(`^([^:@/]+):([^@]*)@`)
+
+//redact hides the password in a connection string. postgres and sql server URLs, key=value DSNs and mysql user:password@ DSNs are
+//recognised, any other non empty value is replaced completely
+func redact(value string) string {
+	if value == "" {
+		return value
+	}
+	if parsed, err := url.Parse(value); err == nil && parsed.User != nil {
+		if _, ok := parsed.User.Password(); ok {
+			parsed.User = url.UserPassword(parsed.User.Username(), redactedValue)
+		}
+		return parsed.String()
+	}
+	if dsnPassword.MatchString(value) {
+		return dsnPassword.ReplaceAllString(value, "${1}"+redactedValue)
+	}
+	if userPassword.MatchString(value) {
+		return userPassword.ReplaceAllString(value, "${1}:"+redactedValue+"@")
+	}
+	return redactedValue
+}
+
+//Redacted - a copy of cfg with every field tagged secret:"true" redacted
+func Redacted(cfg Config) Config {
+	for _, f := range fields(&cfg) {
+		if f.tag.Tag.Get("secret") == "true" && f.value.Kind() == reflect.String {
+			f.value.SetString(redact(f.value.String()))
+		}
+	}
+	return cfg
+}
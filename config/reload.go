@@ -0,0 +1,65 @@
+package config
+
+/*
+	OVERVIEW: Reloading the config while the server runs. Reload reads the config file, environment and flags again, validates the result and
+	applies the fields tagged reload:"true". Those are read from Cfg whenever they are used, so the new values take effect immediately.
+	Any other field that changed, e.g. a port or the dialect, is left as it is and reported as rejected, it needs a restart.
+	Packages that copy a reloadable setting at start up register with OnReload to pick up the new value.
+*/
+
+import (
+	"flag"
+	"os"
+	"reflect"
+	"sync"
+)
+
+type ReloadResult struct {
+	Applied  []string `json:"applied"`
+	Rejected []string `json:"rejected"`
+}
+
+//OnReload - fn is called after every reload with the config before and after it
+func OnReload(fn func(previous Config, current Config)) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	reloadHooks = append(reloadHooks, fn)
+}
+
+//Reload - nothing is applied when the new config is invalid
+func Reload() (ReloadResult, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	result := ReloadResult{Applied: []string{}, Rejected: []string{}}
+	next, err := load(cfgFile, fileRequired(), os.LookupEnv, flag.CommandLine, flagValues)
+	if err != nil {
+		return result, err
+	}
+
+	previous := *Cfg
+	current := fields(Cfg)
+	for i, f := range fields(&next) {
+		if reflect.DeepEqual(f.value.Interface(), current[i].value.Interface()) {
+			continue
+		}
+		if f.tag.Tag.Get("reload") != "true" {
+			Log("config").Warning("config reload: a setting changed that cannot be changed while the server is running. restart to apply it", F("setting", f.key))
+			result.Rejected = append(result.Rejected, f.key)
+			continue
+		}
+		current[i].value.Set(f.value)
+		result.Applied = append(result.Applied, f.key)
+	}
+
+	if previous.LogFile != Cfg.LogFile {
+		reopenLog()
+	}
+	for _, hook := range reloadHooks {
+		hook(previous, *Cfg)
+	}
+	return result, nil
+}
+
+var reloadMutex sync.Mutex
+var reloadHooks []func(previous Config, current Config)
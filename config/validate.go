@@ -0,0 +1,394 @@
+package config
+
+/*
+	OVERVIEW: Validation of the effective config. Every problem is collected, with the name of the field, so a bad config is fixed in one pass
+	instead of one Fatal at a time. Zero values that the packages replace with their own defaults (persistQueueSize, retentionBatchSize...)
+	are accepted, negative ones are not.
+*/
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//postgres is the only SQL driver imported by db/db.go. a dialect is added here together with the import of its driver
+var dialects = []string{"postgres", "memory", "file"}
+var fileSyncPolicies = []string{"always", "interval", "never"}
+
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (f FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", f.Field, f.Message)
+}
+
+//ValidationError - every problem found in the config
+type ValidationError []FieldError
+
+func (v ValidationError) Error() string {
+	lines := []string{}
+	for _, fieldErr := range v {
+		lines = append(lines, fieldErr.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+//Validate - nil when the config is usable, otherwise a ValidationError
+func Validate(cfg Config) error {
+	errs := ValidationError{}
+	add := func(field string, format string, args ...interface{}) {
+		errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	validateListeners(cfg, add)
+	validateTLS(cfg, add)
+	validateSSH(cfg, add)
+	if cfg.MaxClients < 1 {
+		add("maxClients", "must be at least 1, got %d", cfg.MaxClients)
+	}
+
+	if cfg.Dialect == "" {
+		add("dialect", "is required, use one of %s", strings.Join(dialects, ", "))
+	} else if !contains(dialects, cfg.Dialect) {
+		add("dialect", "unknown dialect %q, use one of %s", cfg.Dialect, strings.Join(dialects, ", "))
+	}
+	if cfg.ConnectionString == "" && cfg.Dialect != "memory" {
+		if cfg.Dialect == "file" {
+			add("connectionString", "is required, it is the directory the file dialect stores messages in")
+		} else {
+			add("connectionString", "is required for the %s dialect", cfg.Dialect)
+		}
+	}
+	if cfg.FileSync != "" && !contains(fileSyncPolicies, cfg.FileSync) {
+		add("fileSync", "must be one of %s, got %q", strings.Join(fileSyncPolicies, ", "), cfg.FileSync)
+	}
+
+	if cfg.LogFile == "" {
+		add("logFile", "is required")
+	} else if err := checkWritable(filepath.Dir(cfg.LogFile)); err != nil {
+		add("logFile", "%v", err)
+	}
+	if _, err := ParseLevel(cfg.LogLevel); err != nil {
+		add("logLevel", "%v", err)
+	}
+	components := []string{}
+	for component := range cfg.LogLevels {
+		components = append(components, component)
+	}
+	sort.Strings(components)
+	for _, component := range components {
+		if !contains(Components, component) {
+			add(fmt.Sprintf("logLevels[%s]", component), "unknown component, use one of %s", strings.Join(Components, ", "))
+		} else if _, err := ParseLevel(cfg.LogLevels[component]); err != nil {
+			add(fmt.Sprintf("logLevels[%s]", component), "%v", err)
+		}
+	}
+	if cfg.LogFormat != "" && !contains(logFormats, cfg.LogFormat) {
+		add("logFormat", "must be one of %s, got %q", strings.Join(logFormats, ", "), cfg.LogFormat)
+	}
+	if cfg.SpillFile != "" {
+		if err := checkWritable(filepath.Dir(cfg.SpillFile)); err != nil {
+			add("spillFile", "%v", err)
+		}
+	}
+
+	for _, limit := range []struct {
+		field string
+		value int
+	}{
+		{"persistQueueSize", cfg.PersistQueueSize},
+		{"persistBatchSize", cfg.PersistBatchSize},
+		{"persistFlushMillis", cfg.PersistFlushMillis},
+		{"retentionIntervalMinutes", cfg.RetentionIntervalMinutes},
+		{"retentionBatchSize", cfg.RetentionBatchSize},
+		{"resumeBufferSize", cfg.ResumeBufferSize},
+	} {
+		if limit.value < 0 {
+			add(limit.field, "must not be negative, 0 uses the default. got %d", limit.value)
+		}
+	}
+	for _, limit := range []struct {
+		field string
+		value int
+	}{
+		{"maxClientsPerIP", cfg.MaxClientsPerIP},
+		{"acceptRatePerSecond", cfg.AcceptRatePerSecond},
+		{"acceptBurst", cfg.AcceptBurst},
+		{"loginTimeoutSeconds", cfg.LoginTimeoutSeconds},
+		{"idleTimeoutSeconds", cfg.IdleTimeoutSeconds},
+		{"idleWarningSeconds", cfg.IdleWarningSeconds},
+		{"keepaliveSeconds", cfg.KeepaliveSeconds},
+		{"resumeGraceSeconds", cfg.ResumeGraceSeconds},
+	} {
+		if limit.value < 0 {
+			add(limit.field, "must not be negative, 0 disables the limit. got %d", limit.value)
+		}
+	}
+	if cfg.IdleTimeoutSeconds > 0 && cfg.IdleWarningSeconds >= cfg.IdleTimeoutSeconds {
+		add("idleWarningSeconds", "must be less than idleTimeoutSeconds (%d), got %d", cfg.IdleTimeoutSeconds, cfg.IdleWarningSeconds)
+	}
+	if cfg.ShutdownGraceSeconds < 0 {
+		add("shutdownGraceSeconds", "must not be negative, 0 closes the sessions without a countdown. got %d", cfg.ShutdownGraceSeconds)
+	}
+	if cfg.ShutdownTimeoutSeconds < 1 {
+		add("shutdownTimeoutSeconds", "must be at least 1, got %d", cfg.ShutdownTimeoutSeconds)
+	}
+	if cfg.PersistQueueSize > 0 && cfg.PersistBatchSize > cfg.PersistQueueSize {
+		add("persistBatchSize", "must not be larger than persistQueueSize (%d), got %d", cfg.PersistQueueSize, cfg.PersistBatchSize)
+	}
+	for i, rule := range cfg.Retention {
+		if rule.Days < 0 {
+			add(fmt.Sprintf("retention[%d].days", i), "must not be negative, 0 keeps messages forever. got %d", rule.Days)
+		}
+		if rule.Channel < 0 {
+			add(fmt.Sprintf("retention[%d].channel", i), "must not be negative, got %d", rule.Channel)
+		}
+	}
+	for i, entry := range cfg.TrustedProxies {
+		if _, err := ParseNetwork(entry); err != nil {
+			add(fmt.Sprintf("trustedProxies[%d]", i), "must be an IP address or CIDR, got %q", entry)
+		}
+	}
+	for i, origin := range cfg.TerminalOrigins {
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			add(fmt.Sprintf("terminalOrigins[%d]", i), "must be a scheme and host, e.g. https://chat.example.com, got %q", origin)
+		}
+	}
+	for i, admin := range cfg.Admins {
+		if strings.TrimSpace(admin) == "" || strings.ContainsAny(admin, " \t") {
+			add(fmt.Sprintf("admins[%d]", i), "must be a user name without spaces, got %q", admin)
+		}
+	}
+	for i, tok := range cfg.APITokens {
+		if tok.Identity == "" || strings.ContainsAny(tok.Identity, " \t") {
+			add(fmt.Sprintf("apiTokens[%d].identity", i), "must be a single word, got %q", tok.Identity)
+		}
+		if strings.TrimSpace(strings.Replace(tok.Scopes, ",", "", -1)) == "" {
+			add(fmt.Sprintf("apiTokens[%d].scopes", i), "at least one scope is required")
+		}
+		if hash, err := hex.DecodeString(tok.Hash); err != nil || len(hash) != sha256.Size {
+			add(fmt.Sprintf("apiTokens[%d].hash", i), "must be the SHA-256 of the token as 64 hex characters, see \"token new\"")
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+//validateListeners checks every listener and that no two of them, or a listener and the HTTP server, use the same address. errors of
+//the listeners derived from telnetPort, tlsPort and sshPort are reported for those fields
+func validateListeners(cfg Config, add func(field string, format string, args ...interface{})) {
+	listeners := cfg.ListenerList()
+	if len(listeners) == 0 {
+		add("telnetPort", "is required when there is no TLS or SSH listener, set it, tlsCertFile, sshHostKeyFile or listeners")
+	}
+	type bound struct {
+		field string
+		Listener
+	}
+	seen := []bound{}
+	for i, listener := range listeners {
+		prefix := fmt.Sprintf("listeners[%d].", i)
+		portField := prefix + "port"
+		if len(cfg.Listeners) == 0 {
+			prefix = ""
+			portField = map[string]string{ProtocolTelnet: "telnetPort", ProtocolTelnets: "tlsPort", ProtocolSSH: "sshPort"}[listener.Protocol]
+		}
+
+		switch listener.Protocol {
+		case ProtocolTelnet:
+		case ProtocolTelnets:
+			if cfg.TLSCertFile == "" {
+				add(prefix+"protocol", "telnets requires tlsCertFile")
+			}
+		case ProtocolSSH:
+			if cfg.SSHHostKeyFile == "" {
+				add(prefix+"protocol", "ssh requires sshHostKeyFile")
+			}
+		case ProtocolUnix:
+			if listener.Address == "" {
+				add(prefix+"address", "is required, it is the path of the socket")
+			} else if err := checkWritable(filepath.Dir(listener.Address)); err != nil {
+				add(prefix+"address", "%v", err)
+			}
+		default:
+			add(prefix+"protocol", "must be one of %s, %s, %s or %s, got %q", ProtocolTelnet, ProtocolTelnets, ProtocolSSH, ProtocolUnix, listener.Protocol)
+		}
+		if listener.ProxyProtocol && listener.Protocol == ProtocolUnix {
+			add(prefix+"proxyProtocol", "is only supported on TCP listeners")
+		} else if listener.ProxyProtocol && len(cfg.TrustedProxies) == 0 {
+			add(prefix+"proxyProtocol", "requires trustedProxies, the addresses of the load balancers")
+		}
+		if listener.MaxClients < 0 {
+			add(prefix+"maxClients", "must not be negative, 0 disables the limit. got %d", listener.MaxClients)
+		}
+
+		current := bound{field: portField, Listener: listener}
+		if listener.Protocol != ProtocolUnix {
+			if number, err := strconv.Atoi(listener.Port); err != nil || number < 1 || number > 65535 {
+				add(portField, "must be a port number between 1 and 65535, got %q", listener.Port)
+			}
+			if strings.HasPrefix(listener.Address, "[") {
+				add(prefix+"address", "must be written without brackets, got %q", listener.Address)
+			}
+		} else {
+			current.field = prefix + "address"
+		}
+		for _, other := range seen {
+			if conflicts(current.Listener, other.Listener) {
+				add(current.field, "must differ from %s, both are %s", other.field, other.Listener.String())
+			}
+		}
+		seen = append(seen, current)
+	}
+	http := Listener{Protocol: "http", Port: cfg.HTTPPort}
+	for _, other := range seen {
+		if conflicts(http, other.Listener) {
+			add("httpPort", "must differ from %s, both are %s", other.field, cfg.HTTPPort)
+		}
+	}
+	if number, err := strconv.Atoi(cfg.HTTPPort); err != nil || number < 1 || number > 65535 {
+		add("httpPort", "must be a port number between 1 and 65535, got %q", cfg.HTTPPort)
+	}
+}
+
+//conflicts is true when both listeners would bind the same socket path, or the same port on a shared address
+func conflicts(a Listener, b Listener) bool {
+	if (a.Protocol == ProtocolUnix) != (b.Protocol == ProtocolUnix) {
+		return false
+	}
+	if a.Protocol == ProtocolUnix {
+		return a.Address == b.Address
+	}
+	return a.Port == b.Port && (a.Address == b.Address || a.Address == "" || b.Address == "")
+}
+
+//validateTLS loads the certificates the way the TLS listener does so a bad file is reported before the listener needs it
+func validateTLS(cfg Config, add func(field string, format string, args ...interface{})) {
+	if cfg.TLSCertFile == "" && cfg.TLSKeyFile == "" {
+		if cfg.TLSClientCAFile != "" || cfg.TLSRequireClientCert {
+			add("tlsCertFile", "is required for client certificates")
+		}
+		return
+	}
+	if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+		add("tlsCertFile", "tlsCertFile and tlsKeyFile must be set together")
+		return
+	}
+	if _, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile); err != nil {
+		add("tlsCertFile", "%v", err)
+	}
+	if cfg.TLSRequireClientCert && cfg.TLSClientCAFile == "" {
+		add("tlsClientCAFile", "is required when tlsRequireClientCert is true")
+	}
+	if cfg.TLSClientCAFile != "" {
+		if _, err := LoadCertPool(cfg.TLSClientCAFile); err != nil {
+			add("tlsClientCAFile", "%v", err)
+		}
+	}
+	commonNames := []string{}
+	for commonName := range cfg.TLSClientUsers {
+		commonNames = append(commonNames, commonName)
+	}
+	sort.Strings(commonNames)
+	for _, commonName := range commonNames {
+		if name := cfg.TLSClientUsers[commonName]; name == "" || strings.ContainsAny(name, " \t") {
+			add(fmt.Sprintf("tlsClientUsers[%s]", commonName), "must be a user name without spaces, got %q", name)
+		}
+	}
+}
+
+//validateSSH checks the host key, or that it can be generated, and every line of the authorized keys file
+func validateSSH(cfg Config, add func(field string, format string, args ...interface{})) {
+	if cfg.SSHHostKeyFile == "" {
+		if cfg.SSHAuthorizedKeysFile != "" {
+			add("sshHostKeyFile", "is required for the SSH listener that uses sshAuthorizedKeysFile")
+		}
+		return
+	}
+	if pemBytes, err := ioutil.ReadFile(cfg.SSHHostKeyFile); os.IsNotExist(err) {
+		if err := checkWritable(filepath.Dir(cfg.SSHHostKeyFile)); err != nil {
+			add("sshHostKeyFile", "does not exist and cannot be generated. %v", err)
+		}
+	} else if err != nil {
+		add("sshHostKeyFile", "%v", err)
+	} else if _, err := ssh.ParsePrivateKey(pemBytes); err != nil {
+		add("sshHostKeyFile", "%v", err)
+	}
+	if cfg.SSHAuthorizedKeysFile == "" {
+		return
+	}
+	body, err := ioutil.ReadFile(cfg.SSHAuthorizedKeysFile)
+	if err != nil {
+		add("sshAuthorizedKeysFile", "%v", err)
+		return
+	}
+	for i, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		_, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			add("sshAuthorizedKeysFile", "line %d: %v", i+1, err)
+		} else if user := strings.TrimSpace(comment); user == "" || strings.ContainsAny(user, " \t") {
+			add("sshAuthorizedKeysFile", "line %d: the comment must be the user name, got %q", i+1, user)
+		}
+	}
+}
+
+//LoadCertPool - the PEM certificates in path
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s holds no PEM certificates", path)
+	}
+	return pool, nil
+}
+
+//checkWritable creates and removes a file in dir, the only reliable way to know the process can write there
+func checkWritable(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("directory %s does not exist", dir)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	file, err := ioutil.TempFile(dir, ".write-check-")
+	if err != nil {
+		return fmt.Errorf("directory %s is not writable", dir)
+	}
+	file.Close()
+	os.Remove(file.Name())
+	return nil
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
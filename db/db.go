@@ -3,13 +3,15 @@ package db
 /*
 	OVERVIEW: database model for the backend connection to the database. This uses the database connection information stored in config.json.
 	It uses the GORM package to connect to and communicate with the database.
-	GORM has some minor migrations built into the package so if you add a column to a table struct then the actual table will be updated.
+	The schema is managed by the versioned migrations in migrations.go. Connect applies any that are pending, Open only connects so the
+	migrate subcommand can inspect and change the schema itself. A change to a model struct needs a new migration.
+	Chat messages are read and written through the Messages store, see store.go. Connect selects its backend from the dialect.
 */
 
 import (
+	"errors"
 	"sync"
 	"team-cymru-telnet/config"
-	"team-cymru-telnet/models/chat"
 
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
@@ -17,26 +19,57 @@ import (
 
 var mutex sync.Mutex = sync.Mutex{}
 
-//Will auto update any table that gorm has a connection to
-func autoMigrate() {
-	ch := chat.Chat{}
-	DB.Conn.Debug().AutoMigrate(&ch)
-}
+//returned by features that store more than chat messages when no database is configured
+var ErrNoDatabase = errors.New("not available without a database. the memory and file dialects only store chat messages")
 
+//Connect - connects to the database, applies pending migrations and selects the message store
 func Connect() {
 	var err error
 	//Lock the read and writing to the DB variable to prevent mutiple DB connections
 	mutex.Lock()
-	if !DB.Connected {
-		DB.Conn, err = gorm.Open(config.Cfg.Dialect, config.Cfg.ConnectionString)
+	defer mutex.Unlock()
+	if Messages != nil {
+		return
+	}
+	//the memory dialect needs no database. only the message store is available, everything else stored by GORM is disabled
+	if config.Cfg.Dialect == "memory" {
+		Messages = NewMemoryStore()
+		return
+	}
+	//the file dialect stores messages in segment files in the connectionString directory, again without a database
+	if config.Cfg.Dialect == "file" {
+		Messages, err = NewFileStore(config.Cfg.ConnectionString, config.Cfg.FileSync)
 		if err != nil {
-			config.Logs().Fatal(err.Error())
+			config.Log("db").Fatal("failed to open the file store", config.F("path", config.Cfg.ConnectionString), config.Err(err))
+		}
+		return
+	}
+
+	if !DB.Connected {
+		open()
+		if _, err = migrateTo(latestVersion()); err != nil {
+			config.Log("db").Fatal("failed to migrate the database", config.Err(err))
 		}
+	}
+	Messages = NewGormStore(DB.Conn)
+}
+
+//Open - connects to the database without migrating it
+func Open() {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !DB.Connected {
+		open()
+	}
+}
 
-		DB.Connected = true
-		autoMigrate()
+func open() {
+	var err error
+	DB.Conn, err = gorm.Open(config.Cfg.Dialect, config.Cfg.ConnectionString)
+	if err != nil {
+		config.Log("db").Fatal("failed to connect to the database", config.F("dialect", config.Cfg.Dialect), config.Err(err))
 	}
-	mutex.Unlock()
+	DB.Connected = true
 }
 
 type DBConn struct {
@@ -0,0 +1,557 @@
+package db
+
+/*
+	OVERVIEW: MessageStore kept in append only log files, selected with "dialect": "file". The connectionString is the directory holding the files.
+	There is one segment file per day, named chat-2006-01-02.log after the day the messages were created. Every record is framed as
+	[4 byte length][4 byte CRC-32][JSON], an update appends a new version of the message and a delete appends a tombstone, all to the message's own segment.
+	The index is rebuilt when the store is opened by scanning the segments. It maps every id to its segment and offset and keeps the ids per segment,
+	so id lookups read one record and time lookups only read the segments for the days in range.
+	A torn or corrupt record at the end of a segment, left by a crash during a write, is truncated away when the store is opened. A record
+	that cannot be read in the middle of a segment is not a crash, the store does not open so the records after it are not lost.
+	Compaction rewrites a segment without its superseded versions and tombstones, it runs after deletes once enough of a segment is dead.
+	The tombstone of the highest id given out is kept so that id is not given out again after a restart.
+	The fsync policy is "always" (after every write), "interval" (once a second, the default) or "never" (left to the operating system).
+*/
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"team-cymru-telnet/models/chat"
+	"time"
+)
+
+const (
+	SyncAlways   = "always"
+	SyncInterval = "interval"
+	SyncNever    = "never"
+)
+
+const segmentDateFormat = "2006-01-02"
+
+//records are read back in batches so the lock is not held while the caller handles them
+const streamBatchSize = 256
+
+//a segment is compacted when at least this many records and half of all its records are dead
+const compactMinDead = 1024
+
+const maxRecordSize = 1 << 20
+
+type fileRecord struct {
+	Deleted bool      `json:"deleted,omitempty"`
+	Chat    chat.Chat `json:"chat"`
+}
+
+type segment struct {
+	day   string
+	path  string
+	file  *os.File
+	size  int64
+	ids   map[int]bool
+	dead  int
+	dirty bool
+	//maxID is the highest id of the records in the segment, tombstones included
+	maxID int
+}
+
+type location struct {
+	day    string
+	offset int64
+}
+
+type fileStore struct {
+	mutex    sync.RWMutex
+	dir      string
+	sync     string
+	segments map[string]*segment
+	index    map[int]location
+	nextID   int
+}
+
+//NewFileStore - opens the segments in dir, creating the directory if needed
+func NewFileStore(dir string, syncPolicy string) (MessageStore, error) {
+	if syncPolicy == "" {
+		syncPolicy = SyncInterval
+	}
+	if syncPolicy != SyncAlways && syncPolicy != SyncInterval && syncPolicy != SyncNever {
+		return nil, fmt.Errorf("unknown fsync policy %s", syncPolicy)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	store := &fileStore{
+		dir:      dir,
+		sync:     syncPolicy,
+		segments: map[string]*segment{},
+		index:    map[int]location{},
+		nextID:   1,
+	}
+	//a compaction interrupted by a crash leaves its temporary file behind, the original segment is still intact
+	leftovers, _ := filepath.Glob(filepath.Join(dir, "chat-*.log.compact"))
+	for _, path := range leftovers {
+		os.Remove(path)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "chat-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		day := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "chat-"), ".log")
+		if _, err := time.Parse(segmentDateFormat, day); err != nil {
+			continue
+		}
+		if err := store.load(day, path); err != nil {
+			return nil, err
+		}
+	}
+
+	if syncPolicy == SyncInterval {
+		go store.syncLoop()
+	}
+	return store, nil
+}
+
+//load scans a segment into the index and truncates a torn record at its end
+func (f *fileStore) load(day string, path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	seg := &segment{day: day, path: path, file: file, ids: map[int]bool{}}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	offset := int64(0)
+	for {
+		record, length, err := readRecord(file, offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if !tornAtEnd(file, offset, info.Size()) {
+				file.Close()
+				return fmt.Errorf("segment %s is corrupt at offset %d. %v", path, offset, err)
+			}
+			if err := file.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		f.apply(seg, record, offset)
+		offset += length
+	}
+	seg.size = offset
+	f.segments[day] = seg
+	return nil
+}
+
+//tornAtEnd is true when the record at offset reaches the end of the file, which is what a crash during its write leaves behind
+func tornAtEnd(file *os.File, offset int64, size int64) bool {
+	header := make([]byte, 8)
+	if n, _ := file.ReadAt(header, offset); n < len(header) {
+		return true
+	}
+	return offset+8+int64(binary.BigEndian.Uint32(header[0:4])) >= size
+}
+
+//apply updates the index for a record that has been written at offset in seg
+func (f *fileStore) apply(seg *segment, record fileRecord, offset int64) {
+	id := record.Chat.ID
+	//a deleted id is never given out again
+	if id >= f.nextID {
+		f.nextID = id + 1
+	}
+	if id > seg.maxID {
+		seg.maxID = id
+	}
+	if record.Deleted {
+		//the tombstone and the version it deletes are both dead. the tombstone kept by compaction has no version
+		if seg.ids[id] {
+			seg.dead++
+		}
+		seg.dead++
+		delete(f.index, id)
+		delete(seg.ids, id)
+		return
+	}
+	if seg.ids[id] {
+		seg.dead++
+	}
+	f.index[id] = location{day: seg.day, offset: offset}
+	seg.ids[id] = true
+}
+
+func readRecord(file *os.File, offset int64) (fileRecord, int64, error) {
+	record := fileRecord{}
+	header := make([]byte, 8)
+	n, err := file.ReadAt(header, offset)
+	if n == 0 && err == io.EOF {
+		return record, 0, io.EOF
+	}
+	if n < len(header) {
+		return record, 0, errors.New("incomplete record header")
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	//a garbage length from a torn header must not turn into a huge allocation
+	if length > maxRecordSize {
+		return record, 0, errors.New("record length is larger than any message")
+	}
+	payload := make([]byte, length)
+	if n, _ := file.ReadAt(payload, offset+8); n < len(payload) {
+		return record, 0, errors.New("incomplete record")
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return record, 0, errors.New("record checksum mismatch")
+	}
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return record, 0, err
+	}
+	return record, int64(8 + length), nil
+}
+
+func encodeRecord(record fileRecord) ([]byte, error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	return append(frame, payload...), nil
+}
+
+//write appends a record to the segment for the day it belongs to, creating the segment when it is the first record of that day
+func (f *fileStore) write(record fileRecord) error {
+	day := record.Chat.CreatedAt.Local().Format(segmentDateFormat)
+	if loc, ok := f.index[record.Chat.ID]; ok {
+		//every version of a message stays in the segment it was first written to
+		day = loc.day
+	}
+
+	seg, ok := f.segments[day]
+	if !ok {
+		path := filepath.Join(f.dir, "chat-"+day+".log")
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		seg = &segment{day: day, path: path, file: file, ids: map[int]bool{}}
+		f.segments[day] = seg
+	}
+
+	frame, err := encodeRecord(record)
+	if err != nil {
+		return err
+	}
+	if _, err := seg.file.Write(frame); err != nil {
+		return err
+	}
+	if f.sync == SyncAlways {
+		if err := seg.file.Sync(); err != nil {
+			return err
+		}
+	} else {
+		seg.dirty = true
+	}
+
+	f.apply(seg, record, seg.size)
+	seg.size += int64(len(frame))
+	return nil
+}
+
+func (f *fileStore) Save(message *chat.Chat) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	now := time.Now()
+	if message.ID == 0 {
+		message.ID = f.nextID
+	}
+	if message.CreatedAt.IsZero() {
+		message.CreatedAt = now
+	}
+	message.UpdatedAt = now
+	return f.write(fileRecord{Chat: *message})
+}
+
+func (f *fileStore) SaveBatch(messages []*chat.Chat) error {
+	for _, message := range messages {
+		if err := f.Save(message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fileStore) Query(filter MessageFilter) ([]chat.Chat, error) {
+	messages := []chat.Chat{}
+	err := f.Stream(filter, func(message chat.Chat) error {
+		messages = append(messages, message)
+		return nil
+	})
+	return messages, err
+}
+
+func (f *fileStore) Delete(filter MessageFilter) (int64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	deleted := int64(0)
+	touched := map[string]bool{}
+	for _, id := range f.candidates(filter) {
+		if filter.Limit > 0 && deleted == int64(filter.Limit) {
+			break
+		}
+		message, err := f.read(id)
+		if err != nil {
+			return deleted, err
+		}
+		if !filter.matches(message) {
+			continue
+		}
+		touched[f.index[id].day] = true
+		if err := f.write(fileRecord{Deleted: true, Chat: chat.Chat{ID: id}}); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+
+	for day := range touched {
+		seg := f.segments[day]
+		if seg.dead >= compactMinDead && seg.dead >= len(seg.ids) {
+			if err := f.compact(seg); err != nil {
+				return deleted, err
+			}
+		}
+	}
+	return deleted, nil
+}
+
+func (f *fileStore) Stream(filter MessageFilter, fn func(chat.Chat) error) error {
+	f.mutex.RLock()
+	ids := f.candidates(filter)
+	f.mutex.RUnlock()
+
+	sent := 0
+	for start := 0; start < len(ids); start += streamBatchSize {
+		end := start + streamBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		batch := []chat.Chat{}
+		f.mutex.RLock()
+		for _, id := range ids[start:end] {
+			//the message may have been deleted or compacted since the ids were collected
+			if _, ok := f.index[id]; !ok {
+				continue
+			}
+			message, err := f.read(id)
+			if err != nil {
+				f.mutex.RUnlock()
+				return err
+			}
+			if filter.matches(message) {
+				batch = append(batch, message)
+			}
+		}
+		f.mutex.RUnlock()
+
+		for _, message := range batch {
+			if filter.Limit > 0 && sent == filter.Limit {
+				return nil
+			}
+			if err := fn(message); err != nil {
+				return err
+			}
+			sent++
+		}
+	}
+	return nil
+}
+
+//candidates returns the ids, in order, of the messages in the segments the filter can match. the caller must hold the lock
+func (f *fileStore) candidates(filter MessageFilter) []int {
+	if filter.ID != 0 {
+		if _, ok := f.index[filter.ID]; ok {
+			return []int{filter.ID}
+		}
+		return []int{}
+	}
+	if len(filter.IDs) > 0 {
+		ids := []int{}
+		for _, id := range filter.IDs {
+			if _, ok := f.index[id]; ok {
+				ids = append(ids, id)
+			}
+		}
+		sort.Ints(ids)
+		return ids
+	}
+
+	ids := []int{}
+	for day, seg := range f.segments {
+		if !dayInRange(day, filter.After, filter.Before) {
+			continue
+		}
+		for id := range seg.ids {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+//segments are named after the local day so a day is skipped when it ends before After or starts after Before
+func dayInRange(day string, after time.Time, before time.Time) bool {
+	start, err := time.ParseInLocation(segmentDateFormat, day, time.Local)
+	if err != nil {
+		return false
+	}
+	end := start.AddDate(0, 0, 1)
+	if !after.IsZero() && !end.After(after) {
+		return false
+	}
+	if !before.IsZero() && !start.Before(before) {
+		return false
+	}
+	return true
+}
+
+func (f *fileStore) read(id int) (chat.Chat, error) {
+	loc := f.index[id]
+	record, _, err := readRecord(f.segments[loc.day].file, loc.offset)
+	return record.Chat, err
+}
+
+//compact rewrites the segment with only the latest version of its live messages. the new file is synced before it replaces the old one
+func (f *fileStore) compact(seg *segment) error {
+	tmpPath := seg.path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	ids := []int{}
+	for id := range seg.ids {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	offsets := map[int]int64{}
+	size := int64(0)
+	for _, id := range ids {
+		record, _, err := readRecord(seg.file, f.index[id].offset)
+		if err == nil {
+			var frame []byte
+			frame, err = encodeRecord(record)
+			if err == nil {
+				_, err = tmp.Write(frame)
+				offsets[id] = size
+				size += int64(len(frame))
+			}
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	//the highest id given out is deleted, its tombstone stays so the id is still known after a restart
+	marker := seg.maxID == f.nextID-1 && !seg.ids[seg.maxID]
+	if marker {
+		frame, err := encodeRecord(fileRecord{Deleted: true, Chat: chat.Chat{ID: seg.maxID}})
+		if err == nil {
+			_, err = tmp.Write(frame)
+			size += int64(len(frame))
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	tmp.Close()
+
+	seg.file.Close()
+	if len(ids) == 0 && !marker {
+		os.Remove(tmpPath)
+		delete(f.segments, seg.day)
+		return os.Remove(seg.path)
+	}
+	if err := os.Rename(tmpPath, seg.path); err != nil {
+		return err
+	}
+	syncDir(f.dir)
+
+	file, err := os.OpenFile(seg.path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	seg.file = file
+	seg.size = size
+	seg.dead = 0
+	if marker {
+		seg.dead = 1
+	}
+	for id, offset := range offsets {
+		f.index[id] = location{day: seg.day, offset: offset}
+	}
+	return nil
+}
+
+//Compact - compacts every segment with dead records
+func (f *fileStore) Compact() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, seg := range f.segments {
+		if seg.dead == 0 {
+			continue
+		}
+		if err := f.compact(seg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//a rename is only durable once the directory entry has been synced
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+func (f *fileStore) syncLoop() {
+	for range time.Tick(time.Second) {
+		f.mutex.Lock()
+		for _, seg := range f.segments {
+			if seg.dirty {
+				seg.file.Sync()
+				seg.dirty = false
+			}
+		}
+		f.mutex.Unlock()
+	}
+}
@@ -0,0 +1,128 @@
+package db
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"team-cymru-telnet/models/chat"
+	"testing"
+	"time"
+)
+
+func TestFileStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, SyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	yesterday := time.Now().AddDate(0, 0, -1)
+	store.Save(&chat.Chat{User: "stuart", MessageType: "broadcast", Message: "old news", CreatedAt: yesterday})
+	store.Save(&chat.Chat{User: "andrew", MessageType: "channel", Channel: sql.NullInt64{Valid: true, Int64: 2}, Message: "hello channel"})
+	edited := &chat.Chat{User: "stuart", MessageType: "broadcast", Message: "typo"}
+	store.Save(edited)
+	edited.Message = "fixed"
+	store.Save(edited)
+	store.Delete(MessageFilter{ID: 2})
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "chat-*.log"))
+	if len(segments) != 2 {
+		t.Fatalf("expected a segment per day got %v", segments)
+	}
+
+	//simulate a crash in the middle of a write
+	today := filepath.Join(dir, "chat-"+time.Now().Format(segmentDateFormat)+".log")
+	file, _ := os.OpenFile(today, os.O_WRONLY|os.O_APPEND, 0644)
+	file.Write([]byte{0, 0, 1, 0, 9, 9})
+	file.Close()
+
+	reopened, err := NewFileStore(dir, SyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, _ := reopened.Query(MessageFilter{})
+	if len(results) != 2 || results[0].Message != "old news" || results[1].Message != "fixed" {
+		t.Fatalf("unexpected messages after reopen %v", results)
+	}
+	results, _ = reopened.Query(MessageFilter{After: time.Now().Add(-time.Hour)})
+	if len(results) != 1 || results[0].ID != 3 {
+		t.Fatalf("unexpected time lookup %v", results)
+	}
+
+	message := &chat.Chat{User: "kallye", MessageType: "broadcast", Message: "after the crash"}
+	reopened.Save(message)
+	if message.ID != 4 {
+		t.Fatalf("ids must continue after reopen, got %d", message.ID)
+	}
+}
+
+func TestFileStoreCompaction(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := NewFileStore(dir, SyncNever)
+	for i := 0; i < 10; i++ {
+		store.Save(&chat.Chat{User: "stuart", MessageType: "broadcast", Message: "spam"})
+	}
+	store.Delete(MessageFilter{Limit: 8})
+
+	today := filepath.Join(dir, "chat-"+time.Now().Format(segmentDateFormat)+".log")
+	before, _ := os.Stat(today)
+	if err := store.(*fileStore).Compact(); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := os.Stat(today)
+	if after.Size() >= before.Size() {
+		t.Fatalf("compaction did not shrink the segment %d >= %d", after.Size(), before.Size())
+	}
+
+	results, _ := store.Query(MessageFilter{})
+	if len(results) != 2 || results[0].ID != 9 {
+		t.Fatalf("unexpected messages after compaction %v", results)
+	}
+}
+
+func TestFileStoreCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := NewFileStore(dir, SyncAlways)
+	for i := 0; i < 3; i++ {
+		store.Save(&chat.Chat{User: "stuart", MessageType: "broadcast", Message: "intact"})
+	}
+
+	//flip a byte in the payload of the first record, the two records after it are fine
+	today := filepath.Join(dir, "chat-"+time.Now().Format(segmentDateFormat)+".log")
+	file, _ := os.OpenFile(today, os.O_RDWR, 0644)
+	file.WriteAt([]byte{'#'}, 10)
+	file.Close()
+	before, _ := os.Stat(today)
+
+	if _, err := NewFileStore(dir, SyncAlways); err == nil {
+		t.Fatal("a segment corrupt in the middle was opened")
+	}
+	if after, _ := os.Stat(today); after.Size() != before.Size() {
+		t.Fatalf("the records after the corrupt one were truncated, %d bytes left of %d", after.Size(), before.Size())
+	}
+}
+
+func TestFileStoreKeepsHighestID(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := NewFileStore(dir, SyncAlways)
+	for i := 0; i < 3; i++ {
+		store.Save(&chat.Chat{User: "stuart", MessageType: "broadcast", Message: "hello"})
+	}
+	store.Delete(MessageFilter{ID: 3})
+	if err := store.(*fileStore).Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewFileStore(dir, SyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := &chat.Chat{User: "andrew", MessageType: "broadcast", Message: "new"}
+	reopened.Save(message)
+	if message.ID != 4 {
+		t.Fatalf("the id of a deleted message was given out again, got %d", message.ID)
+	}
+	if results, _ := reopened.Query(MessageFilter{}); len(results) != 3 {
+		t.Fatalf("unexpected messages after reopen %v", results)
+	}
+}
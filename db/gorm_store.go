@@ -0,0 +1,134 @@
+package db
+
+/*
+	OVERVIEW: MessageStore backed by the GORM connection in DB. The filter is translated into parameterised conditions on the chat table.
+*/
+
+import (
+	"team-cymru-telnet/models/chat"
+
+	"github.com/jinzhu/gorm"
+)
+
+type gormStore struct {
+	conn *gorm.DB
+}
+
+func NewGormStore(conn *gorm.DB) MessageStore {
+	return &gormStore{conn: conn}
+}
+
+func (g *gormStore) Save(message *chat.Chat) error {
+	return g.conn.Save(message).Error
+}
+
+//SaveBatch - saves the messages in one transaction. ids assigned by a rolled back transaction are cleared so the batch can be retried
+func (g *gormStore) SaveBatch(messages []*chat.Chat) error {
+	newIDs := []*chat.Chat{}
+	for _, message := range messages {
+		if message.ID == 0 {
+			newIDs = append(newIDs, message)
+		}
+	}
+
+	tx := g.conn.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	for _, message := range messages {
+		if err := tx.Save(message).Error; err != nil {
+			tx.Rollback()
+			for _, m := range newIDs {
+				m.ID = 0
+			}
+			return err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		for _, m := range newIDs {
+			m.ID = 0
+		}
+		return err
+	}
+	return nil
+}
+
+func (g *gormStore) Query(filter MessageFilter) ([]chat.Chat, error) {
+	messages := []chat.Chat{}
+	tx := g.where(filter).Order("id")
+	if filter.Limit > 0 {
+		tx = tx.Limit(filter.Limit)
+	}
+	err := tx.Find(&messages).Error
+	return messages, err
+}
+
+func (g *gormStore) Delete(filter MessageFilter) (int64, error) {
+	tx := g.where(filter)
+	//postgres has no DELETE ... LIMIT so a limited delete goes through the ids of the oldest matching rows
+	if filter.Limit > 0 {
+		ids := g.where(filter).Select("id").Order("id").Limit(filter.Limit).QueryExpr()
+		tx = g.conn.Model(&chat.Chat{}).Where("id IN (?)", ids)
+	}
+	result := tx.Delete(&chat.Chat{})
+	return result.RowsAffected, result.Error
+}
+
+func (g *gormStore) Stream(filter MessageFilter, fn func(chat.Chat) error) error {
+	tx := g.where(filter).Order("id")
+	if filter.Limit > 0 {
+		tx = tx.Limit(filter.Limit)
+	}
+	rows, err := tx.Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		message := chat.Chat{}
+		if err := g.conn.ScanRows(rows, &message); err != nil {
+			return err
+		}
+		if err := fn(message); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (g *gormStore) where(filter MessageFilter) *gorm.DB {
+	tx := g.conn.Model(&chat.Chat{})
+	if filter.ID != 0 {
+		tx = tx.Where("id = ?", filter.ID)
+	}
+	if len(filter.IDs) > 0 {
+		tx = tx.Where("id IN (?)", filter.IDs)
+	}
+	if filter.AfterID != 0 {
+		tx = tx.Where("id > ?", filter.AfterID)
+	}
+	//user is a reserved word in postgres so the column has to be quoted
+	if filter.User != "" {
+		tx = tx.Where(`"user" = ?`, filter.User)
+	}
+	if filter.Channel != 0 {
+		tx = tx.Where("channel = ?", filter.Channel)
+	}
+	if filter.MessageType != "" {
+		tx = tx.Where("message_type = ?", filter.MessageType)
+	}
+	if filter.Recipient != "" {
+		tx = tx.Where("pm_recipient = ?", filter.Recipient)
+	}
+	if filter.ExcludePM {
+		tx = tx.Where("message_type <> ?", "pm")
+	}
+	if !filter.Before.IsZero() {
+		tx = tx.Where("created_at < ?", filter.Before)
+	}
+	if !filter.After.IsZero() {
+		tx = tx.Where("created_at > ?", filter.After)
+	}
+	return tx
+}
@@ -0,0 +1,55 @@
+package db
+
+/*
+	OVERVIEW: Storage of the incoming webhook integrations, see api/integrations.go. Integrations are found by the hash of the secret in
+	their /hooks/ URL, the secret itself is never stored. They need a database, the memory and file dialects return ErrNoDatabase.
+*/
+
+import (
+	"fmt"
+	"team-cymru-telnet/models/integration"
+)
+
+//CreateIntegration - saves hook, whose Hash is already set, and fills in its id
+func CreateIntegration(hook *integration.Integration) error {
+	if !DB.Connected {
+		return ErrNoDatabase
+	}
+	return DB.Conn.Save(hook).Error
+}
+
+//FindIntegration - the integration whose secret has the hash. nil when there is none
+func FindIntegration(hash string) (*integration.Integration, error) {
+	if !DB.Connected {
+		return nil, ErrNoDatabase
+	}
+	hook := &integration.Integration{}
+	result := DB.Conn.Where("hash = ?", hash).First(hook)
+	if result.RecordNotFound() {
+		return nil, nil
+	}
+	return hook, result.Error
+}
+
+func ListIntegrations() ([]integration.Integration, error) {
+	if !DB.Connected {
+		return nil, ErrNoDatabase
+	}
+	hooks := []integration.Integration{}
+	err := DB.Conn.Order("id").Find(&hooks).Error
+	return hooks, err
+}
+
+func DeleteIntegration(id int) error {
+	if !DB.Connected {
+		return ErrNoDatabase
+	}
+	result := DB.Conn.Where("id = ?", id).Delete(&integration.Integration{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("integration %d does not exist", id)
+	}
+	return nil
+}
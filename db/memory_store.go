@@ -0,0 +1,107 @@
+package db
+
+/*
+	OVERVIEW: MessageStore kept in process. Used by tests and by deployments selecting the "memory" dialect. Messages are lost on restart.
+	Save assigns ids and timestamps the same way GORM does so callers see no difference.
+*/
+
+import (
+	"sync"
+	"team-cymru-telnet/models/chat"
+	"time"
+)
+
+type memoryStore struct {
+	mutex    sync.RWMutex
+	messages []chat.Chat
+	nextID   int
+}
+
+func NewMemoryStore() MessageStore {
+	return &memoryStore{nextID: 1}
+}
+
+func (m *memoryStore) Save(message *chat.Chat) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	message.UpdatedAt = now
+	if message.ID != 0 {
+		for i := range m.messages {
+			if m.messages[i].ID == message.ID {
+				m.messages[i] = *message
+				return nil
+			}
+		}
+	}
+
+	if message.ID == 0 {
+		message.ID = m.nextID
+	}
+	if message.ID >= m.nextID {
+		m.nextID = message.ID + 1
+	}
+	if message.CreatedAt.IsZero() {
+		message.CreatedAt = now
+	}
+	m.messages = append(m.messages, *message)
+	return nil
+}
+
+func (m *memoryStore) SaveBatch(messages []*chat.Chat) error {
+	for _, message := range messages {
+		if err := m.Save(message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) Query(filter MessageFilter) ([]chat.Chat, error) {
+	messages := []chat.Chat{}
+	err := m.Stream(filter, func(message chat.Chat) error {
+		messages = append(messages, message)
+		return nil
+	})
+	return messages, err
+}
+
+func (m *memoryStore) Delete(filter MessageFilter) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	kept := m.messages[:0]
+	deleted := int64(0)
+	for _, message := range m.messages {
+		if filter.matches(message) && (filter.Limit == 0 || deleted < int64(filter.Limit)) {
+			deleted++
+			continue
+		}
+		kept = append(kept, message)
+	}
+	m.messages = kept
+	return deleted, nil
+}
+
+func (m *memoryStore) Stream(filter MessageFilter, fn func(chat.Chat) error) error {
+	//copy the matches first so fn can call back into the store
+	m.mutex.RLock()
+	matched := []chat.Chat{}
+	for _, message := range m.messages {
+		if filter.matches(message) {
+			matched = append(matched, message)
+			if filter.Limit > 0 && len(matched) == filter.Limit {
+				break
+			}
+		}
+	}
+	m.mutex.RUnlock()
+
+	for _, message := range matched {
+		if err := fn(message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package db
+
+/*
+	OVERVIEW: Runs the migrations in migrations.go and records them in the schema_migrations table.
+	Connect applies every pending migration at start up. The migrate subcommand uses MigrationStatus, MigrateUp, MigrateDown and MigrateTo.
+	Every migration runs in its own transaction together with the insert or delete of its schema_migrations row, so a failed migration is not recorded.
+*/
+
+import (
+	"fmt"
+	"team-cymru-telnet/config"
+	"time"
+)
+
+type MigrationState struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+type schemaMigration struct {
+	Version   int       `gorm:"column:version;primaryKey"`
+	Name      string    `gorm:"column:name"`
+	AppliedAt time.Time `gorm:"column:applied_at"`
+}
+
+func (s *schemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+func createMigrationTable() error {
+	if !DB.Connected {
+		return ErrNoDatabase
+	}
+	return DB.Conn.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version integer PRIMARY KEY, name varchar(255), applied_at timestamp NULL)").Error
+}
+
+func appliedMigrations() (map[int]schemaMigration, error) {
+	if err := createMigrationTable(); err != nil {
+		return nil, err
+	}
+	rows := []schemaMigration{}
+	if err := DB.Conn.Order("version").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	applied := map[int]schemaMigration{}
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
+}
+
+//CurrentVersion - the highest applied version, 0 for an empty database
+func CurrentVersion() (int, error) {
+	applied, err := appliedMigrations()
+	if err != nil {
+		return 0, err
+	}
+	current := 0
+	for version := range applied {
+		if version > current {
+			current = version
+		}
+	}
+	return current, nil
+}
+
+//MigrationStatus - every known migration and whether it has been applied
+func MigrationStatus() ([]MigrationState, error) {
+	applied, err := appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	states := []MigrationState{}
+	for _, migration := range migrations {
+		state := MigrationState{Version: migration.Version, Name: migration.Name}
+		if row, ok := applied[migration.Version]; ok {
+			state.Applied = true
+			state.AppliedAt = row.AppliedAt
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+//MigrateUp - applies every pending migration and returns the ones that ran
+func MigrateUp() ([]Migration, error) {
+	return MigrateTo(latestVersion())
+}
+
+func latestVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+//MigrateDown - reverts the most recently applied migration. nothing is returned when no migration has been applied
+func MigrateDown() ([]Migration, error) {
+	current, err := CurrentVersion()
+	if err != nil || current == 0 {
+		return nil, err
+	}
+	target := 0
+	for _, migration := range migrations {
+		if migration.Version < current {
+			target = migration.Version
+		}
+	}
+	return MigrateTo(target)
+}
+
+//MigrateTo - applies or reverts migrations until version is the latest one applied. version 0 reverts everything
+func MigrateTo(version int) ([]Migration, error) {
+	if version != 0 && findMigration(version) == nil {
+		return nil, fmt.Errorf("unknown migration version %d", version)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	return migrateTo(version)
+}
+
+//migrateTo expects the caller to hold mutex
+func migrateTo(version int) ([]Migration, error) {
+	applied, err := appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	ran := []Migration{}
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; ok || migration.Version > version {
+			continue
+		}
+		if err := runMigration(migration, true); err != nil {
+			return ran, err
+		}
+		ran = append(ran, migration)
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		migration := migrations[i]
+		if _, ok := applied[migration.Version]; !ok || migration.Version <= version {
+			continue
+		}
+		if err := runMigration(migration, false); err != nil {
+			return ran, err
+		}
+		ran = append(ran, migration)
+	}
+	return ran, nil
+}
+
+func runMigration(migration Migration, up bool) error {
+	statements, ok := migration.Down[config.Cfg.Dialect]
+	direction := "down"
+	if up {
+		statements, ok = migration.Up[config.Cfg.Dialect]
+		direction = "up"
+	}
+	if !ok {
+		return fmt.Errorf("migration %d (%s) has no %s statements for the %s dialect", migration.Version, migration.Name, direction, config.Cfg.Dialect)
+	}
+
+	tx := DB.Conn.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	for _, statement := range statements {
+		if err := tx.Exec(statement).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s) %s failed: %v", migration.Version, migration.Name, direction, err)
+		}
+	}
+
+	var err error
+	if up {
+		err = tx.Create(&schemaMigration{Version: migration.Version, Name: migration.Name, AppliedAt: time.Now()}).Error
+	} else {
+		err = tx.Where("version = ?", migration.Version).Delete(&schemaMigration{}).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("migration %d (%s) %s could not be recorded: %v", migration.Version, migration.Name, direction, err)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	config.Log("db").Info("migration run", config.F("migration", migration.Version), config.F("name", migration.Name), config.F("direction", direction))
+	return nil
+}
+
+func findMigration(version int) *Migration {
+	for i := range migrations {
+		if migrations[i].Version == version {
+			return &migrations[i]
+		}
+	}
+	return nil
+}
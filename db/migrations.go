@@ -0,0 +1,166 @@
+package db
+
+/*
+	OVERVIEW: The schema, as an ordered list of migrations. Each migration has up and down statements per dialect and runs in a transaction.
+	Never edit a migration that has been released, add a new one with the next version instead.
+	The first migrations use IF NOT EXISTS so databases created by the old GORM AutoMigrate are adopted without changes.
+	Postgres is the only dialect with a schema, memory and file do not use migrations. A dialect listed with no statements records the
+	migration as applied. A dialect that is not listed at all has no schema, the migration fails instead of being recorded as applied without
+	creating anything. Adding a dialect means adding its statements to every migration.
+*/
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      map[string][]string
+	Down    map[string][]string
+}
+
+var migrations []Migration = []Migration{
+	{
+		Version: 1,
+		Name:    "create chat",
+		Up: map[string][]string{
+			"postgres": {`CREATE TABLE IF NOT EXISTS chat (
+				id serial PRIMARY KEY,
+				"user" text,
+				channel bigint,
+				pm_recipient text,
+				message text,
+				message_type text,
+				created_at timestamp with time zone,
+				updated_at timestamp with time zone
+			)`},
+		},
+		Down: map[string][]string{
+			"postgres": {"DROP TABLE chat"},
+		},
+	},
+	{
+		Version: 2,
+		Name:    "create api_token",
+		Up: map[string][]string{
+			"postgres": {
+				`CREATE TABLE IF NOT EXISTS api_token (
+					id serial PRIMARY KEY,
+					identity text,
+					scopes text,
+					hash text,
+					revoked boolean,
+					created_at timestamp with time zone,
+					updated_at timestamp with time zone
+				)`,
+				"CREATE UNIQUE INDEX IF NOT EXISTS uix_api_token_hash ON api_token (hash)",
+			},
+		},
+		Down: map[string][]string{
+			"postgres": {"DROP TABLE api_token"},
+		},
+	},
+	{
+		Version: 3,
+		Name:    "create webhooks",
+		Up: map[string][]string{
+			"postgres": {
+				`CREATE TABLE IF NOT EXISTS webhook_subscription (
+					id serial PRIMARY KEY,
+					url text,
+					events text,
+					channel bigint,
+					keywords text,
+					secret text,
+					created_at timestamp with time zone,
+					updated_at timestamp with time zone
+				)`,
+				`CREATE TABLE IF NOT EXISTS webhook_delivery (
+					id serial PRIMARY KEY,
+					subscription_id integer,
+					event text,
+					payload text,
+					status text,
+					attempts integer,
+					response_code integer,
+					last_error text,
+					created_at timestamp with time zone,
+					updated_at timestamp with time zone
+				)`,
+			},
+		},
+		Down: map[string][]string{
+			"postgres": {"DROP TABLE webhook_delivery", "DROP TABLE webhook_subscription"},
+		},
+	},
+	{
+		Version: 4,
+		Name:    "create integration",
+		Up: map[string][]string{
+			"postgres": {
+				`CREATE TABLE IF NOT EXISTS integration (
+					id serial PRIMARY KEY,
+					name text,
+					channel bigint,
+					hash text,
+					created_at timestamp with time zone,
+					updated_at timestamp with time zone
+				)`,
+				"CREATE UNIQUE INDEX IF NOT EXISTS uix_integration_hash ON integration (hash)",
+			},
+		},
+		Down: map[string][]string{
+			"postgres": {"DROP TABLE integration"},
+		},
+	},
+	{
+		Version: 5,
+		Name:    "index chat history columns",
+		Up: map[string][]string{
+			"postgres": {
+				"CREATE INDEX IF NOT EXISTS idx_chat_created_at ON chat (created_at)",
+				`CREATE INDEX IF NOT EXISTS idx_chat_user ON chat ("user")`,
+				"CREATE INDEX IF NOT EXISTS idx_chat_channel ON chat (channel)",
+				"CREATE INDEX IF NOT EXISTS idx_chat_message_type ON chat (message_type)",
+				"CREATE INDEX IF NOT EXISTS idx_webhook_delivery_subscription_id ON webhook_delivery (subscription_id)",
+			},
+		},
+		Down: map[string][]string{
+			"postgres": {
+				"DROP INDEX idx_webhook_delivery_subscription_id",
+				"DROP INDEX idx_chat_message_type",
+				"DROP INDEX idx_chat_channel",
+				"DROP INDEX idx_chat_user",
+				"DROP INDEX idx_chat_created_at",
+			},
+		},
+	},
+	{
+		Version: 6,
+		Name:    "full text search index",
+		Up: map[string][]string{
+			"postgres": {"CREATE INDEX IF NOT EXISTS chat_message_search ON chat USING GIN (to_tsvector('english', message))"},
+		},
+		Down: map[string][]string{
+			"postgres": {"DROP INDEX chat_message_search"},
+		},
+	},
+	{
+		Version: 7,
+		Name:    "create ssh_key",
+		Up: map[string][]string{
+			"postgres": {
+				`CREATE TABLE ssh_key (
+					id serial PRIMARY KEY,
+					user_name text,
+					public_key text,
+					fingerprint text,
+					created_at timestamp with time zone,
+					updated_at timestamp with time zone
+				)`,
+				"CREATE UNIQUE INDEX uix_ssh_key_fingerprint ON ssh_key (fingerprint)",
+				"CREATE INDEX idx_ssh_key_user_name ON ssh_key (user_name)",
+			},
+		},
+		Down: map[string][]string{
+			"postgres": {"DROP TABLE ssh_key"},
+		},
+	},
+}
@@ -0,0 +1,45 @@
+package db
+
+import "testing"
+
+func TestMigrationsAreOrdered(t *testing.T) {
+	previous := 0
+	for _, migration := range migrations {
+		if migration.Version != previous+1 {
+			t.Fatalf("migration %q has version %d, expected %d", migration.Name, migration.Version, previous+1)
+		}
+		previous = migration.Version
+	}
+}
+
+func TestMigrationsCanBeReverted(t *testing.T) {
+	for _, migration := range migrations {
+		for dialect, statements := range migration.Up {
+			if len(statements) > 0 && len(migration.Down[dialect]) == 0 {
+				t.Errorf("migration %d (%s) has no %s down statements", migration.Version, migration.Name, dialect)
+			}
+		}
+	}
+}
+
+func TestFindMigration(t *testing.T) {
+	if findMigration(latestVersion()) == nil {
+		t.Fatal("the latest migration was not found")
+	}
+	if findMigration(latestVersion()+1) != nil {
+		t.Fatal("found a migration that does not exist")
+	}
+}
+
+func TestMigrationsCoverEveryDialect(t *testing.T) {
+	for _, migration := range migrations {
+		for _, dialect := range []string{"postgres"} {
+			if _, ok := migration.Up[dialect]; !ok {
+				t.Errorf("migration %d (%s) does not list the %s dialect", migration.Version, migration.Name, dialect)
+			}
+			if _, ok := migration.Down[dialect]; !ok {
+				t.Errorf("migration %d (%s) does not list the %s down statements", migration.Version, migration.Name, dialect)
+			}
+		}
+	}
+}
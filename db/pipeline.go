@@ -0,0 +1,453 @@
+package db
+
+/*
+	OVERVIEW: Asynchronous, batched persistence of chat messages so a slow or unavailable database never blocks the user who is typing.
+	Persist() puts the message on a bounded queue and returns. A single writer saves the queue in batches, either when BatchSize messages are waiting
+	or when FlushInterval has passed. Transient errors (lost connections, timeouts) are retried with a short backoff. When the retries run out,
+	or the queue is full, the messages are appended to the spill file as JSON lines and are replayed into the store once a save succeeds again.
+	Messages are dated when they are queued so a message saved late, e.g. replayed after an outage, keeps the time it was sent.
+	A replay first moves the spill file aside, to the spill file name with .replay, so new messages can be spilled while it saves.
+	Errors that are not transient, e.g. a value the database rejects, are logged and the batch is dropped. A spilled message the store rejects
+	is moved to the spill file name with .rejected, so it does not block the replay, and can be fixed and appended to the spill file by hand.
+	Stats() reports the queue depth and the counters used by GET /api/v1/metrics.
+*/
+
+import (
+	"bufio"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"team-cymru-telnet/config"
+	"team-cymru-telnet/models/chat"
+	"time"
+)
+
+//number of times a failing batch is retried before it is spilled to disk
+const persistRetries = 3
+
+type PipelineStats struct {
+	QueueDepth    int    `json:"queue_depth"`
+	QueueCapacity int    `json:"queue_capacity"`
+	Saved         uint64 `json:"saved"`
+	Batches       uint64 `json:"batches"`
+	Retries       uint64 `json:"retries"`
+	Failed        uint64 `json:"failed"`
+	Spilled       uint64 `json:"spilled"`
+	Replayed      uint64 `json:"replayed"`
+	SpillPending  bool   `json:"spill_pending"`
+}
+
+type Pipeline struct {
+	store         MessageStore
+	queue         chan *chat.Chat
+	batchSize     int
+	flushInterval time.Duration
+	spillPath     string
+	onSaved       func(chat.Chat)
+
+	spillMutex   sync.Mutex
+	spillPending int32
+
+	saved    uint64
+	batches  uint64
+	retries  uint64
+	failed   uint64
+	spilled  uint64
+	replayed uint64
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+//NewPipeline - starts the writer. onSaved is called for every message once it has been saved and has its id
+func NewPipeline(store MessageStore, queueSize int, batchSize int, flushInterval time.Duration, spillPath string, onSaved func(chat.Chat)) *Pipeline {
+	p := &Pipeline{
+		store:         store,
+		queue:         make(chan *chat.Chat, queueSize),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		spillPath:     spillPath,
+		onSaved:       onSaved,
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+	//messages spilled before a restart are waiting to be replayed
+	for _, path := range []string{spillPath, p.replayPath()} {
+		if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+			p.spillPending = 1
+		}
+	}
+	go p.run()
+	return p
+}
+
+//Enqueue - never blocks. a full queue sends the message straight to the spill file
+func (p *Pipeline) Enqueue(message *chat.Chat) {
+	now := time.Now()
+	if message.CreatedAt.IsZero() {
+		message.CreatedAt = now
+	}
+	if message.UpdatedAt.IsZero() {
+		message.UpdatedAt = now
+	}
+	select {
+	case p.queue <- message:
+	default:
+		config.Log("db").Error("persistence queue is full. spilling message to disk", config.User(message.User))
+		p.spill([]*chat.Chat{message})
+	}
+}
+
+func (p *Pipeline) run() {
+	defer close(p.stopped)
+	ticker := time.NewTicker(p.flushInterval)
+	defer ticker.Stop()
+
+	batch := []*chat.Chat{}
+	for {
+		select {
+		case message := <-p.queue:
+			batch = append(batch, message)
+			if len(batch) >= p.batchSize {
+				p.flush(batch)
+				batch = []*chat.Chat{}
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				p.flush(batch)
+				batch = []*chat.Chat{}
+			} else if atomic.LoadInt32(&p.spillPending) == 1 {
+				p.replay()
+			}
+		case <-p.done:
+			//drain whatever was queued before Close was called
+			for len(p.queue) > 0 {
+				batch = append(batch, <-p.queue)
+			}
+			for len(batch) > 0 {
+				n := len(batch)
+				if n > p.batchSize {
+					n = p.batchSize
+				}
+				p.flush(batch[:n])
+				batch = batch[n:]
+			}
+			return
+		}
+	}
+}
+
+func (p *Pipeline) flush(batch []*chat.Chat) {
+	err := p.save(batch)
+	if err == nil {
+		if atomic.LoadInt32(&p.spillPending) == 1 {
+			p.replay()
+		}
+		return
+	}
+
+	if isTransient(err) {
+		config.Log("db").Error("failed to save messages after the retries, spilling to disk", config.F("count", len(batch)), config.F("retries", persistRetries), config.Err(err))
+		p.spill(batch)
+		return
+	}
+	atomic.AddUint64(&p.failed, uint64(len(batch)))
+	config.Log("db").Error("dropped messages the store rejected", config.F("count", len(batch)), config.Err(err))
+}
+
+//save writes the batch, retrying transient errors with a doubling backoff
+func (p *Pipeline) save(batch []*chat.Chat) error {
+	backoff := 100 * time.Millisecond
+	var err error
+	for attempt := 0; attempt <= persistRetries; attempt++ {
+		if attempt > 0 {
+			atomic.AddUint64(&p.retries, 1)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		err = p.store.SaveBatch(batch)
+		if err == nil {
+			atomic.AddUint64(&p.batches, 1)
+			atomic.AddUint64(&p.saved, uint64(len(batch)))
+			if p.onSaved != nil {
+				for _, message := range batch {
+					p.onSaved(*message)
+				}
+			}
+			return nil
+		}
+		if !isTransient(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (p *Pipeline) spill(batch []*chat.Chat) {
+	p.spillMutex.Lock()
+	defer p.spillMutex.Unlock()
+
+	file, err := os.OpenFile(p.spillPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		atomic.AddUint64(&p.failed, uint64(len(batch)))
+		config.Log("db").Error("could not open the spill file, messages lost", config.F("path", p.spillPath), config.F("count", len(batch)), config.Err(err))
+		return
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	for _, message := range batch {
+		if err := encoder.Encode(message); err != nil {
+			atomic.AddUint64(&p.failed, 1)
+			config.Log("db").Error("could not write to the spill file, message lost", config.F("path", p.spillPath), config.Err(err))
+			continue
+		}
+		atomic.AddUint64(&p.spilled, 1)
+	}
+	file.Sync()
+	atomic.StoreInt32(&p.spillPending, 1)
+}
+
+func (p *Pipeline) replayPath() string {
+	return p.spillPath + ".replay"
+}
+
+//replay saves the spilled messages and empties the spill file. it stops at the first failure and tries again on the next flush.
+//the lock is only held to move the spill file aside, a slow store must not block spill and so Enqueue
+func (p *Pipeline) replay() {
+	p.spillMutex.Lock()
+	//a replay file left by a failed replay is finished before the messages spilled since
+	if _, err := os.Stat(p.replayPath()); os.IsNotExist(err) {
+		if err := os.Rename(p.spillPath, p.replayPath()); err != nil {
+			if os.IsNotExist(err) {
+				atomic.StoreInt32(&p.spillPending, 0)
+			}
+			p.spillMutex.Unlock()
+			return
+		}
+	}
+	p.spillMutex.Unlock()
+
+	file, err := os.Open(p.replayPath())
+	if err != nil {
+		return
+	}
+	messages := []*chat.Chat{}
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			message := &chat.Chat{}
+			if jsonErr := json.Unmarshal(line, message); jsonErr == nil {
+				messages = append(messages, message)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return
+		}
+	}
+	file.Close()
+
+	for len(messages) > 0 {
+		n := len(messages)
+		if n > p.batchSize {
+			n = p.batchSize
+		}
+		err := p.store.SaveBatch(messages[:n])
+		if err == nil {
+			p.markReplayed(messages[:n])
+		} else if isTransient(err) {
+			//keep what has not been saved for the next attempt
+			p.rewriteReplay(messages)
+			return
+		} else {
+			//save the batch one message at a time so only the messages the store rejects are set aside
+			for i, message := range messages[:n] {
+				err := p.store.SaveBatch([]*chat.Chat{message})
+				if err == nil {
+					p.markReplayed([]*chat.Chat{message})
+				} else if isTransient(err) {
+					p.rewriteReplay(messages[i:])
+					return
+				} else {
+					p.reject(message, err)
+				}
+			}
+		}
+		messages = messages[n:]
+	}
+
+	os.Remove(p.replayPath())
+	config.Log("db").Info("replayed spilled messages into the store")
+
+	p.spillMutex.Lock()
+	defer p.spillMutex.Unlock()
+	//messages spilled during the replay are replayed on the next flush
+	if info, err := os.Stat(p.spillPath); err != nil || info.Size() == 0 {
+		atomic.StoreInt32(&p.spillPending, 0)
+	}
+}
+
+func (p *Pipeline) markReplayed(batch []*chat.Chat) {
+	if p.onSaved != nil {
+		for _, message := range batch {
+			p.onSaved(*message)
+		}
+	}
+	atomic.AddUint64(&p.replayed, uint64(len(batch)))
+}
+
+func (p *Pipeline) rejectedPath() string {
+	return p.spillPath + ".rejected"
+}
+
+//reject moves a spilled message the store will never accept out of the replay into the rejected file
+func (p *Pipeline) reject(message *chat.Chat, err error) {
+	atomic.AddUint64(&p.failed, 1)
+	config.Log("db").Error("the store rejected a spilled message, moving it to the rejected file", config.F("path", p.rejectedPath()), config.User(message.User), config.Err(err))
+
+	file, openErr := os.OpenFile(p.rejectedPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if openErr != nil {
+		config.Log("db").Error("could not open the rejected file, the message is lost", config.F("path", p.rejectedPath()), config.User(message.User), config.Err(openErr))
+		return
+	}
+	defer file.Close()
+	if encodeErr := json.NewEncoder(file).Encode(message); encodeErr != nil {
+		config.Log("db").Error("could not write to the rejected file, the message is lost", config.F("path", p.rejectedPath()), config.User(message.User), config.Err(encodeErr))
+		return
+	}
+	file.Sync()
+}
+
+func (p *Pipeline) rewriteReplay(messages []*chat.Chat) {
+	tmpPath := p.replayPath() + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return
+	}
+	encoder := json.NewEncoder(file)
+	for _, message := range messages {
+		encoder.Encode(message)
+	}
+	file.Sync()
+	file.Close()
+	os.Rename(tmpPath, p.replayPath())
+}
+
+func (p *Pipeline) Stats() PipelineStats {
+	return PipelineStats{
+		QueueDepth:    len(p.queue),
+		QueueCapacity: cap(p.queue),
+		Saved:         atomic.LoadUint64(&p.saved),
+		Batches:       atomic.LoadUint64(&p.batches),
+		Retries:       atomic.LoadUint64(&p.retries),
+		Failed:        atomic.LoadUint64(&p.failed),
+		Spilled:       atomic.LoadUint64(&p.spilled),
+		Replayed:      atomic.LoadUint64(&p.replayed),
+		SpillPending:  atomic.LoadInt32(&p.spillPending) == 1,
+	}
+}
+
+//Close - saves everything still queued and stops the writer
+func (p *Pipeline) Close() {
+	close(p.done)
+	<-p.stopped
+}
+
+//isTransient reports errors worth retrying: the connection to the database was lost or timed out
+func isTransient(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	message := strings.ToLower(err.Error())
+	for _, text := range []string{"connection refused", "connection reset", "broken pipe", "bad connection", "timeout", "too many connections", "the database system is"} {
+		if strings.Contains(message, text) {
+			return true
+		}
+	}
+	return false
+}
+
+//StartPersistence - starts the pipeline used by Persist. onSaved is called with every saved message
+func StartPersistence(onSaved func(chat.Chat)) {
+	queueSize := config.Cfg.PersistQueueSize
+	if queueSize <= 0 {
+		queueSize = 10000
+	}
+	batchSize := config.Cfg.PersistBatchSize
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	interval := time.Duration(config.Cfg.PersistFlushMillis) * time.Millisecond
+	if interval <= 0 {
+		interval = 500 * time.Millisecond
+	}
+	spillPath := config.Cfg.SpillFile
+	if spillPath == "" {
+		spillPath = config.Cfg.LogFile + ".spill"
+	}
+
+	pipelineMutex.Lock()
+	savedHook = onSaved
+	pipeline = NewPipeline(Messages, queueSize, batchSize, interval, spillPath, onSaved)
+	pipelineMutex.Unlock()
+	config.Log("db").Info("persistence pipeline has started")
+}
+
+//Persist - queues the message to be saved. before StartPersistence it is saved synchronously
+func Persist(message *chat.Chat) {
+	pipelineMutex.RLock()
+	defer pipelineMutex.RUnlock()
+	if pipeline != nil {
+		pipeline.Enqueue(message)
+		return
+	}
+	if err := Messages.Save(message); err != nil {
+		config.Log("db").Error("failed to save message", config.User(message.User), config.F("type", message.MessageType), config.Err(err))
+		return
+	}
+	if savedHook != nil {
+		savedHook(*message)
+	}
+}
+
+//PersistenceStats - the zero value until StartPersistence has been called
+func PersistenceStats() PipelineStats {
+	pipelineMutex.RLock()
+	defer pipelineMutex.RUnlock()
+	if pipeline == nil {
+		return PipelineStats{}
+	}
+	return pipeline.Stats()
+}
+
+//StopPersistence - flushes the queue and returns the final stats. messages persisted afterwards are saved synchronously
+func StopPersistence() PipelineStats {
+	pipelineMutex.Lock()
+	p := pipeline
+	pipeline = nil
+	pipelineMutex.Unlock()
+	if p == nil {
+		return PipelineStats{}
+	}
+	p.Close()
+	return p.Stats()
+}
+
+var pipeline *Pipeline
+var pipelineMutex sync.RWMutex
+var savedHook func(chat.Chat)
@@ -0,0 +1,165 @@
+package db
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"team-cymru-telnet/config"
+	"team-cymru-telnet/models/chat"
+	"testing"
+	"time"
+)
+
+//flakyStore fails every batch while down is set, like a database that has gone away
+type flakyStore struct {
+	MessageStore
+	mutex sync.Mutex
+	down  bool
+}
+
+func (f *flakyStore) SaveBatch(messages []*chat.Chat) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.down {
+		return errors.New("dial tcp 127.0.0.1:5432: connect: connection refused")
+	}
+	return f.MessageStore.SaveBatch(messages)
+}
+
+func (f *flakyStore) setDown(down bool) {
+	f.mutex.Lock()
+	f.down = down
+	f.mutex.Unlock()
+}
+
+func TestPipelineSpillAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	config.Cfg.LogFile = filepath.Join(dir, "ChatServer")
+	store := &flakyStore{MessageStore: NewMemoryStore(), down: true}
+
+	indexed := make(chan chat.Chat, 10)
+	p := NewPipeline(store, 10, 2, 20*time.Millisecond, filepath.Join(dir, "spill"), func(message chat.Chat) {
+		indexed <- message
+	})
+	p.Enqueue(&chat.Chat{User: "stuart", MessageType: "broadcast", Message: "one"})
+	p.Enqueue(&chat.Chat{User: "stuart", MessageType: "broadcast", Message: "two"})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Stats().Spilled != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("messages were not spilled %+v", p.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	up := time.Now()
+	store.setDown(false)
+	p.Enqueue(&chat.Chat{User: "andrew", MessageType: "broadcast", Message: "three"})
+	p.Close()
+
+	stats := p.Stats()
+	if stats.Saved != 1 || stats.Replayed != 2 || stats.SpillPending || stats.Failed != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	messages, _ := store.Query(MessageFilter{})
+	if len(messages) != 3 || len(indexed) != 3 {
+		t.Fatalf("expected 3 saved and indexed messages got %d and %d", len(messages), len(indexed))
+	}
+	for _, message := range messages {
+		if message.Message != "three" && !message.CreatedAt.Before(up) {
+			t.Fatalf("replayed message %q is dated %v, after it was sent", message.Message, message.CreatedAt)
+		}
+	}
+}
+
+//blockingStore holds every batch until release is closed, like a database that has become very slow
+type blockingStore struct {
+	MessageStore
+	release chan struct{}
+}
+
+func (b *blockingStore) SaveBatch(messages []*chat.Chat) error {
+	<-b.release
+	return b.MessageStore.SaveBatch(messages)
+}
+
+func TestReplayDoesNotBlockSpill(t *testing.T) {
+	dir := t.TempDir()
+	config.Cfg.LogFile = filepath.Join(dir, "ChatServer")
+	spillPath := filepath.Join(dir, "spill")
+	ioutil.WriteFile(spillPath, []byte(`{"User":"stuart","MessageType":"broadcast","Message":"spilled before a restart"}`+"\n"), 0600)
+	store := &blockingStore{MessageStore: NewMemoryStore(), release: make(chan struct{})}
+
+	//the writer starts replaying the spill file on its first tick and is held there by the store
+	p := NewPipeline(store, 1, 1, 10*time.Millisecond, spillPath, nil)
+	time.Sleep(50 * time.Millisecond)
+	enqueued := make(chan struct{})
+	go func() {
+		p.Enqueue(&chat.Chat{User: "andrew", MessageType: "broadcast", Message: "queued"})
+		p.Enqueue(&chat.Chat{User: "andrew", MessageType: "broadcast", Message: "spilled during the replay"})
+		close(enqueued)
+	}()
+	select {
+	case <-enqueued:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Enqueue blocked while the spill file was being replayed")
+	}
+
+	close(store.release)
+	p.Close()
+	if messages, _ := store.Query(MessageFilter{}); len(messages) != 3 {
+		t.Fatalf("expected 3 saved messages got %d", len(messages))
+	}
+}
+
+//pickyStore rejects every batch holding a message with the text bad, like a database refusing a value
+type pickyStore struct {
+	MessageStore
+}
+
+func (p *pickyStore) SaveBatch(messages []*chat.Chat) error {
+	for _, message := range messages {
+		if message.Message == "bad" {
+			return errors.New(`pq: invalid byte sequence for encoding "UTF8"`)
+		}
+	}
+	return p.MessageStore.SaveBatch(messages)
+}
+
+func TestReplayRejectedMessage(t *testing.T) {
+	dir := t.TempDir()
+	config.Cfg.LogFile = filepath.Join(dir, "ChatServer")
+	spillPath := filepath.Join(dir, "spill")
+	ioutil.WriteFile(spillPath, []byte(`{"User":"stuart","MessageType":"broadcast","Message":"one"}
+{"User":"stuart","MessageType":"broadcast","Message":"bad"}
+{"User":"stuart","MessageType":"broadcast","Message":"two"}
+`), 0600)
+	store := &pickyStore{MessageStore: NewMemoryStore()}
+
+	p := NewPipeline(store, 10, 2, 10*time.Millisecond, spillPath, nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Stats().SpillPending {
+		if time.Now().After(deadline) {
+			t.Fatalf("the replay never finished %+v", p.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	p.Close()
+
+	if stats := p.Stats(); stats.Replayed != 2 || stats.Failed != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if messages, _ := store.Query(MessageFilter{}); len(messages) != 2 {
+		t.Fatalf("expected the 2 good messages to be saved got %d", len(messages))
+	}
+	if _, err := os.Stat(spillPath + ".replay"); !os.IsNotExist(err) {
+		t.Fatal("the replay file was kept")
+	}
+	rejected, _ := ioutil.ReadFile(spillPath + ".rejected")
+	if !strings.Contains(string(rejected), `"Message":"bad"`) || strings.Count(string(rejected), "\n") != 1 {
+		t.Fatalf("unexpected rejected file %q", rejected)
+	}
+}
@@ -0,0 +1,86 @@
+package db
+
+/*
+	OVERVIEW: MessageStore is the only way the server and the API read and write chat messages, so neither depends on GORM or a live database.
+	The backend is chosen by the dialect in config.json. "memory" keeps messages in process (tests and ephemeral deployments, nothing survives a restart),
+	every other dialect is passed to GORM.
+	Query returns messages oldest first. Limit caps the number of messages returned by Query and deleted by Delete, 0 means no limit.
+*/
+
+import (
+	"team-cymru-telnet/models/chat"
+	"time"
+)
+
+type MessageFilter struct {
+	ID int
+	//IDs matches any of the listed messages, e.g. a batch selected by retention
+	IDs         []int
+	User        string
+	Channel     int
+	MessageType string
+	Recipient   string
+	//ExcludePM leaves out private messages for callers that are not allowed to read them
+	ExcludePM bool
+	Before    time.Time
+	After     time.Time
+	//AfterID matches messages with a larger id, to page through a Stream
+	AfterID int
+	Limit   int
+}
+
+type MessageStore interface {
+	Save(message *chat.Chat) error
+	//SaveBatch saves every message or, where the backend allows it, none of them
+	SaveBatch(messages []*chat.Chat) error
+	Query(filter MessageFilter) ([]chat.Chat, error)
+	Delete(filter MessageFilter) (int64, error)
+	//Stream calls fn for every matching message, oldest first, without loading them all at once. a non nil error from fn stops the stream
+	Stream(filter MessageFilter, fn func(chat.Chat) error) error
+}
+
+//matches is the in process version of the filter, used by stores which cannot push it down to a database
+func (f MessageFilter) matches(message chat.Chat) bool {
+	if f.ID != 0 && message.ID != f.ID {
+		return false
+	}
+	if f.AfterID != 0 && message.ID <= f.AfterID {
+		return false
+	}
+	if len(f.IDs) > 0 && !containsID(f.IDs, message.ID) {
+		return false
+	}
+	if f.User != "" && message.User != f.User {
+		return false
+	}
+	if f.Channel != 0 && (!message.Channel.Valid || message.Channel.Int64 != int64(f.Channel)) {
+		return false
+	}
+	if f.MessageType != "" && message.MessageType != f.MessageType {
+		return false
+	}
+	if f.Recipient != "" && message.PMRecipient.String != f.Recipient {
+		return false
+	}
+	if f.ExcludePM && message.MessageType == "pm" {
+		return false
+	}
+	if !f.Before.IsZero() && !message.CreatedAt.Before(f.Before) {
+		return false
+	}
+	if !f.After.IsZero() && !message.CreatedAt.After(f.After) {
+		return false
+	}
+	return true
+}
+
+func containsID(ids []int, id int) bool {
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+	return false
+}
+
+var Messages MessageStore
@@ -0,0 +1,53 @@
+package db
+
+import (
+	"database/sql"
+	"team-cymru-telnet/models/chat"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	messages := []*chat.Chat{
+		{User: "stuart", MessageType: "broadcast", Message: "hello all"},
+		{User: "andrew", MessageType: "channel", Channel: sql.NullInt64{Valid: true, Int64: 1}, Message: "hello channel"},
+		{User: "andrew", MessageType: "pm", PMRecipient: sql.NullString{Valid: true, String: "stuart"}, Message: "hey stuart"},
+	}
+	for _, message := range messages {
+		if err := store.Save(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if messages[2].ID != 3 || messages[2].CreatedAt.IsZero() {
+		t.Fatalf("save did not assign id and timestamp %+v", messages[2])
+	}
+
+	results, _ := store.Query(MessageFilter{ExcludePM: true})
+	if len(results) != 2 || results[0].ID != 1 {
+		t.Fatalf("unexpected results %v", results)
+	}
+	results, _ = store.Query(MessageFilter{User: "andrew", Channel: 1})
+	if len(results) != 1 || results[0].Message != "hello channel" {
+		t.Fatalf("unexpected results %v", results)
+	}
+	results, _ = store.Query(MessageFilter{Recipient: "stuart", After: time.Now().Add(-time.Minute)})
+	if len(results) != 1 || results[0].ID != 3 {
+		t.Fatalf("unexpected results %v", results)
+	}
+
+	streamed := 0
+	store.Stream(MessageFilter{Limit: 2}, func(message chat.Chat) error {
+		streamed++
+		return nil
+	})
+	if streamed != 2 {
+		t.Fatalf("expected 2 streamed messages got %d", streamed)
+	}
+
+	deleted, _ := store.Delete(MessageFilter{User: "andrew", Limit: 1})
+	results, _ = store.Query(MessageFilter{})
+	if deleted != 1 || len(results) != 2 || results[1].ID != 3 {
+		t.Fatalf("unexpected delete %d %v", deleted, results)
+	}
+}
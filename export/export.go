@@ -0,0 +1,97 @@
+package export
+
+/*
+	OVERVIEW: Writes chat history in one of three formats, used by GET /api/v1/export and the export subcommand.
+	ndjson is one JSON message per line, csv has a header row, and transcript is the "name timestamp#: message" layout the telnet clients see.
+	Messages are streamed from the store one at a time so an export never holds the whole history in memory.
+	Timestamps are converted to the location passed to Write.
+*/
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"team-cymru-telnet/db"
+	"team-cymru-telnet/models/chat"
+	"time"
+)
+
+var Formats = map[string]string{
+	"ndjson":     "application/x-ndjson",
+	"csv":        "text/csv",
+	"transcript": "text/plain; charset=utf-8",
+}
+
+var csvHeader = []string{"id", "user", "channel", "recipient", "message_type", "message", "created_at"}
+
+//Write - streams the messages matching filter to w, oldest first
+func Write(w io.Writer, format string, filter db.MessageFilter, loc *time.Location) error {
+	if _, ok := Formats[format]; !ok {
+		return fmt.Errorf("unknown export format %q. use ndjson, csv or transcript", format)
+	}
+	out := bufio.NewWriter(w)
+
+	var write func(message chat.Chat) error
+	switch format {
+	case "ndjson":
+		encoder := json.NewEncoder(out)
+		write = func(message chat.Chat) error {
+			message.CreatedAt = message.CreatedAt.In(loc)
+			message.UpdatedAt = message.UpdatedAt.In(loc)
+			return encoder.Encode(message)
+		}
+	case "csv":
+		csvWriter := csv.NewWriter(out)
+		if err := csvWriter.Write(csvHeader); err != nil {
+			return err
+		}
+		write = func(message chat.Chat) error {
+			channel := ""
+			if message.Channel.Valid {
+				channel = strconv.FormatInt(message.Channel.Int64, 10)
+			}
+			csvWriter.Write([]string{
+				strconv.Itoa(message.ID),
+				message.User,
+				channel,
+				message.PMRecipient.String,
+				message.MessageType,
+				message.Message,
+				message.CreatedAt.In(loc).Format(time.RFC3339),
+			})
+			csvWriter.Flush()
+			return csvWriter.Error()
+		}
+	case "transcript":
+		write = func(message chat.Chat) error {
+			_, err := fmt.Fprintln(out, TranscriptLine(message, loc))
+			return err
+		}
+	}
+
+	if err := db.Messages.Stream(filter, write); err != nil {
+		out.Flush()
+		return err
+	}
+	return out.Flush()
+}
+
+//TranscriptLine - the message as the telnet server displays it. private messages also name the recipient
+func TranscriptLine(message chat.Chat, loc *time.Location) string {
+	timeStamp := message.CreatedAt.In(loc).Format(time.Stamp)
+	channel := ""
+	if message.Channel.Valid {
+		channel = "Channel: " + strconv.FormatInt(message.Channel.Int64, 10) + " "
+	}
+	switch message.MessageType {
+	case "pm":
+		return "Private Message: " + message.User + " to " + message.PMRecipient.String + " " + timeStamp + "#: " + message.Message
+	case "integration":
+		return "[bot] " + channel + message.User + " " + timeStamp + "#: " + message.Message
+	default:
+		return channel + message.User + " " + timeStamp + "#: " + message.Message
+	}
+}
@@ -0,0 +1,69 @@
+package export
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"strings"
+	"team-cymru-telnet/db"
+	"team-cymru-telnet/models/chat"
+	"testing"
+	"time"
+)
+
+func seed(t *testing.T) {
+	db.Messages = db.NewMemoryStore()
+	sent := time.Date(2020, 11, 2, 15, 4, 5, 0, time.UTC)
+	messages := []*chat.Chat{
+		{User: "stuart", MessageType: "broadcast", Message: "hello all", CreatedAt: sent},
+		{User: "andrew", MessageType: "channel", Channel: sql.NullInt64{Valid: true, Int64: 3}, Message: "deploying, \"careful\"", CreatedAt: sent},
+		{User: "andrew", MessageType: "pm", PMRecipient: sql.NullString{Valid: true, String: "stuart"}, Message: "hey", CreatedAt: sent},
+	}
+	for _, message := range messages {
+		if err := db.Messages.Save(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTranscript(t *testing.T) {
+	seed(t)
+	loc, _ := time.LoadLocation("America/Chicago")
+	out := bytes.Buffer{}
+	if err := Write(&out, "transcript", db.MessageFilter{ExcludePM: true}, loc); err != nil {
+		t.Fatal(err)
+	}
+	expected := "stuart Nov  2 09:04:05#: hello all\nChannel: 3 andrew Nov  2 09:04:05#: deploying, \"careful\"\n"
+	if out.String() != expected {
+		t.Fatalf("unexpected transcript:\n%s", out.String())
+	}
+}
+
+func TestCSV(t *testing.T) {
+	seed(t)
+	out := bytes.Buffer{}
+	if err := Write(&out, "csv", db.MessageFilter{Channel: 3}, time.UTC); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[1][5] != "deploying, \"careful\"" || records[1][6] != "2020-11-02T15:04:05Z" {
+		t.Fatalf("unexpected csv %v", records)
+	}
+}
+
+func TestNDJSON(t *testing.T) {
+	seed(t)
+	out := bytes.Buffer{}
+	if err := Write(&out, "ndjson", db.MessageFilter{}, time.UTC); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 3 {
+		t.Fatalf("expected 3 lines, got %d", len(lines))
+	}
+	if err := Write(&out, "xml", db.MessageFilter{}, time.UTC); err == nil {
+		t.Fatal("expected an error for an unknown format")
+	}
+}
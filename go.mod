@@ -1,5 +1,14 @@
 module team-cymru-telnet
 
-go 1.15
+go 1.18
 
-require github.com/jinzhu/gorm v1.9.16
+require (
+	github.com/jinzhu/gorm v1.9.16
+	golang.org/x/crypto v0.17.0
+)
+
+require (
+	github.com/jinzhu/inflection v1.0.0 // indirect
+	github.com/lib/pq v1.1.1 // indirect
+	golang.org/x/sys v0.15.0 // indirect
+)
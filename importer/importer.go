@@ -0,0 +1,132 @@
+package importer
+
+/*
+	OVERVIEW: Imports existing chat logs into the message store, used by the import subcommand.
+	A Parser turns one line of a log into a chat.Chat with its original timestamp, see parsers.go for the server log, IRC and NDJSON formats.
+	Lines which hold no message (server start up, joins, topic changes) are skipped, lines which cannot be parsed are reported with their line number
+	and the rest of the file is still imported.
+	Re-importing a file does not duplicate messages. A message is a duplicate when the store already has one with the same user, type, channel,
+	recipient and text sent in the same second. Logs only keep seconds, or minutes, so the comparison ignores anything finer.
+*/
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"team-cymru-telnet/db"
+	"team-cymru-telnet/models/chat"
+	"time"
+)
+
+//number of messages saved per SaveBatch call
+const importBatchSize = 500
+
+type Parser interface {
+	//Parse returns nil and no error for lines that hold no message
+	Parse(line string) (*chat.Chat, error)
+}
+
+type ParseError struct {
+	Line int
+	Text string
+	Err  error
+}
+
+func (p ParseError) Error() string {
+	return fmt.Sprintf("line %d: %v: %q", p.Line, p.Err, p.Text)
+}
+
+type Result struct {
+	Lines      int
+	Parsed     int
+	Imported   int
+	Duplicates int
+	Errors     []ParseError
+}
+
+//Import - parses every line of r and saves the messages the store does not already have. the returned error is a read or store failure,
+//parse errors are collected in the Result
+func Import(r io.Reader, parser Parser, store db.MessageStore) (Result, error) {
+	result := Result{Errors: []ParseError{}}
+	messages := []*chat.Chat{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		result.Lines++
+		message, err := parser.Parse(scanner.Text())
+		if err != nil {
+			result.Errors = append(result.Errors, ParseError{Line: result.Lines, Text: scanner.Text(), Err: err})
+			continue
+		}
+		if message != nil {
+			messages = append(messages, message)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return result, fmt.Errorf("line %d: %v", result.Lines+1, err)
+	}
+	result.Parsed = len(messages)
+	if len(messages) == 0 {
+		return result, nil
+	}
+
+	existing, err := existingKeys(messages, store)
+	if err != nil {
+		return result, err
+	}
+	batch := []*chat.Chat{}
+	for _, message := range messages {
+		k := key(*message)
+		if existing[k] > 0 {
+			existing[k]--
+			result.Duplicates++
+			continue
+		}
+		batch = append(batch, message)
+		if len(batch) == importBatchSize {
+			if err := store.SaveBatch(batch); err != nil {
+				return result, err
+			}
+			result.Imported += len(batch)
+			batch = []*chat.Chat{}
+		}
+	}
+	if len(batch) > 0 {
+		if err := store.SaveBatch(batch); err != nil {
+			return result, err
+		}
+		result.Imported += len(batch)
+	}
+	return result, nil
+}
+
+//existingKeys counts the messages already stored in the time range of the import, by key
+func existingKeys(messages []*chat.Chat, store db.MessageStore) (map[string]int, error) {
+	first, last := messages[0].CreatedAt, messages[0].CreatedAt
+	for _, message := range messages {
+		if message.CreatedAt.Before(first) {
+			first = message.CreatedAt
+		}
+		if message.CreatedAt.After(last) {
+			last = message.CreatedAt
+		}
+	}
+
+	keys := map[string]int{}
+	filter := db.MessageFilter{After: first.Truncate(time.Second).Add(-time.Nanosecond), Before: last.Truncate(time.Second).Add(time.Second)}
+	err := store.Stream(filter, func(message chat.Chat) error {
+		keys[key(message)]++
+		return nil
+	})
+	return keys, err
+}
+
+func key(message chat.Chat) string {
+	channel := ""
+	if message.Channel.Valid {
+		channel = strconv.FormatInt(message.Channel.Int64, 10)
+	}
+	return fmt.Sprintf("%d\x00%s\x00%s\x00%s\x00%s\x00%s", message.CreatedAt.Truncate(time.Second).Unix(), message.User, message.MessageType, channel, message.PMRecipient.String, message.Message)
+}
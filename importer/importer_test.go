@@ -0,0 +1,127 @@
+package importer
+
+import (
+	"strings"
+	"team-cymru-telnet/db"
+	"testing"
+	"time"
+)
+
+const serverLog = `ChatServer_1604368036 2020/11/02 Info: chat server has started
+ChatServer_1604368036 2020/11/02 BROADCAST MESSAGE - andrew Nov  2 20:47:41#: hello all
+
+ChatServer_1604368036 2020/11/02 CHANNEL: 3 - MESSAGE - Channel: 3 Nov  2 20:48:00#: deploying now
+ChatServer_1604368036 2020/11/02 PRIVATE - RECIPIENT: stuart - MESSAGE - Private Message: andrew Nov  2 20:49:00#: hey
+ChatServer_1604368036 2020/11/02 INTEGRATION MESSAGE - [bot] Channel: 3 ci Nov  2 20:50:00#: build 42 failed
+ChatServer_1604368036 2020/11/02 SOMETHING ELSE
+ChatServer_1604368036 2021/01/01 BROADCAST MESSAGE - andrew Dec 31 23:59:59#: happy new year
+`
+
+func TestServerLog(t *testing.T) {
+	store := db.NewMemoryStore()
+	parser, _ := NewParser("server", time.UTC, 0)
+	result, err := Import(strings.NewReader(serverLog), parser, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Imported != 5 || len(result.Errors) != 1 || result.Errors[0].Line != 7 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+
+	messages, _ := store.Query(db.MessageFilter{})
+	if messages[1].MessageType != "channel" || messages[1].Channel.Int64 != 3 || messages[1].User != "unknown" {
+		t.Errorf("unexpected channel message %+v", messages[1])
+	}
+	if messages[2].PMRecipient.String != "stuart" || messages[2].User != "andrew" {
+		t.Errorf("unexpected private message %+v", messages[2])
+	}
+	if messages[3].User != "ci" || messages[3].MessageType != "integration" {
+		t.Errorf("unexpected integration message %+v", messages[3])
+	}
+	if !messages[4].CreatedAt.Equal(time.Date(2020, 12, 31, 23, 59, 59, 0, time.UTC)) {
+		t.Errorf("a message logged after new year was dated %v", messages[4].CreatedAt)
+	}
+
+	//importing the same file again adds nothing
+	parser, _ = NewParser("server", time.UTC, 0)
+	result, err = Import(strings.NewReader(serverLog), parser, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Imported != 0 || result.Duplicates != 5 {
+		t.Fatalf("re-import was not deduplicated %+v", result)
+	}
+}
+
+func TestServerJSONLog(t *testing.T) {
+	jsonLog := `{"time":"2020-11-02T20:47:26Z","level":"info","component":"server","msg":"chat server has started"}
+{"time":"2020-11-02T20:47:41Z","level":"info","component":"chat","msg":"chat message","type":"broadcast","user":"andrew","body":"hello all"}
+{"time":"2020-11-02T20:48:00Z","level":"info","component":"chat","msg":"chat message","type":"channel","user":"andrew","channel":3,"body":"deploying now"}
+{"time":"2020-11-02T20:49:00Z","level":"info","component":"chat","msg":"chat message","type":"pm","user":"andrew","recipient":"stuart"}
+Warning: [server] User, andrew, already exists in chat
+`
+	store := db.NewMemoryStore()
+	parser, _ := NewParser("server", time.UTC, 0)
+	result, err := Import(strings.NewReader(jsonLog), parser, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the pm was logged without its body, the last line is not a server log line
+	if result.Imported != 2 || len(result.Errors) != 1 || result.Errors[0].Line != 5 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	messages, _ := store.Query(db.MessageFilter{})
+	if messages[1].User != "andrew" || messages[1].Channel.Int64 != 3 || !messages[1].CreatedAt.Equal(time.Date(2020, 11, 2, 20, 48, 0, 0, time.UTC)) {
+		t.Errorf("unexpected channel message %+v", messages[1])
+	}
+}
+
+func TestIRCLogs(t *testing.T) {
+	irssi := `--- Log opened Mon Nov 02 20:47:26 2020
+20:47 -!- andrew [~andrew@host] has joined #ops
+20:47 <@andrew> is the build green?
+20:48  * stuart looks
+--- Day changed Tue Nov 03 2020
+00:01 < stuart> it is now
+`
+	weechat := "2020-11-03 00:02:00\t-->\tkallye (~k@host) has joined #ops\n2020-11-03 00:02:10\t+kallye\tgreat\n"
+
+	store := db.NewMemoryStore()
+	parser, _ := NewParser("irc", time.UTC, 5)
+	result, err := Import(strings.NewReader(irssi+weechat), parser, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Imported != 3 || len(result.Errors) != 0 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	messages, _ := store.Query(db.MessageFilter{Channel: 5})
+	if len(messages) != 3 || messages[0].User != "andrew" || messages[1].User != "stuart" || messages[2].User != "kallye" {
+		t.Fatalf("unexpected messages %+v", messages)
+	}
+	if !messages[1].CreatedAt.Equal(time.Date(2020, 11, 3, 0, 1, 0, 0, time.UTC)) {
+		t.Errorf("day change was not applied, got %v", messages[1].CreatedAt)
+	}
+
+	parser, _ = NewParser("irc", time.UTC, 0)
+	result, _ = Import(strings.NewReader("20:47 <andrew> no date\n"), parser, store)
+	if len(result.Errors) != 1 || result.Errors[0].Line != 1 {
+		t.Fatalf("expected an error for a message without a date %+v", result)
+	}
+}
+
+func TestNDJSON(t *testing.T) {
+	store := db.NewMemoryStore()
+	lines := `{"ID":7,"User":"stuart","MessageType":"broadcast","Message":"hello","CreatedAt":"2020-11-02T20:47:41Z"}
+{"User":"stuart"}
+not json
+`
+	parser, _ := NewParser("ndjson", time.UTC, 0)
+	result, err := Import(strings.NewReader(lines), parser, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Imported != 1 || len(result.Errors) != 2 || result.Errors[1].Line != 3 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+}
@@ -0,0 +1,253 @@
+package importer
+
+/*
+	OVERVIEW: Parsers for the log formats accepted by the import subcommand.
+	server: the ChatServer_*.log files written by FileLogger. Only BROADCAST MESSAGE, CHANNEL, PRIVATE and INTEGRATION lines are imported.
+	Logs written with logFormat json are read too, from their "chat message" entries. Entries without a body, logged with
+	logExcludeMessageBodies, are skipped.
+	The lines carry the month, day and time of the message, the year comes from the date the logger prefixes every line with.
+	Channel lines do not name the sender so those messages are imported from the user "unknown".
+	irc: irssi logs ("--- Log opened" / "--- Day changed" headers and "12:34 <nick> text" lines) and weechat logs
+	("2020-11-02 12:34:56<TAB>nick<TAB>text"). Joins, parts, actions and other events are skipped. Messages are imported as broadcasts,
+	or as messages to a channel when one is given.
+	ndjson: one chat.Chat as JSON per line, the format written by the export subcommand and the retention archive. Ids are not kept.
+	Timestamps without a zone are read in the location given to NewParser.
+*/
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"team-cymru-telnet/models/chat"
+	"time"
+)
+
+var Formats = []string{"server", "irc", "ndjson"}
+
+//NewParser - channel is only used by the irc format
+func NewParser(format string, loc *time.Location, channel int) (Parser, error) {
+	switch format {
+	case "server":
+		return &serverParser{loc: loc}, nil
+	case "irc":
+		return &ircParser{loc: loc, channel: channel}, nil
+	case "ndjson":
+		return &ndjsonParser{}, nil
+	}
+	return nil, fmt.Errorf("unknown import format %q. use server, irc or ndjson", format)
+}
+
+var (
+	serverLine        = regexp.MustCompile(`^\S+ (\d{4}/\d{2}/\d{2}) (.*)$`)
+	serverBroadcast   = regexp.MustCompile(`^BROADCAST MESSAGE - (\S+) ([A-Z][a-z]{2} [ \d]\d \d{2}:\d{2}:\d{2})#: (.*)$`)
+	serverChannel     = regexp.MustCompile(`^CHANNEL: (-?\d+) - MESSAGE - Channel: -?\d+ ([A-Z][a-z]{2} [ \d]\d \d{2}:\d{2}:\d{2})#: (.*)$`)
+	serverPrivate     = regexp.MustCompile(`^PRIVATE - RECIPIENT: (\S+) - MESSAGE - Private Message: (\S+) ([A-Z][a-z]{2} [ \d]\d \d{2}:\d{2}:\d{2})#: (.*)$`)
+	serverIntegration = regexp.MustCompile(`^INTEGRATION MESSAGE - \[bot\] (?:Channel: (-?\d+) )?(\S+) ([A-Z][a-z]{2} [ \d]\d \d{2}:\d{2}:\d{2})#: (.*)$`)
+	serverEvent       = regexp.MustCompile(`^(Debug|Info|Warning|Error|Fatal): `)
+)
+
+type serverParser struct {
+	loc *time.Location
+}
+
+func (s *serverParser) Parse(line string) (*chat.Chat, error) {
+	if strings.TrimSpace(line) == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(line, "{") {
+		return s.parseJSON(line)
+	}
+	parts := serverLine.FindStringSubmatch(line)
+	if parts == nil {
+		return nil, errors.New("not a server log line")
+	}
+	logDate, err := time.ParseInLocation("2006/01/02", parts[1], s.loc)
+	if err != nil {
+		return nil, err
+	}
+	body := parts[2]
+
+	if match := serverBroadcast.FindStringSubmatch(body); match != nil {
+		return s.message(logDate, match[2], &chat.Chat{User: match[1], MessageType: "broadcast", Message: match[3]})
+	}
+	if match := serverChannel.FindStringSubmatch(body); match != nil {
+		channel, _ := strconv.ParseInt(match[1], 10, 64)
+		return s.message(logDate, match[2], &chat.Chat{
+			User:        "unknown",
+			MessageType: "channel",
+			Channel:     sql.NullInt64{Valid: true, Int64: channel},
+			Message:     match[3],
+		})
+	}
+	if match := serverPrivate.FindStringSubmatch(body); match != nil {
+		return s.message(logDate, match[3], &chat.Chat{
+			User:        match[2],
+			MessageType: "pm",
+			PMRecipient: sql.NullString{Valid: true, String: match[1]},
+			Message:     match[4],
+		})
+	}
+	if match := serverIntegration.FindStringSubmatch(body); match != nil {
+		message := &chat.Chat{User: match[2], MessageType: "integration", Message: match[4]}
+		if match[1] != "" {
+			channel, _ := strconv.ParseInt(match[1], 10, 64)
+			message.Channel = sql.NullInt64{Valid: true, Int64: channel}
+		}
+		return s.message(logDate, match[3], message)
+	}
+	if serverEvent.MatchString(body) {
+		return nil, nil
+	}
+	return nil, errors.New("unknown server log entry")
+}
+
+//serverJSONEntry is the part of a JSON log entry, see config.Logger.Chat, needed for a chat message
+type serverJSONEntry struct {
+	Time      time.Time `json:"time"`
+	Component string    `json:"component"`
+	Msg       string    `json:"msg"`
+	Type      string    `json:"type"`
+	User      string    `json:"user"`
+	Channel   *int64    `json:"channel"`
+	Recipient string    `json:"recipient"`
+	Body      *string   `json:"body"`
+}
+
+func (s *serverParser) parseJSON(line string) (*chat.Chat, error) {
+	entry := serverJSONEntry{}
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		return nil, err
+	}
+	if entry.Component != "chat" || entry.Msg != "chat message" || entry.Body == nil {
+		return nil, nil
+	}
+	message := &chat.Chat{User: entry.User, MessageType: entry.Type, Message: *entry.Body, CreatedAt: entry.Time, UpdatedAt: entry.Time}
+	if entry.Channel != nil && *entry.Channel != 0 {
+		message.Channel = sql.NullInt64{Valid: true, Int64: *entry.Channel}
+	}
+	if entry.Recipient != "" {
+		message.PMRecipient = sql.NullString{Valid: true, String: entry.Recipient}
+	}
+	return message, nil
+}
+
+//message sets the time from the time.Stamp in the line. a message logged just after new year carries the previous year's December date
+func (s *serverParser) message(logDate time.Time, stamp string, message *chat.Chat) (*chat.Chat, error) {
+	sent, err := time.ParseInLocation(time.Stamp, stamp, s.loc)
+	if err != nil {
+		return nil, err
+	}
+	sent = sent.AddDate(logDate.Year(), 0, 0)
+	if sent.After(logDate.AddDate(0, 0, 1)) {
+		sent = sent.AddDate(-1, 0, 0)
+	}
+	message.CreatedAt = sent
+	message.UpdatedAt = sent
+	return message, nil
+}
+
+var (
+	irssiOpened   = regexp.MustCompile(`^--- Log opened (.+)$`)
+	irssiDay      = regexp.MustCompile(`^--- Day changed (.+)$`)
+	irssiHeader   = regexp.MustCompile(`^--- `)
+	irssiMessage  = regexp.MustCompile(`^(\d{2}:\d{2}(?::\d{2})?) <[ @+%&~]?([^>]+)> (.*)$`)
+	irssiEvent    = regexp.MustCompile(`^\d{2}:\d{2}(?::\d{2})? `)
+	weechatLine   = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2})\t([^\t]*)\t(.*)$`)
+	weechatEvents = map[string]bool{"": true, "-->": true, "<--": true, "--": true, "*": true, "=!=": true}
+)
+
+type ircParser struct {
+	loc     *time.Location
+	channel int
+	//day is the date of the irssi lines that follow, set by the Log opened and Day changed headers
+	day time.Time
+}
+
+func (i *ircParser) Parse(line string) (*chat.Chat, error) {
+	if strings.TrimSpace(line) == "" {
+		return nil, nil
+	}
+
+	if match := weechatLine.FindStringSubmatch(line); match != nil {
+		nick := strings.TrimSpace(match[2])
+		if weechatEvents[nick] {
+			return nil, nil
+		}
+		sent, err := time.ParseInLocation("2006-01-02 15:04:05", match[1], i.loc)
+		if err != nil {
+			return nil, err
+		}
+		return i.message(strings.TrimLeft(nick, "@+%&~"), match[3], sent), nil
+	}
+
+	if match := irssiOpened.FindStringSubmatch(line); match != nil {
+		opened, err := time.ParseInLocation("Mon Jan 02 15:04:05 2006", match[1], i.loc)
+		if err != nil {
+			return nil, err
+		}
+		i.day = opened
+		return nil, nil
+	}
+	if match := irssiDay.FindStringSubmatch(line); match != nil {
+		day, err := time.ParseInLocation("Mon Jan 02 2006", match[1], i.loc)
+		if err != nil {
+			return nil, err
+		}
+		i.day = day
+		return nil, nil
+	}
+	if irssiHeader.MatchString(line) {
+		return nil, nil
+	}
+
+	if match := irssiMessage.FindStringSubmatch(line); match != nil {
+		if i.day.IsZero() {
+			return nil, errors.New("message before a \"--- Log opened\" or \"--- Day changed\" line, the date is unknown")
+		}
+		layout := "15:04"
+		if len(match[1]) == len("15:04:05") {
+			layout = "15:04:05"
+		}
+		clock, err := time.Parse(layout, match[1])
+		if err != nil {
+			return nil, err
+		}
+		year, month, day := i.day.Date()
+		sent := time.Date(year, month, day, clock.Hour(), clock.Minute(), clock.Second(), 0, i.loc)
+		return i.message(strings.TrimSpace(match[2]), match[3], sent), nil
+	}
+	if irssiEvent.MatchString(line) {
+		return nil, nil
+	}
+	return nil, errors.New("not an irssi or weechat log line")
+}
+
+func (i *ircParser) message(nick string, text string, sent time.Time) *chat.Chat {
+	message := &chat.Chat{User: nick, MessageType: "broadcast", Message: text, CreatedAt: sent, UpdatedAt: sent}
+	if i.channel != 0 {
+		message.MessageType = "channel"
+		message.Channel = sql.NullInt64{Valid: true, Int64: int64(i.channel)}
+	}
+	return message
+}
+
+type ndjsonParser struct{}
+
+func (n *ndjsonParser) Parse(line string) (*chat.Chat, error) {
+	if strings.TrimSpace(line) == "" {
+		return nil, nil
+	}
+	message := &chat.Chat{}
+	if err := json.Unmarshal([]byte(line), message); err != nil {
+		return nil, err
+	}
+	if message.MessageType == "" || message.CreatedAt.IsZero() {
+		return nil, errors.New("MessageType and CreatedAt are required")
+	}
+	message.ID = 0
+	return message, nil
+}
@@ -1,20 +1,88 @@
 package main
 
 /*
-	OVERVIEW: Main packages initlizes config, db, and starts the HTTP and Telnet servers.
+	OVERVIEW: Main packages initlizes config, db, the webhook dispatcher, search, the retention janitor, and starts the HTTP and Telnet servers.
+	Arguments after the flags run a subcommand from the cli package instead, e.g. "migrate status".
+	SIGINT and SIGTERM cancel the root context, which starts a graceful shutdown: both servers stop accepting, the sessions get a countdown and
+	are closed, running HTTP requests finish and queued messages are saved. The exit code is 0 when all of that finished in time, 1 otherwise.
+	A second signal exits immediately.
 */
 
 import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
 	"team-cymru-telnet/api"
+	"team-cymru-telnet/cli"
 	"team-cymru-telnet/config"
 	"team-cymru-telnet/db"
+	"team-cymru-telnet/retention"
+	"team-cymru-telnet/search"
 	"team-cymru-telnet/server"
+	"team-cymru-telnet/webhooks"
+	"time"
 )
 
 func main() {
+	config.GetFlags()
+	if flag.NArg() > 0 {
+		os.Exit(cli.Run(flag.Args()))
+	}
 	config.Init()
 	db.Connect()
+	webhooks.Start()
+	search.Start()
+	db.StartPersistence(search.Index)
+	retention.Start(search.Remove)
 
-	api.Start()
-	server.Start()
+	ctx, cancel := context.WithCancel(context.Background())
+	go cancelOnSignal(cancel)
+
+	api.Start(ctx)
+	server.Start(ctx)
+	os.Exit(shutdown())
+}
+
+func cancelOnSignal(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	received := <-signals
+	config.Log("main").Info("received a signal, shutting down", config.F("signal", received))
+	cancel()
+
+	received = <-signals
+	config.Log("main").Error("received a signal during shutdown, exiting immediately", config.F("signal", received))
+	os.Exit(1)
+}
+
+//shutdown returns the exit code
+func shutdown() int {
+	grace := time.Duration(config.Cfg.ShutdownGraceSeconds) * time.Second
+	timeout := time.Duration(config.Cfg.ShutdownTimeoutSeconds) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), grace+timeout)
+	defer cancel()
+	code := 0
+
+	apiDone := make(chan error, 1)
+	go func() {
+		apiDone <- api.Shutdown(ctx)
+	}()
+	if err := server.Shutdown(ctx); err != nil {
+		config.Log("main").Error("chat sessions did not close in time", config.Err(err))
+		code = 1
+	}
+	if err := <-apiDone; err != nil {
+		config.Log("main").Error("api requests did not finish in time", config.Err(err))
+		code = 1
+	}
+
+	stats := db.StopPersistence()
+	if stats.Failed > 0 || stats.SpillPending {
+		config.Log("main").Error("not every message reached the database", config.F("failed", stats.Failed), config.F("spill_pending", stats.SpillPending))
+		code = 1
+	}
+	config.Log("main").Info("shutdown complete", config.F("exit_code", code))
+	return code
 }
@@ -0,0 +1,25 @@
+package integration
+
+/*
+	OVERVIEW: model for the integration table. An integration is an incoming webhook used by CI or alerting to post notices into the chat.
+	Its URL is /hooks/<secret>. Only the SHA-256 hash of the secret is stored so the URL is shown once when the integration is created.
+	Name is the display name used when a payload does not set one and Channel is the default channel.
+*/
+
+import (
+	"database/sql"
+	"time"
+)
+
+type Integration struct {
+	ID        int           `gorm:"column:id;primaryKey"`
+	Name      string        `gorm:"column:name"`
+	Channel   sql.NullInt64 `gorm:"column:channel"`
+	Hash      string        `gorm:"column:hash;unique_index"`
+	CreatedAt time.Time     `gorm:"column:created_at"`
+	UpdatedAt time.Time     `gorm:"column:updated_at"`
+}
+
+func (i *Integration) TableName() string {
+	return "integration"
+}
@@ -0,0 +1,24 @@
+package sshkey
+
+/*
+	OVERVIEW: model for the ssh_key table, the public keys users log in to the SSH listener with.
+	PublicKey is the key in authorized_keys format without options or comment. Fingerprint is its SHA256 fingerprint, which is how a key is
+	looked up when a client offers it.
+*/
+
+import (
+	"time"
+)
+
+type SSHKey struct {
+	ID          int       `gorm:"column:id;primaryKey"`
+	User        string    `gorm:"column:user_name"`
+	PublicKey   string    `gorm:"column:public_key"`
+	Fingerprint string    `gorm:"column:fingerprint;unique_index"`
+	CreatedAt   time.Time `gorm:"column:created_at"`
+	UpdatedAt   time.Time `gorm:"column:updated_at"`
+}
+
+func (s *SSHKey) TableName() string {
+	return "ssh_key"
+}
@@ -0,0 +1,24 @@
+package token
+
+/*
+	OVERVIEW: model for the api_token table. Only the SHA-256 hash of a token is stored, the token itself is shown once when it is created.
+	Scopes is a comma separated list of the scopes granted to the token, see the auth package for the accepted values.
+*/
+
+import (
+	"time"
+)
+
+type Token struct {
+	ID        int       `gorm:"column:id;primaryKey"`
+	Identity  string    `gorm:"column:identity"`
+	Scopes    string    `gorm:"column:scopes"`
+	Hash      string    `gorm:"column:hash;unique_index"`
+	Revoked   bool      `gorm:"column:revoked"`
+	CreatedAt time.Time `gorm:"column:created_at"`
+	UpdatedAt time.Time `gorm:"column:updated_at"`
+}
+
+func (t *Token) TableName() string {
+	return "api_token"
+}
@@ -0,0 +1,53 @@
+package webhook
+
+/*
+	OVERVIEW: models for the webhook_subscription and webhook_delivery tables.
+	A subscription receives a JSON POST for every event listed in Events (comma separated). Channel limits message events to a single channel and
+	Keywords (comma separated) are the words that trigger the keyword event.
+	A delivery is created for every event sent to a subscription and records its status. Deliveries which run out of retries keep the status "dead"
+	and act as the dead letter record.
+*/
+
+import (
+	"database/sql"
+	"time"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusRetrying  = "retrying"
+	StatusDead      = "dead"
+)
+
+type Subscription struct {
+	ID        int           `gorm:"column:id;primaryKey"`
+	URL       string        `gorm:"column:url"`
+	Events    string        `gorm:"column:events"`
+	Channel   sql.NullInt64 `gorm:"column:channel"`
+	Keywords  string        `gorm:"column:keywords"`
+	Secret    string        `gorm:"column:secret"`
+	CreatedAt time.Time     `gorm:"column:created_at"`
+	UpdatedAt time.Time     `gorm:"column:updated_at"`
+}
+
+func (s *Subscription) TableName() string {
+	return "webhook_subscription"
+}
+
+type Delivery struct {
+	ID             int       `gorm:"column:id;primaryKey"`
+	SubscriptionID int       `gorm:"column:subscription_id"`
+	Event          string    `gorm:"column:event"`
+	Payload        string    `gorm:"column:payload"`
+	Status         string    `gorm:"column:status"`
+	Attempts       int       `gorm:"column:attempts"`
+	ResponseCode   int       `gorm:"column:response_code"`
+	LastError      string    `gorm:"column:last_error"`
+	CreatedAt      time.Time `gorm:"column:created_at"`
+	UpdatedAt      time.Time `gorm:"column:updated_at"`
+}
+
+func (d *Delivery) TableName() string {
+	return "webhook_delivery"
+}
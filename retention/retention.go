@@ -0,0 +1,266 @@
+package retention
+
+/*
+	OVERVIEW: Retention rules and the janitor that purges expired chat messages.
+	Rules come from the retention list in config.json, e.g. broadcasts 90 days, private messages 30 days and channel 7 forever:
+	[{"messageType": "broadcast", "days": 90}, {"messageType": "pm", "days": 30}, {"channel": 7, "days": 0}]
+	The most specific matching rule decides how long a message is kept. A rule with a channel beats one with only a message type, and a rule with
+	both beats either. Messages no rule matches are kept forever, as are messages whose rule has 0 days.
+	The janitor runs every retentionIntervalMinutes (default 60). It reads retentionBatchSize (default 1000) messages at a time, ordered by id,
+	and deletes the expired ones among them, so a run never holds more than one batch of ids.
+	When archiveDir is set every batch is first appended to a gzip compressed NDJSON file, one per run, and synced before it is deleted.
+	The settings are read from the config on every pass, a reload applies to the next one. A new interval applies after the current wait.
+	Plan does the same selection without deleting anything and is the dry run reported by GET /api/v1/retention.
+*/
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"team-cymru-telnet/config"
+	"team-cymru-telnet/db"
+	"team-cymru-telnet/models/chat"
+	"time"
+)
+
+type RuleReport struct {
+	MessageType string `json:"message_type,omitempty"`
+	Channel     int    `json:"channel,omitempty"`
+	Days        int    `json:"days"`
+	//Cutoff is nil for rules that keep messages forever
+	Cutoff  *time.Time `json:"cutoff,omitempty"`
+	Expired int        `json:"expired"`
+}
+
+type Report struct {
+	GeneratedAt time.Time    `json:"generated_at"`
+	Rules       []RuleReport `json:"rules"`
+	Expired     int          `json:"expired"`
+	Deleted     int64        `json:"deleted"`
+	Archive     string       `json:"archive,omitempty"`
+}
+
+type Janitor struct {
+	store      db.MessageStore
+	rules      []config.RetentionRule
+	batchSize  int
+	archiveDir string
+	//onDeleted is called with the ids of every deleted batch
+	onDeleted func(ids []int)
+}
+
+func NewJanitor(store db.MessageStore, rules []config.RetentionRule, batchSize int, archiveDir string, onDeleted func(ids []int)) *Janitor {
+	return &Janitor{
+		store:      store,
+		rules:      rules,
+		batchSize:  batchSize,
+		archiveDir: archiveDir,
+		onDeleted:  onDeleted,
+	}
+}
+
+// ruleFor returns the index of the most specific rule matching the message, -1 when no rule matches. the first rule wins a tie
+func ruleFor(rules []config.RetentionRule, message chat.Chat) int {
+	best, bestScore := -1, -1
+	for i, rule := range rules {
+		score := 0
+		if rule.MessageType != "" {
+			if rule.MessageType != message.MessageType {
+				continue
+			}
+			score++
+		}
+		if rule.Channel != 0 {
+			if !message.Channel.Valid || message.Channel.Int64 != int64(rule.Channel) {
+				continue
+			}
+			score += 2
+		}
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// Plan - reports the messages that are expired at now
+func (j *Janitor) Plan(now time.Time) (Report, error) {
+	return j.scan(now, nil)
+}
+
+// scan pages through the messages old enough to be expired, batchSize messages per page, and calls fn with the ids of the expired
+// messages of each page. no more than a page of ids is held at a time
+func (j *Janitor) scan(now time.Time, fn func(ids []int) error) (Report, error) {
+	report := Report{GeneratedAt: now, Rules: []RuleReport{}}
+	cutoffs := make([]time.Time, len(j.rules))
+	//only messages older than the latest cutoff, the shortest retention period, can be expired
+	var latest time.Time
+	for i, rule := range j.rules {
+		ruleReport := RuleReport{MessageType: rule.MessageType, Channel: rule.Channel, Days: rule.Days}
+		if rule.Days > 0 {
+			cutoffs[i] = now.AddDate(0, 0, -rule.Days)
+			ruleReport.Cutoff = &cutoffs[i]
+			if cutoffs[i].After(latest) {
+				latest = cutoffs[i]
+			}
+		}
+		report.Rules = append(report.Rules, ruleReport)
+	}
+	if latest.IsZero() {
+		return report, nil
+	}
+
+	//pages follow the ids rather than an offset so deleting a page does not skip messages
+	lastID := 0
+	for {
+		ids := []int{}
+		scanned := 0
+		err := j.store.Stream(db.MessageFilter{Before: latest, AfterID: lastID, Limit: j.batchSize}, func(message chat.Chat) error {
+			scanned++
+			lastID = message.ID
+			i := ruleFor(j.rules, message)
+			if i == -1 || cutoffs[i].IsZero() || !message.CreatedAt.Before(cutoffs[i]) {
+				return nil
+			}
+			report.Rules[i].Expired++
+			report.Expired++
+			ids = append(ids, message.ID)
+			return nil
+		})
+		if err != nil {
+			return report, err
+		}
+		if fn != nil && len(ids) > 0 {
+			if err := fn(ids); err != nil {
+				return report, err
+			}
+		}
+		if scanned < j.batchSize {
+			return report, nil
+		}
+	}
+}
+
+// Run - deletes the messages that are expired at now, archiving them first when an archive directory is set
+func (j *Janitor) Run(now time.Time) (Report, error) {
+	var archive *archiveWriter
+	defer func() {
+		if archive != nil {
+			archive.Close()
+		}
+	}()
+	var deleted int64
+
+	report, err := j.scan(now, func(batch []int) error {
+		if j.archiveDir != "" {
+			//the archive is only created once there is something to put in it
+			if archive == nil {
+				var err error
+				if archive, err = newArchiveWriter(j.archiveDir, now); err != nil {
+					return err
+				}
+			}
+			messages, err := j.store.Query(db.MessageFilter{IDs: batch})
+			if err != nil {
+				return err
+			}
+			if err := archive.Write(messages); err != nil {
+				return fmt.Errorf("failed to archive expired messages to %s, nothing was deleted from this batch: %v", archive.path, err)
+			}
+		}
+		count, err := j.store.Delete(db.MessageFilter{IDs: batch})
+		deleted += count
+		if err != nil {
+			return err
+		}
+		if j.onDeleted != nil {
+			j.onDeleted(batch)
+		}
+		return nil
+	})
+	report.Deleted = deleted
+	if archive != nil {
+		report.Archive = archive.path
+	}
+	return report, err
+}
+
+type archiveWriter struct {
+	path string
+	file *os.File
+	gz   *gzip.Writer
+}
+
+func newArchiveWriter(dir string, now time.Time) (*archiveWriter, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("chat-archive-%s.ndjson.gz", now.Format("20060102T150405")))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &archiveWriter{path: path, file: file, gz: gzip.NewWriter(file)}, nil
+}
+
+// Write - the messages are on disk when Write returns
+func (a *archiveWriter) Write(messages []chat.Chat) error {
+	encoder := json.NewEncoder(a.gz)
+	for _, message := range messages {
+		if err := encoder.Encode(message); err != nil {
+			return err
+		}
+	}
+	if err := a.gz.Flush(); err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+func (a *archiveWriter) Close() error {
+	if err := a.gz.Close(); err != nil {
+		a.file.Close()
+		return err
+	}
+	a.file.Sync()
+	return a.file.Close()
+}
+
+// Start - starts the janitor. The rules, batch size, archive directory and interval are read from the config on every pass, so a reload
+// applies them to the next pass. onDeleted is called with the ids of every deleted batch
+func Start(onDeleted func(ids []int)) {
+	go func() {
+		for {
+			if len(config.Cfg.Retention) > 0 {
+				report, err := newJanitor(onDeleted).Run(time.Now())
+				if err != nil {
+					config.Log("retention").Error("retention stopped before deleting every expired message", config.F("deleted", report.Deleted), config.F("expired", report.Expired), config.Err(err))
+				} else if report.Deleted > 0 {
+					config.Log("retention").Info("retention deleted expired messages", config.F("deleted", report.Deleted))
+				}
+			}
+			interval := time.Duration(config.Cfg.RetentionIntervalMinutes) * time.Minute
+			if interval <= 0 {
+				interval = time.Hour
+			}
+			time.Sleep(interval)
+		}
+	}()
+	config.Log("retention").Info("retention janitor has started")
+}
+
+// newJanitor - a janitor with the current retention config
+func newJanitor(onDeleted func(ids []int)) *Janitor {
+	batchSize := config.Cfg.RetentionBatchSize
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+	return NewJanitor(db.Messages, config.Cfg.Retention, batchSize, config.Cfg.ArchiveDir, onDeleted)
+}
+
+// DryRun - what the janitor would delete now, without deleting anything
+func DryRun() (Report, error) {
+	return newJanitor(nil).Plan(time.Now())
+}
@@ -0,0 +1,154 @@
+package retention
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"team-cymru-telnet/config"
+	"team-cymru-telnet/db"
+	"team-cymru-telnet/models/chat"
+	"testing"
+	"time"
+)
+
+var rules = []config.RetentionRule{
+	{MessageType: "broadcast", Days: 90},
+	{MessageType: "pm", Days: 30},
+	{MessageType: "channel", Days: 60},
+	{Channel: 7, Days: 0},
+}
+
+func seed(t *testing.T, now time.Time) db.MessageStore {
+	store := db.NewMemoryStore()
+	messages := []*chat.Chat{
+		{User: "stuart", MessageType: "broadcast", Message: "old broadcast", CreatedAt: now.AddDate(0, 0, -100)},
+		{User: "stuart", MessageType: "broadcast", Message: "new broadcast", CreatedAt: now.AddDate(0, 0, -10)},
+		{User: "andrew", MessageType: "pm", PMRecipient: sql.NullString{Valid: true, String: "stuart"}, Message: "old pm", CreatedAt: now.AddDate(0, 0, -40)},
+		{User: "andrew", MessageType: "channel", Channel: sql.NullInt64{Valid: true, Int64: 3}, Message: "old channel", CreatedAt: now.AddDate(0, 0, -70)},
+		{User: "andrew", MessageType: "channel", Channel: sql.NullInt64{Valid: true, Int64: 7}, Message: "audit", CreatedAt: now.AddDate(0, 0, -400)},
+		{User: "andrew", MessageType: "integration", Message: "no rule", CreatedAt: now.AddDate(0, 0, -400)},
+	}
+	for _, message := range messages {
+		if err := store.Save(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func TestRuleFor(t *testing.T) {
+	audit := chat.Chat{MessageType: "channel", Channel: sql.NullInt64{Valid: true, Int64: 7}}
+	if i := ruleFor(rules, audit); i != 3 {
+		t.Fatalf("expected the channel rule to win, got rule %d", i)
+	}
+	if i := ruleFor(rules, chat.Chat{MessageType: "integration"}); i != -1 {
+		t.Fatalf("expected no rule, got rule %d", i)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	now := time.Now()
+	store := seed(t, now)
+	report, err := NewJanitor(store, rules, 10, "", nil).Plan(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Expired != 3 {
+		t.Fatalf("expected 3 expired messages, got %d", report.Expired)
+	}
+	for i, expected := range []int{1, 1, 1, 0} {
+		if report.Rules[i].Expired != expected {
+			t.Errorf("rule %d expired %d messages, expected %d", i, report.Rules[i].Expired, expected)
+		}
+	}
+	if report.Rules[3].Cutoff != nil {
+		t.Error("a rule that keeps messages forever has no cutoff")
+	}
+	//a dry run deletes nothing
+	if all, _ := store.Query(db.MessageFilter{}); len(all) != 6 {
+		t.Fatalf("expected 6 messages after the plan, got %d", len(all))
+	}
+}
+
+func TestRunArchivesAndDeletes(t *testing.T) {
+	now := time.Now()
+	store := seed(t, now)
+	dir := t.TempDir()
+	removed := []int{}
+	janitor := NewJanitor(store, rules, 2, dir, func(ids []int) {
+		removed = append(removed, ids...)
+	})
+
+	report, err := janitor.Run(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Deleted != 3 || len(removed) != 3 {
+		t.Fatalf("expected 3 deleted messages, got %d and %d removed", report.Deleted, len(removed))
+	}
+	left, _ := store.Query(db.MessageFilter{})
+	if len(left) != 3 {
+		t.Fatalf("expected 3 messages left, got %d", len(left))
+	}
+
+	file, err := os.Open(report.Archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archived := 0
+	scanner := bufio.NewScanner(gz)
+	for scanner.Scan() {
+		message := chat.Chat{}
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			t.Fatal(err)
+		}
+		archived++
+	}
+	if archived != 3 {
+		t.Fatalf("expected 3 archived messages, got %d", archived)
+	}
+}
+
+func TestRunInBatches(t *testing.T) {
+	now := time.Now()
+	store := seed(t, now)
+	batches := [][]int{}
+	janitor := NewJanitor(store, rules, 2, "", func(ids []int) {
+		batches = append(batches, ids)
+	})
+
+	report, err := janitor.Run(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//message 2 is newer than every cutoff so the pages are the messages 1 and 3, 4 and 5, and 6. 5 and 6 are kept forever
+	if report.Deleted != 3 || report.Archive != "" || len(batches) != 2 || len(batches[0]) != 2 || len(batches[1]) != 1 {
+		t.Fatalf("expected 3 messages deleted in 2 batches, got %d in %v", report.Deleted, batches)
+	}
+}
+
+func TestDryRunReadsTheConfig(t *testing.T) {
+	messages := db.Messages
+	db.Messages = seed(t, time.Now())
+	defer func() {
+		db.Messages = messages
+		config.Cfg.Retention = nil
+	}()
+
+	config.Cfg.Retention = rules
+	if report, err := DryRun(); err != nil || report.Expired != 3 {
+		t.Fatalf("expected 3 expired messages, got %d %v", report.Expired, err)
+	}
+	//a reload replaces the rules
+	config.Cfg.Retention = []config.RetentionRule{{Days: 1}}
+	if report, err := DryRun(); err != nil || report.Expired != 6 {
+		t.Fatalf("expected 6 expired messages after the rules changed, got %d %v", report.Expired, err)
+	}
+}
@@ -0,0 +1,112 @@
+package search
+
+/*
+	OVERVIEW: In process inverted index used when the database has no native full text search.
+	Every word maps to the ids of the messages containing it. A search starts from the shortest posting list of the query words and checks the
+	candidates newest first, so the cost depends on how rare the rarest word is rather than on the size of the history.
+*/
+
+import (
+	"sort"
+	"sync"
+	"team-cymru-telnet/config"
+	"team-cymru-telnet/db"
+	"team-cymru-telnet/models/chat"
+)
+
+type memoryIndex struct {
+	mutex    sync.RWMutex
+	messages map[int]chat.Chat
+	postings map[string][]int
+}
+
+func newMemoryIndex() *memoryIndex {
+	index := &memoryIndex{
+		messages: map[int]chat.Chat{},
+		postings: map[string][]int{},
+	}
+
+	err := db.Messages.Stream(db.MessageFilter{}, func(message chat.Chat) error {
+		index.Index(message)
+		return nil
+	})
+	if err != nil {
+		config.Log("search").Error("failed to load chat history into the search index", config.Err(err))
+	}
+	return index
+}
+
+func (m *memoryIndex) Index(message chat.Chat) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.messages[message.ID]; ok {
+		return
+	}
+	m.messages[message.ID] = message
+
+	seen := map[string]bool{}
+	for _, word := range tokenize(message.Message) {
+		if seen[word] {
+			continue
+		}
+		seen[word] = true
+		m.postings[word] = append(m.postings[word], message.ID)
+	}
+}
+
+func (m *memoryIndex) Remove(ids []int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, id := range ids {
+		message, ok := m.messages[id]
+		if !ok {
+			continue
+		}
+		delete(m.messages, id)
+		for _, word := range tokenize(message.Message) {
+			posting := m.postings[word]
+			for i := range posting {
+				if posting[i] == id {
+					posting = append(posting[:i], posting[i+1:]...)
+					break
+				}
+			}
+			if len(posting) == 0 {
+				delete(m.postings, word)
+			} else {
+				m.postings[word] = posting
+			}
+		}
+	}
+}
+
+func (m *memoryIndex) Search(query Query, limit int) ([]chat.Chat, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	words := append([]string{}, query.Terms...)
+	for _, phrase := range query.Phrases {
+		words = append(words, tokenize(phrase)...)
+	}
+
+	var candidates []int
+	for i, word := range words {
+		if i == 0 || len(m.postings[word]) < len(candidates) {
+			candidates = m.postings[word]
+		}
+	}
+	//ids are usually appended in order but messages loaded after a restart are not guaranteed to be
+	sorted := append([]int{}, candidates...)
+	sort.Sort(sort.Reverse(sort.IntSlice(sorted)))
+
+	results := []chat.Chat{}
+	for _, id := range sorted {
+		if len(results) == limit {
+			break
+		}
+		if message, ok := m.messages[id]; ok && matches(message, query) {
+			results = append(results, message)
+		}
+	}
+	return results, nil
+}
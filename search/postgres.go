@@ -0,0 +1,53 @@
+package search
+
+/*
+	OVERVIEW: Postgres backend. Searches the chat table directly with to_tsvector/tsquery so nothing has to be kept in memory.
+	The GIN expression index on the message column that these queries use is created by migration 6, see db/migrations.go.
+	Postgres stems words ("deploys" matches "deploy") so results can differ slightly from the in memory index.
+*/
+
+import (
+	"strings"
+	"team-cymru-telnet/db"
+	"team-cymru-telnet/models/chat"
+)
+
+type postgresBackend struct{}
+
+func newPostgresBackend() *postgresBackend {
+	return &postgresBackend{}
+}
+
+func (p *postgresBackend) Index(message chat.Chat) {}
+
+func (p *postgresBackend) Remove(ids []int) {}
+
+func (p *postgresBackend) Search(query Query, limit int) ([]chat.Chat, error) {
+	tx := db.DB.Conn.Model(&chat.Chat{})
+	if len(query.Terms) > 0 {
+		tx = tx.Where("to_tsvector('english', message) @@ plainto_tsquery('english', ?)", strings.Join(query.Terms, " "))
+	}
+	for _, phrase := range query.Phrases {
+		tx = tx.Where("to_tsvector('english', message) @@ phraseto_tsquery('english', ?)", phrase)
+	}
+	//user is a reserved word in postgres so the column has to be quoted
+	if query.User != "" {
+		tx = tx.Where(`"user" = ?`, query.User)
+	}
+	if query.Channel != 0 {
+		tx = tx.Where("channel = ?", query.Channel)
+	}
+	if !query.Before.IsZero() {
+		tx = tx.Where("created_at < ?", query.Before)
+	}
+	if !query.After.IsZero() {
+		tx = tx.Where("created_at > ?", query.After)
+	}
+	if !query.IncludePM {
+		tx = tx.Where(`message_type <> 'pm' OR "user" = ? OR pm_recipient = ?`, query.Viewer, query.Viewer)
+	}
+
+	results := []chat.Chat{}
+	err := tx.Order("created_at desc").Limit(limit).Find(&results).Error
+	return results, err
+}
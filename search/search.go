@@ -0,0 +1,274 @@
+package search
+
+/*
+	OVERVIEW: Full text search over the message history, used by the /search telnet command and GET /api/v1/search.
+	A query is a list of words and "quoted phrases" plus the operators user:<name>, channel:<number>, before:<date> and after:<date>.
+	Dates are either 2006-01-02 or RFC 3339. Every word and phrase must match.
+	The search is done by a Backend. Postgres uses its native tsvector full text search, every other dialect uses the in process inverted index in memory.go.
+	Private messages are only returned when the Query allows it, see Query.IncludePM and Query.Viewer.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"team-cymru-telnet/config"
+	"team-cymru-telnet/db"
+	"team-cymru-telnet/models/chat"
+	"time"
+	"unicode"
+)
+
+type Query struct {
+	Terms   []string
+	Phrases []string
+	User    string
+	Channel int
+	Before  time.Time
+	After   time.Time
+	//IncludePM returns every private message. when false only private messages sent by or to Viewer are returned, none when Viewer is empty
+	IncludePM bool
+	Viewer    string
+}
+
+type Backend interface {
+	//Index adds a saved message to the index. backends that search the database directly can ignore it
+	Index(message chat.Chat)
+	//Remove drops messages deleted from the store, e.g. by retention
+	Remove(ids []int)
+	Search(query Query, limit int) ([]chat.Chat, error)
+}
+
+//ParseQuery - splits the raw search string into words, phrases, and operators
+func ParseQuery(raw string) (Query, error) {
+	query := Query{}
+	for _, field := range splitQuery(raw) {
+		if strings.HasPrefix(field, `"`) {
+			phrase := strings.Join(tokenize(strings.Trim(field, `"`)), " ")
+			if phrase != "" {
+				query.Phrases = append(query.Phrases, phrase)
+			}
+			continue
+		}
+
+		var err error
+		switch {
+		case strings.HasPrefix(field, "user:"):
+			query.User = strings.TrimPrefix(field, "user:")
+		case strings.HasPrefix(field, "channel:"):
+			query.Channel, err = strconv.Atoi(strings.TrimPrefix(field, "channel:"))
+			if err != nil {
+				return query, fmt.Errorf("channel must be a number: %s", field)
+			}
+		case strings.HasPrefix(field, "before:"):
+			query.Before, err = parseDate(strings.TrimPrefix(field, "before:"))
+		case strings.HasPrefix(field, "after:"):
+			query.After, err = parseDate(strings.TrimPrefix(field, "after:"))
+		default:
+			query.Terms = append(query.Terms, tokenize(field)...)
+		}
+		if err != nil {
+			return query, err
+		}
+	}
+
+	if len(query.Terms) == 0 && len(query.Phrases) == 0 {
+		return query, errors.New("search needs at least one word or phrase")
+	}
+	return query, nil
+}
+
+//splits on spaces while keeping "quoted phrases" together. an unterminated quote runs to the end of the string
+func splitQuery(raw string) []string {
+	fields := []string{}
+	current := ""
+	quoted := false
+	for _, r := range raw {
+		switch {
+		case r == '"':
+			if quoted {
+				fields = append(fields, `"`+current+`"`)
+				current = ""
+			} else if current != "" {
+				fields = append(fields, current)
+				current = ""
+			}
+			quoted = !quoted
+		case r == ' ' && !quoted:
+			if current != "" {
+				fields = append(fields, current)
+				current = ""
+			}
+		default:
+			current += string(r)
+		}
+	}
+	if quoted {
+		fields = append(fields, `"`+current+`"`)
+	} else if current != "" {
+		fields = append(fields, current)
+	}
+	return fields
+}
+
+func parseDate(value string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf("dates must be 2006-01-02 or RFC 3339: %s", value)
+	}
+	return t, nil
+}
+
+//tokenize - lower case words made of letters and digits. the index and the queries must split text the same way
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+//Snippet - returns up to radius characters either side of the first match with every matching word wrapped in open and close
+func Snippet(message string, query Query, open string, close string, radius int) string {
+	return snippet(message, query, open, close, radius, func(text string) string { return text })
+}
+
+//HTMLSnippet - Snippet with the matches in <mark> and the message HTML escaped, so it is safe to render as HTML
+func HTMLSnippet(message string, query Query, radius int) string {
+	return snippet(message, query, "<mark>", "</mark>", radius, html.EscapeString)
+}
+
+//snippet passes the text of the message through escape, but not open and close
+func snippet(message string, query Query, open string, close string, radius int, escape func(string) string) string {
+	words := map[string]bool{}
+	for _, term := range query.Terms {
+		words[term] = true
+	}
+	for _, phrase := range query.Phrases {
+		for _, word := range strings.Fields(phrase) {
+			words[word] = true
+		}
+	}
+
+	runes := []rune(message)
+	first := -1
+	snippet := ""
+	start := 0
+	//walk the message word by word so the original spacing and case are kept
+	for i := 0; i <= len(runes); i++ {
+		if i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) {
+			continue
+		}
+		if i > start && words[strings.ToLower(string(runes[start:i]))] && first == -1 {
+			first = start
+		}
+		start = i + 1
+	}
+	if first == -1 {
+		first = 0
+	}
+
+	from := first - radius
+	if from < 0 {
+		from = 0
+	}
+	to := first + radius
+	if to > len(runes) {
+		to = len(runes)
+	}
+	window := runes[from:to]
+
+	start = 0
+	for i := 0; i <= len(window); i++ {
+		if i < len(window) && (unicode.IsLetter(window[i]) || unicode.IsDigit(window[i])) {
+			continue
+		}
+		word := string(window[start:i])
+		if word != "" && words[strings.ToLower(word)] {
+			snippet += open + escape(word) + close
+		} else {
+			snippet += escape(word)
+		}
+		if i < len(window) {
+			snippet += escape(string(window[i]))
+		}
+		start = i + 1
+	}
+
+	if from > 0 {
+		snippet = "..." + snippet
+	}
+	if to < len(runes) {
+		snippet += "..."
+	}
+	return snippet
+}
+
+//matches applies the whole query to a single message. used by the in memory index
+func matches(message chat.Chat, query Query) bool {
+	if query.User != "" && message.User != query.User {
+		return false
+	}
+	if query.Channel != 0 && (!message.Channel.Valid || message.Channel.Int64 != int64(query.Channel)) {
+		return false
+	}
+	if !query.Before.IsZero() && !message.CreatedAt.Before(query.Before) {
+		return false
+	}
+	if !query.After.IsZero() && !message.CreatedAt.After(query.After) {
+		return false
+	}
+	if message.MessageType == "pm" && !query.IncludePM && message.User != query.Viewer && message.PMRecipient.String != query.Viewer {
+		return false
+	}
+
+	words := " " + strings.Join(tokenize(message.Message), " ") + " "
+	for _, term := range query.Terms {
+		if !strings.Contains(words, " "+term+" ") {
+			return false
+		}
+	}
+	for _, phrase := range query.Phrases {
+		if !strings.Contains(words, " "+phrase+" ") {
+			return false
+		}
+	}
+	return true
+}
+
+//Start - selects the backend for the configured dialect. the in memory index is loaded from the database here
+func Start() {
+	if config.Cfg.Dialect == "postgres" && db.DB.Connected {
+		backend = newPostgresBackend()
+	} else {
+		backend = newMemoryIndex()
+	}
+	config.Log("search").Info("search backend has started")
+}
+
+//Index - adds a message to the index after it has been saved
+func Index(message chat.Chat) {
+	if backend != nil {
+		backend.Index(message)
+	}
+}
+
+//Remove - drops deleted messages from the index
+func Remove(ids []int) {
+	if backend != nil {
+		backend.Remove(ids)
+	}
+}
+
+//Search - newest matching messages first. use Snippet to highlight the matches in each message
+func Search(query Query, limit int) ([]chat.Chat, error) {
+	if backend == nil {
+		return nil, errors.New("search is not available")
+	}
+	return backend.Search(query, limit)
+}
+
+var backend Backend
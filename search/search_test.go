@@ -0,0 +1,94 @@
+package search
+
+import (
+	"database/sql"
+	"team-cymru-telnet/models/chat"
+	"testing"
+	"time"
+)
+
+func TestParseQuery(t *testing.T) {
+	query, err := ParseQuery(`deploy "build failed" user:stuart channel:2 after:2020-11-01`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(query.Terms) != 1 || query.Terms[0] != "deploy" {
+		t.Fatalf("unexpected terms %v", query.Terms)
+	}
+	if len(query.Phrases) != 1 || query.Phrases[0] != "build failed" {
+		t.Fatalf("unexpected phrases %v", query.Phrases)
+	}
+	if query.User != "stuart" || query.Channel != 2 || query.After.Year() != 2020 {
+		t.Fatalf("unexpected operators %+v", query)
+	}
+
+	if _, err := ParseQuery("user:stuart"); err == nil {
+		t.Fatal("expected an error for a query without words")
+	}
+}
+
+func TestMemoryIndex(t *testing.T) {
+	index := &memoryIndex{messages: map[int]chat.Chat{}, postings: map[string][]int{}}
+	now := time.Now()
+	index.Index(chat.Chat{ID: 1, User: "stuart", MessageType: "broadcast", Message: "the build failed again", CreatedAt: now})
+	index.Index(chat.Chat{ID: 2, User: "andrew", MessageType: "channel", Channel: sql.NullInt64{Valid: true, Int64: 2}, Message: "failed build, retrying", CreatedAt: now})
+	index.Index(chat.Chat{ID: 3, User: "andrew", MessageType: "pm", PMRecipient: sql.NullString{Valid: true, String: "stuart"}, Message: "build failed, sorry", CreatedAt: now})
+
+	query, _ := ParseQuery(`"build failed"`)
+	results, _ := index.Search(query, 10)
+	if len(results) != 1 || results[0].ID != 1 {
+		t.Fatalf("phrase search returned %v", results)
+	}
+
+	query, _ = ParseQuery("build failed")
+	query.Viewer = "stuart"
+	results, _ = index.Search(query, 10)
+	if len(results) != 3 || results[0].ID != 3 {
+		t.Fatalf("word search returned %v", results)
+	}
+
+	query.Viewer = "kallye"
+	results, _ = index.Search(query, 10)
+	if len(results) != 2 {
+		t.Fatalf("private message leaked to another viewer %v", results)
+	}
+
+	query.Viewer = ""
+	results, _ = index.Search(query, 10)
+	if len(results) != 2 {
+		t.Fatalf("private message returned without a viewer %v", results)
+	}
+
+	query, _ = ParseQuery("build channel:2")
+	results, _ = index.Search(query, 10)
+	if len(results) != 1 || results[0].ID != 2 {
+		t.Fatalf("channel search returned %v", results)
+	}
+
+	index.Remove([]int{1, 2})
+	query, _ = ParseQuery("build")
+	results, _ = index.Search(query, 10)
+	if len(results) != 0 {
+		t.Fatalf("removed messages were returned %v", results)
+	}
+	if _, ok := index.postings["retrying"]; ok {
+		t.Fatal("a word only used by removed messages is still indexed")
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	query, _ := ParseQuery("failed")
+	snippet := Snippet("the build Failed again", query, "<mark>", "</mark>", 80)
+	if snippet != "the build <mark>Failed</mark> again" {
+		t.Fatalf("unexpected snippet %s", snippet)
+	}
+}
+
+func TestHTMLSnippet(t *testing.T) {
+	query, _ := ParseQuery("alert")
+	snippet := HTMLSnippet(`<script>alert("x")</script> & <b>alert</b>`, query, 80)
+	expected := `&lt;script&gt;<mark>alert</mark>(&#34;x&#34;)&lt;/script&gt; &amp; &lt;b&gt;<mark>alert</mark>&lt;/b&gt;`
+	if snippet != expected {
+		t.Fatalf("unexpected snippet %s", snippet)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"team-cymru-telnet/config"
 	"team-cymru-telnet/db"
 	"team-cymru-telnet/models/chat"
+	"team-cymru-telnet/webhooks"
 )
 
 //object representing the connected user
@@ -36,13 +37,14 @@ func SendBroadcast(user User) bool {
 
 	if !threadController() {
 		if user.Name == "web" {
-			config.Logs().Info("could not receive message from web. no available listening clients")
+			config.Log("server").Info("could not receive message from web. no available listening clients")
 		}
 		return false
 	}
 
-	config.Logs().FileLogger.Printf("BROADCAST MESSAGE - %s", msg)
-	db.DB.Conn.Save(chat)
+	config.Log("chat").Chat(fmt.Sprintf("BROADCAST MESSAGE - %s", msg), config.F("type", chat.MessageType), config.User(chat.User), config.Body(chat.Message))
+	saveMessage(chat)
+	webhooks.Publish(webhooks.Event{Type: webhooks.EventMessage, User: chat.User, Message: chat.Message, MessageType: chat.MessageType})
 
 	return true
 }
@@ -59,19 +61,54 @@ func SendToChannel(user User) bool {
 
 	if !threadController() {
 		if user.Name == "web" {
-			config.Logs().Info("could not receive message from web. no available listening clients")
+			config.Log("server").Info("could not receive message from web. no available listening clients")
 		}
 		return false
 	}
 
 	channelMessage.Delete(user.Channel)
 
-	config.Logs().FileLogger.Printf("CHANNEL: %d - MESSAGE - %s", user.Channel, msg)
-	db.DB.Conn.Save(chat)
+	config.Log("chat").Chat(fmt.Sprintf("CHANNEL: %d - MESSAGE - %s", user.Channel, msg), config.F("type", chat.MessageType), config.User(chat.User),
+		config.Channel(user.Channel), config.Body(chat.Message))
+	saveMessage(chat)
+	webhooks.Publish(webhooks.Event{Type: webhooks.EventMessage, User: chat.User, Channel: user.Channel, Message: chat.Message, MessageType: chat.MessageType})
 
 	return true
 }
 
+//SendIntegration - delivers a notice posted to an incoming webhook. the line is prefixed with [bot] so it stands out from messages typed by users
+//and is sent to the channel when one is set, otherwise to everyone. notices are saved even when nobody is connected to receive them
+func SendIntegration(user User) bool {
+	chat := &chat.Chat{
+		User:        user.Name,
+		MessageType: "integration",
+		Message:     user.Message,
+	}
+
+	msg := fmt.Sprint("[bot] " + user.Name + " " + user.TimeStamp + "#: " + user.Message)
+	delivered := false
+	if user.Channel != 0 {
+		chat.Channel = sql.NullInt64{Valid: true, Int64: int64(user.Channel)}
+		msg = fmt.Sprint("[bot] Channel: " + strconv.Itoa(user.Channel) + " " + user.Name + " " + user.TimeStamp + "#: " + user.Message)
+		channelMessage.Store(user.Channel, msg)
+		delivered = threadController()
+		channelMessage.Delete(user.Channel)
+	} else {
+		user.Message = msg
+		for _, client := range connectedClients {
+			broadCastMessage.Store(client.name, user)
+		}
+		delivered = threadController()
+	}
+
+	config.Log("chat").Chat(fmt.Sprintf("INTEGRATION MESSAGE - %s", msg), config.F("type", chat.MessageType), config.User(chat.User),
+		config.Channel(int(chat.Channel.Int64)), config.Body(chat.Message))
+	saveMessage(chat)
+	webhooks.Publish(webhooks.Event{Type: webhooks.EventMessage, User: chat.User, Channel: int(chat.Channel.Int64), Message: chat.Message, MessageType: chat.MessageType})
+
+	return delivered
+}
+
 func sendPM(user User) {
 	chat := &chat.Chat{
 		User:        user.Name,
@@ -87,8 +124,14 @@ func sendPM(user User) {
 
 	privateMessage.Delete(user.Recipient)
 
-	config.Logs().FileLogger.Printf("PRIVATE - RECIPIENT: %s - MESSAGE - %s", user.Recipient, msg)
-	db.DB.Conn.Save(chat)
+	config.Log("chat").Chat(fmt.Sprintf("PRIVATE - RECIPIENT: %s - MESSAGE - %s", user.Recipient, msg), config.F("type", chat.MessageType),
+		config.User(chat.User), config.F("recipient", user.Recipient), config.Body(chat.Message))
+	saveMessage(chat)
+}
+
+//queues the message to be saved. saving happens in the background so a slow database never holds up the sender, see db/pipeline.go
+func saveMessage(message *chat.Chat) {
+	db.Persist(message)
 }
 
 func threadController() bool {
@@ -6,7 +6,10 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"team-cymru-telnet/auth"
 	"team-cymru-telnet/config"
+	"team-cymru-telnet/search"
+	"time"
 )
 
 func Exit(line string) bool {
@@ -16,9 +19,13 @@ func Exit(line string) bool {
 	return false
 }
 
-func displayHelp(conn net.Conn) {
+func displayHelp(user string, conn net.Conn) {
 	commands := []string{"/exit", "/quit", "/showusers", "/ignore <user>", "/unignore", "/channel <channel number> <message>", "/pm <user> <message>",
-		"/subscribe <channel number>", "/unsubscribe", "/help"}
+		"/subscribe <channel number>", "/unsubscribe", "/search <terms>", "/help"}
+	if isAdmin(user) {
+		commands = append(commands, "/token create <identity> <scopes>", "/token revoke <id>", "/token list",
+			"/sshkey add <user> <public key>", "/sshkey remove <id>", "/sshkey list")
+	}
 	// commands := map[string]string{
 	// 	"/exit":                               "quit the chat application\r\n",
 	// 	"/quit":                               "quit the chat application\r\n",
@@ -52,18 +59,38 @@ func displayHelp(conn net.Conn) {
 			helpMsg = fmt.Sprintf("%s: subscribe to channel\r\n", value)
 		case "/unsubscribe":
 			helpMsg = fmt.Sprintf("%s: stop channel subscription\r\n", value)
+		case "/search <terms>":
+			helpMsg = fmt.Sprintf("%s: search message history. supports \"phrases\", user:<name>, channel:<number>, before:<date> and after:<date>\r\n", value)
 		case "/help":
 			helpMsg = fmt.Sprintf("%s: displays this information\r\n", value)
+		case "/token create <identity> <scopes>":
+			helpMsg = fmt.Sprintf("%s: create an API token. scopes are comma separated, e.g. read:history,post:broadcast\r\n", value)
+		case "/token revoke <id>":
+			helpMsg = fmt.Sprintf("%s: revoke an API token\r\n", value)
+		case "/token list":
+			helpMsg = fmt.Sprintf("%s: list all API tokens\r\n", value)
+		case "/sshkey add <user> <public key>":
+			helpMsg = fmt.Sprintf("%s: register a public key, in authorized_keys format, for logging in to the SSH listener\r\n", value)
+		case "/sshkey remove <id>":
+			helpMsg = fmt.Sprintf("%s: remove a public key\r\n", value)
+		case "/sshkey list":
+			helpMsg = fmt.Sprintf("%s: list all registered public keys\r\n", value)
 		}
 		conn.Write([]byte(helpMsg))
 	}
 	conn.Write([]byte("\r\n"))
 }
 
+//lists every user once, with the number of places they are connected from when there is more than one
 func displayUsers(conn net.Conn) {
 	for _, client := range connectedClients {
 		if client.name != "web" {
 			conn.Write([]byte(client.name))
+			if value, ok := sessionsByName.Load(client.name); ok {
+				if connections := value.(*session).connections(); connections > 1 {
+					conn.Write([]byte(fmt.Sprintf(" (%d sessions)", connections)))
+				}
+			}
 			conn.Write([]byte("\r\n"))
 		}
 	}
@@ -111,7 +138,7 @@ func addChannel(name string, line string, lineIndex int, conn net.Conn) {
 		if i == lineIndex {
 			channelNum, err = strconv.Atoi(str)
 			if err != nil {
-				config.Logs().Error(fmt.Sprintf("failed to subscribe to channel %s. error: %v", str, err))
+				config.Log("server").Error("failed to subscribe to a channel", config.User(name), config.F("channel", str), config.Err(err))
 				conn.Write([]byte(fmt.Sprintf("could not subscribe to channel. %v", err)))
 				return
 			}
@@ -142,7 +169,7 @@ func updateUserWithChannel(user *User, line string) {
 		if i == 1 {
 			user.Channel, err = strconv.Atoi(str)
 			if err != nil {
-				config.Logs().Error(fmt.Sprintf("failed to send to channel %s. error: %v", str, err))
+				config.Log("server").Error("failed to send to a channel", config.User(user.Name), config.F("channel", str), config.Err(err))
 			}
 		} else if i == 2 {
 			user.Message = str
@@ -150,6 +177,143 @@ func updateUserWithChannel(user *User, line string) {
 	}
 }
 
+//number of results written to the telnet session for a /search
+const searchResultLimit = 10
+
+//runs a /search for the user. private messages are only included when they were sent by or to the user, and only for users authenticated
+//by their connection. anyone can type the name of a user who is away at the prompt
+func searchHistory(name string, line string, conn net.Conn) {
+	query, err := search.ParseQuery(searchCommand.FindStringSubmatch(line)[1])
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("could not search. %v\r\n", err)))
+		return
+	}
+	if sessionAuthenticated(name) {
+		query.Viewer = name
+	}
+
+	results, err := search.Search(query, searchResultLimit)
+	if err != nil {
+		config.Log("server").Error("search failed", config.User(name), config.Err(err))
+		conn.Write([]byte(fmt.Sprintf("could not search. %v\r\n", err)))
+		return
+	}
+	if len(results) == 0 {
+		conn.Write([]byte("no messages found\r\n"))
+		return
+	}
+	for _, result := range results {
+		where := result.MessageType
+		if result.Channel.Valid {
+			where = fmt.Sprintf("channel %d", result.Channel.Int64)
+		}
+		snippet := search.Snippet(result.Message, query, "*", "*", 40)
+		conn.Write([]byte(fmt.Sprintf("%s %s (%s)#: %s\r\n", result.CreatedAt.Local().Format(time.Stamp), result.User, where, snippet)))
+	}
+}
+
+//isAdmin is true for the users in admins whose session was authenticated by their connection. a name typed at the prompt proves nothing,
+//anyone can enter it while the admin is away
+func isAdmin(name string) bool {
+	if !sessionAuthenticated(name) {
+		return false
+	}
+	for _, admin := range config.Cfg.Admins {
+		if admin == name {
+			return true
+		}
+	}
+	return false
+}
+
+//handles the /token admin commands. the plain text token is only ever written back to the admin who created it
+func tokenCommand(name string, line string, conn net.Conn) {
+	if !isAdmin(name) {
+		config.Log("server").Error("user attempted to run an admin command", config.User(name), config.F("command", line))
+		conn.Write([]byte("permission denied\r\n"))
+		return
+	}
+
+	switch {
+	case tokenCreate.MatchString(line):
+		match := tokenCreate.FindStringSubmatch(line)
+		plain, tok, err := auth.CreateToken(match[1], auth.ParseScopes(match[2]))
+		if err != nil {
+			config.Log("server").Error("failed to create token", config.User(name), config.F("identity", match[1]), config.Err(err))
+			conn.Write([]byte(fmt.Sprintf("could not create token. %v\r\n", err)))
+			return
+		}
+		config.Log("server").Info("token created", config.User(name), config.F("token", tok.ID), config.F("identity", tok.Identity), config.F("scopes", tok.Scopes))
+		conn.Write([]byte(fmt.Sprintf("token %d created for %s. this is the only time it will be shown:\r\n%s\r\n", tok.ID, tok.Identity, plain)))
+	case tokenRevoke.MatchString(line):
+		id, _ := strconv.Atoi(tokenRevoke.FindStringSubmatch(line)[1])
+		if err := auth.RevokeToken(id); err != nil {
+			config.Log("server").Error("failed to revoke token", config.User(name), config.F("token", id), config.Err(err))
+			conn.Write([]byte(fmt.Sprintf("could not revoke token. %v\r\n", err)))
+			return
+		}
+		config.Log("server").Info("token revoked", config.User(name), config.F("token", id))
+		conn.Write([]byte(fmt.Sprintf("token %d revoked\r\n", id)))
+	case line == tokenList:
+		tokens, err := auth.ListTokens()
+		if err != nil {
+			conn.Write([]byte(fmt.Sprintf("could not list tokens. %v\r\n", err)))
+			return
+		}
+		for _, tok := range tokens {
+			status := "active"
+			if tok.Revoked {
+				status = "revoked"
+			}
+			conn.Write([]byte(fmt.Sprintf("%d %s %s %s\r\n", tok.ID, tok.Identity, tok.Scopes, status)))
+		}
+	default:
+		conn.Write([]byte("usage: /token create <identity> <scopes> | /token revoke <id> | /token list\r\n"))
+	}
+}
+
+//handles the /sshkey admin commands
+func sshKeyCommand(name string, line string, conn net.Conn) {
+	if !isAdmin(name) {
+		config.Log("server").Error("user attempted to run an admin command", config.User(name), config.F("command", line))
+		conn.Write([]byte("permission denied\r\n"))
+		return
+	}
+
+	switch {
+	case sshKeyAdd.MatchString(line):
+		match := sshKeyAdd.FindStringSubmatch(line)
+		key, err := auth.AddSSHKey(match[1], match[2])
+		if err != nil {
+			config.Log("server").Error("failed to add ssh key", config.User(name), config.F("owner", match[1]), config.Err(err))
+			conn.Write([]byte(fmt.Sprintf("could not add ssh key. %v\r\n", err)))
+			return
+		}
+		config.Log("server").Info("ssh key added", config.User(name), config.F("key", key.ID), config.F("fingerprint", key.Fingerprint), config.F("owner", key.User))
+		conn.Write([]byte(fmt.Sprintf("ssh key %d added for %s. %s\r\n", key.ID, key.User, key.Fingerprint)))
+	case sshKeyRemove.MatchString(line):
+		id, _ := strconv.Atoi(sshKeyRemove.FindStringSubmatch(line)[1])
+		if err := auth.RemoveSSHKey(id); err != nil {
+			config.Log("server").Error("failed to remove ssh key", config.User(name), config.F("key", id), config.Err(err))
+			conn.Write([]byte(fmt.Sprintf("could not remove ssh key. %v\r\n", err)))
+			return
+		}
+		config.Log("server").Info("ssh key removed", config.User(name), config.F("key", id))
+		conn.Write([]byte(fmt.Sprintf("ssh key %d removed\r\n", id)))
+	case line == sshKeyList:
+		keys, err := auth.ListSSHKeys()
+		if err != nil {
+			conn.Write([]byte(fmt.Sprintf("could not list ssh keys. %v\r\n", err)))
+			return
+		}
+		for _, key := range keys {
+			conn.Write([]byte(fmt.Sprintf("%d %s %s\r\n", key.ID, key.User, key.Fingerprint)))
+		}
+	default:
+		conn.Write([]byte("usage: /sshkey add <user> <public key> | /sshkey remove <id> | /sshkey list\r\n"))
+	}
+}
+
 var exit string = "/exit"
 var quit string = "/quit"
 var showUsers string = "/showusers"
@@ -160,3 +324,13 @@ var pm *regexp.Regexp = regexp.MustCompile("^/pm ([a-z]+) (.*)$")
 var subscribe *regexp.Regexp = regexp.MustCompile("^/subscribe (\\d+)$")
 var unsubscribe string = "/unsubscribe"
 var help string = "/help"
+var resumeCommand *regexp.Regexp = regexp.MustCompile("^/resume ([0-9a-f]+)$")
+var searchCommand *regexp.Regexp = regexp.MustCompile("^/search (.+)$")
+var token *regexp.Regexp = regexp.MustCompile("^/token( .*)?$")
+var tokenCreate *regexp.Regexp = regexp.MustCompile("^/token create ([a-z]+) ([a-z:,]+)$")
+var tokenRevoke *regexp.Regexp = regexp.MustCompile("^/token revoke (\\d+)$")
+var tokenList string = "/token list"
+var sshKey *regexp.Regexp = regexp.MustCompile("^/sshkey( .*)?$")
+var sshKeyAdd *regexp.Regexp = regexp.MustCompile("^/sshkey add ([a-z]+) (.+)$")
+var sshKeyRemove *regexp.Regexp = regexp.MustCompile("^/sshkey remove (\\d+)$")
+var sshKeyList string = "/sshkey list"
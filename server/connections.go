@@ -0,0 +1,166 @@
+package server
+
+/*
+	OVERVIEW: Connection accounting for the telnet listener and the web terminal. Every session is admitted by the connection manager before
+	the name prompt and released when the session ends, whichever way it ends: /exit, a read error, a closed web terminal or a shutdown.
+	Four limits are checked, in order: the accept rate (acceptRatePerSecond with bursts of acceptBurst), maxClients, the maxClients of the
+	listener the connection came in on and maxClientsPerIP. Web terminal sessions have no listener limit.
+	A refused connection is told why and closed and never counts as a session. The limits are read from config.Cfg on every connection so
+	a reload applies them straight away; sessions already over a lowered limit are not closed.
+	ConnectionStats is returned by GET /api/v1/metrics.
+*/
+
+import (
+	"net"
+	"sync"
+	"team-cymru-telnet/config"
+	"time"
+)
+
+//ConnectionStats - current sessions and the connections refused since start up
+type ConnectionStats struct {
+	Active              int            `json:"active"`
+	PerIP               map[string]int `json:"perIP"`
+	PerListener         map[string]int `json:"perListener"`
+	Accepted            int64          `json:"accepted"`
+	RefusedMaxClients   int64          `json:"refusedMaxClients"`
+	RefusedPerIP        int64          `json:"refusedPerIP"`
+	RefusedListener     int64          `json:"refusedListener"`
+	RefusedRate         int64          `json:"refusedRate"`
+	RefusedShuttingDown int64          `json:"refusedShuttingDown"`
+}
+
+type connectionManager struct {
+	mutex  sync.Mutex
+	active int
+	perIP  map[string]int
+	//perListener counts the sessions by listener name, see config.Listener.String
+	perListener map[string]int
+	//tokens and lastFill are the accept rate limiter, a token bucket refilled at acceptRatePerSecond
+	tokens   float64
+	lastFill time.Time
+	stats    ConnectionStats
+	now      func() time.Time
+}
+
+func newConnectionManager() *connectionManager {
+	return &connectionManager{perIP: map[string]int{}, perListener: map[string]int{}, now: time.Now}
+}
+
+var connections = newConnectionManager()
+
+//admit returns a release func when conn, accepted by listener with its limit, may start a session, otherwise the message to send before
+//closing it. listener is empty for connections without one, e.g. the web terminal
+func (c *connectionManager) admit(conn net.Conn, listener string, limit int) (func(), string) {
+	ip := remoteIP(conn.RemoteAddr())
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.allowRate(config.Cfg.AcceptRatePerSecond, config.Cfg.AcceptBurst) {
+		c.stats.RefusedRate++
+		return nil, "Connection Refused. Too many new connections. Please try again later."
+	}
+	if c.active >= config.Cfg.MaxClients {
+		c.stats.RefusedMaxClients++
+		return nil, "Connection Refused. Too many current clients. Please try again later."
+	}
+	if listener != "" && limit > 0 && c.perListener[listener] >= limit {
+		c.stats.RefusedListener++
+		return nil, "Connection Refused. Too many current clients. Please try again later."
+	}
+	if limit := config.Cfg.MaxClientsPerIP; limit > 0 && c.perIP[ip] >= limit {
+		c.stats.RefusedPerIP++
+		return nil, "Connection Refused. Too many connections from your address. Please try again later."
+	}
+
+	c.active++
+	c.perIP[ip]++
+	if listener != "" {
+		c.perListener[listener]++
+	}
+	c.stats.Accepted++
+	released := false
+	return func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if released {
+			return
+		}
+		released = true
+		c.active--
+		if c.perIP[ip]--; c.perIP[ip] <= 0 {
+			delete(c.perIP, ip)
+		}
+		if listener == "" {
+			return
+		}
+		if c.perListener[listener]--; c.perListener[listener] <= 0 {
+			delete(c.perListener, listener)
+		}
+	}, ""
+}
+
+//refuseShuttingDown counts a connection refused because Shutdown has started
+func (c *connectionManager) refuseShuttingDown() {
+	c.mutex.Lock()
+	c.stats.RefusedShuttingDown++
+	c.mutex.Unlock()
+}
+
+//allowRate takes a token from the bucket. a rate of 0 disables the limit and a burst below 1 allows one connection at a time
+func (c *connectionManager) allowRate(rate int, burst int) bool {
+	if rate <= 0 {
+		return true
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	now := c.now()
+	if c.lastFill.IsZero() {
+		c.tokens = float64(burst)
+	} else {
+		c.tokens += now.Sub(c.lastFill).Seconds() * float64(rate)
+	}
+	c.lastFill = now
+	if c.tokens > float64(burst) {
+		c.tokens = float64(burst)
+	}
+	if c.tokens < 1 {
+		return false
+	}
+	c.tokens--
+	return true
+}
+
+func (c *connectionManager) snapshot() ConnectionStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats := c.stats
+	stats.Active = c.active
+	stats.PerIP = make(map[string]int, len(c.perIP))
+	for ip, count := range c.perIP {
+		stats.PerIP[ip] = count
+	}
+	stats.PerListener = make(map[string]int, len(c.perListener))
+	for listener, count := range c.perListener {
+		stats.PerListener[listener] = count
+	}
+	return stats
+}
+
+//Connections - the current session counts, for the metrics endpoint
+func Connections() ConnectionStats {
+	return connections.snapshot()
+}
+
+//remoteIP is the host part of addr. addresses without a port, like the one of net.Pipe, are used as they are
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
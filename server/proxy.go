@@ -0,0 +1,150 @@
+package server
+
+/*
+	OVERVIEW: PROXY protocol (v1 text and v2 binary) for listeners behind a load balancer such as HAProxy. On listeners with proxyProtocol set,
+	connections from the trustedProxies addresses must start with a PROXY header. The client address in it replaces the balancer's as the
+	RemoteAddr of the connection, so logs, the per IP limits and sessions see the real client. The header is read before the TLS or SSH
+	handshake. A LOCAL (v2) or UNKNOWN (v1) header, e.g. a health check, keeps the balancer's address.
+	Connections from any other address are served as they are, without a header, so a client cannot pretend to be someone else.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"team-cymru-telnet/config"
+	"time"
+)
+
+//proxyV2Signature starts every v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+//longest v1 header allowed by the specification, CRLF included
+const maxProxyV1Length = 107
+
+//proxyConn is a connection whose PROXY header has been read. reads continue with what the client sent after the header
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+func (p *proxyConn) Read(b []byte) (int, error) {
+	return p.reader.Read(b)
+}
+
+func (p *proxyConn) RemoteAddr() net.Addr {
+	return p.remote
+}
+
+//acceptProxy reads the PROXY header of a connection from a trusted proxy. other connections are returned unchanged
+func acceptProxy(conn net.Conn) (net.Conn, error) {
+	peer := conn.RemoteAddr()
+	if !config.Cfg.TrustedProxy(net.ParseIP(remoteIP(peer))) {
+		return conn, nil
+	}
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	reader := bufio.NewReader(conn)
+	addr, err := readProxyHeader(reader)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol header from %s. %v", peer.String(), err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	if addr == nil {
+		addr = peer
+	}
+	return &proxyConn{Conn: conn, reader: reader, remote: addr}, nil
+}
+
+//readProxyHeader reads a v1 or v2 header and returns the client address, nil when the header does not carry one
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	//the shortest header, v1 "PROXY UNKNOWN\r\n", is longer than the v2 signature
+	start, err := reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(start, proxyV2Signature):
+		return readProxyV2(reader)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readProxyV1(reader)
+	}
+	return nil, errors.New("the connection does not start with a PROXY header")
+}
+
+//readProxyV1 reads "PROXY TCP4|TCP6 <source> <destination> <source port> <destination port>\r\n" or "PROXY UNKNOWN ...\r\n"
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	line := []byte{}
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == maxProxyV1Length {
+			return nil, fmt.Errorf("v1 header longer than %d bytes", maxProxyV1Length)
+		}
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", string(line))
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid %s source address %q", fields[1], fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source port %q", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+//readProxyV2 reads the binary header: the signature, version and command, address family, length and the addresses
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	versionCommand, family := header[12], header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", versionCommand>>4)
+	}
+	switch versionCommand & 0x0f {
+	case 0x0:
+		//LOCAL, the proxy's own connection
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("unsupported command %d", versionCommand&0x0f)
+	}
+
+	//addresses are followed by optional TLVs which are ignored
+	switch family >> 4 {
+	case 0x1:
+		if len(body) < 12 {
+			return nil, errors.New("IPv4 addresses are truncated")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x2:
+		if len(body) < 36 {
+			return nil, errors.New("IPv6 addresses are truncated")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	//AF_UNSPEC and AF_UNIX carry no client IP
+	return nil, nil
+}
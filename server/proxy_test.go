@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"team-cymru-telnet/config"
+	"testing"
+)
+
+//proxyV2 builds a v2 header for the command, family and address bytes
+func proxyV2(command byte, family byte, addresses []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0x12, 0x67, 0, 23}
+	ipv6 := append(append(append([]byte{}, net.ParseIP("2001:db8::7")...), net.ParseIP("2001:db8::1")...), 0x12, 0x67, 0, 23)
+	//a TLV after the addresses must be skipped
+	withTLV := append(append([]byte{}, ipv4...), 0x04, 0, 1, 0)
+
+	for _, test := range []struct {
+		name     string
+		header   []byte
+		expected string
+		fails    bool
+	}{
+		{name: "v1 TCP4", header: []byte("PROXY TCP4 203.0.113.7 10.0.0.1 4711 23\r\n"), expected: "203.0.113.7:4711"},
+		{name: "v1 TCP6", header: []byte("PROXY TCP6 2001:db8::7 2001:db8::1 4711 23\r\n"), expected: "[2001:db8::7]:4711"},
+		{name: "v1 UNKNOWN", header: []byte("PROXY UNKNOWN\r\n")},
+		{name: "v2 IPv4", header: proxyV2(1, 0x11, ipv4), expected: "203.0.113.7:4711"},
+		{name: "v2 IPv6", header: proxyV2(1, 0x21, ipv6), expected: "[2001:db8::7]:4711"},
+		{name: "v2 TLV", header: proxyV2(1, 0x11, withTLV), expected: "203.0.113.7:4711"},
+		{name: "v2 LOCAL", header: proxyV2(0, 0x00, nil)},
+		{name: "v1 family mismatch", header: []byte("PROXY TCP4 2001:db8::7 10.0.0.1 4711 23\r\n"), fails: true},
+		{name: "v1 bad port", header: []byte("PROXY TCP4 203.0.113.7 10.0.0.1 70000 23\r\n"), fails: true},
+		{name: "v2 truncated", header: proxyV2(1, 0x11, ipv4[:8]), fails: true},
+		{name: "no header", header: []byte("alice\r\nhello everyone\r\n"), fails: true},
+	} {
+		reader := bufio.NewReader(bytes.NewReader(append(test.header, "alice\r\n"...)))
+		addr, err := readProxyHeader(reader)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", test.name, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if (addr == nil && test.expected != "") || (addr != nil && addr.String() != test.expected) {
+			t.Errorf("%s: expected %q, got %v", test.name, test.expected, addr)
+		}
+		if rest, _ := ioutil.ReadAll(reader); string(rest) != "alice\r\n" {
+			t.Errorf("%s: the data after the header was not kept, got %q", test.name, rest)
+		}
+	}
+}
+
+func TestAcceptProxy(t *testing.T) {
+	config.Cfg.TrustedProxies = []string{"10.0.0.0/24"}
+	defer func() { config.Cfg.TrustedProxies = nil }()
+
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	go clientSide.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 4711 23\r\nalice\r\n"))
+	conn, err := acceptProxy(addrConn{Conn: serverSide, addr: testAddr("10.0.0.9:5000")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remoteIP(conn.RemoteAddr()) != "203.0.113.7" || !isTelnet(conn) {
+		t.Fatalf("the connection from the balancer was not attributed to its client, got %v", conn.RemoteAddr())
+	}
+	buf := make([]byte, 16)
+	if n, _ := conn.Read(buf); string(buf[:n]) != "alice\r\n" {
+		t.Fatalf("expected the name after the header, got %q", buf[:n])
+	}
+
+	//a client which is not a trusted proxy is served as it is, its PROXY line is not believed
+	direct := addrConn{addr: testAddr("192.0.2.50:6000")}
+	if conn, err := acceptProxy(direct); err != nil || conn.RemoteAddr().String() != "192.0.2.50:6000" {
+		t.Fatalf("a direct connection was changed, got %v %v", conn, err)
+	}
+}
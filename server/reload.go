@@ -0,0 +1,75 @@
+package server
+
+/*
+	OVERVIEW: Hot reload of the config. SIGHUP and POST /api/v1/config/reload both call ReloadConfig, which applies the reloadable settings
+	(see config/reload.go) and tells every connected admin what changed and what needs a restart.
+*/
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"team-cymru-telnet/config"
+	"time"
+)
+
+//ReloadConfig - source names what asked for the reload, e.g. "SIGHUP", for the log and the admin notice
+func ReloadConfig(source string) (config.ReloadResult, error) {
+	result, err := config.Reload()
+	if err != nil {
+		config.Log("server").Error("config reload failed, nothing was changed", config.F("source", source), config.Err(err))
+		sendAdminNotice(fmt.Sprintf("config reload requested by %s failed, nothing was changed", source))
+		return result, err
+	}
+
+	notice := fmt.Sprintf("config reloaded by %s. applied: %s", source, fieldList(result.Applied))
+	fields := []config.Field{config.F("source", source), config.F("applied", strings.Join(result.Applied, ","))}
+	if len(result.Rejected) > 0 {
+		notice += fmt.Sprintf(". restart required for: %s", fieldList(result.Rejected))
+		fields = append(fields, config.F("restart_required", strings.Join(result.Rejected, ",")))
+	}
+	config.Log("server").Info("config reloaded", fields...)
+	sendAdminNotice(notice)
+	return result, nil
+}
+
+func fieldList(fields []string) string {
+	if len(fields) == 0 {
+		return "none"
+	}
+	return strings.Join(fields, ", ")
+}
+
+//sendAdminNotice delivers a system line to every connected admin, the same way a private message is delivered
+func sendAdminNotice(text string) {
+	msg := fmt.Sprint("[system] " + time.Now().Local().Format(time.Stamp) + "#: " + text)
+	admins := []string{}
+	for _, client := range connectedClients {
+		if isAdmin(client.name) {
+			admins = append(admins, client.name)
+			privateMessage.Store(client.name, msg)
+		}
+	}
+	if len(admins) == 0 {
+		return
+	}
+
+	threadController()
+
+	for _, name := range admins {
+		privateMessage.Delete(name)
+	}
+}
+
+//reloadOnSignal reloads the config every time the process receives SIGHUP
+func reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			ReloadConfig("SIGHUP")
+		}
+	}()
+}
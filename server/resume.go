@@ -0,0 +1,305 @@
+package server
+
+/*
+	OVERVIEW: Resumable chat sessions, and sessions with several connections. Once a name is entered the user gets a resume token.
+	When the connection drops (a read fails, as opposed to /exit, a timeout or a shutdown) the session is detached instead of ended: the name stays taken, the listener keeps running and
+	what it would have written is buffered, up to resumeBufferSize writes with the oldest dropped first. A new connection that enters
+	/resume <token> at the name prompt within resumeGraceSeconds gets the session back, with the buffered messages replayed and a new token.
+	Connections that already carry an authenticated name (authenticatedConn) resume a session of that name without a token.
+	Resuming a session that still looks connected, e.g. a half open connection whose peer is gone, takes it over and closes the old connection.
+	When the grace period passes the session ends as if the user had left. resumeGraceSeconds 0 disables resuming.
+	With multiSession on, /resume and authenticated names add the connection to the session instead of taking it over, so one user can be
+	connected from several places. Everything the listener writes, messages and PMs alike, goes to every connection, commands are answered on
+	the connection they were typed on and /quit, timeouts and dropped connections only remove that connection. The session is detached or
+	ended, as above, when its last connection goes.
+	Tokens are kept in memory only, by their SHA-256 hash like the API tokens, so sessions cannot be resumed across a restart.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"team-cymru-telnet/auth"
+	"team-cymru-telnet/config"
+	"team-cymru-telnet/webhooks"
+	"time"
+)
+
+//number of writes buffered for a detached session when resumeBufferSize is 0
+const defaultResumeBufferSize = 100
+
+var errSessionEnded = errors.New("the session has ended")
+
+//authenticatedConn is implemented by connections whose user has been authenticated before the chat session starts
+type authenticatedConn interface {
+	AuthenticatedName() string
+}
+
+//authenticatedName is the name conn was authenticated as, empty for anonymous connections
+func authenticatedName(conn net.Conn) string {
+	if authenticated, ok := conn.(authenticatedConn); ok {
+		return authenticated.AuthenticatedName()
+	}
+	return ""
+}
+
+//sessionAuthenticated is true when the session of name was started on an authenticatedConn
+func sessionAuthenticated(name string) bool {
+	value, ok := sessionsByName.Load(name)
+	return ok && value.(*session).authenticated
+}
+
+//session is the chat state of a user which outlives the connections it was started on. it is the io.Writer of its listener
+type session struct {
+	name string
+	//user and ignoreUserMap are shared by the connections of the session and its listener, guarded by stateMutex. each connection sends
+	//with its own User, user only holds the name and the channel the listener delivers
+	stateMutex    sync.Mutex
+	user          *User
+	ignoreUserMap map[string]bool
+	//authenticated is true when the session was started on an authenticatedConn, e.g. with a TLS client certificate or an SSH key
+	authenticated bool
+	//stop ends the listener
+	stop chan struct{}
+
+	mutex sync.Mutex
+	//conns is empty while the session is detached
+	conns     []net.Conn
+	tokenHash string
+	missed    [][]byte
+	lost      int
+	expiry    *time.Timer
+	ended     bool
+}
+
+//resumeTokens maps the hash of a resume token to its session, sessionsByName maps the name to the session
+var resumeTokens sync.Map = sync.Map{}
+var sessionsByName sync.Map = sync.Map{}
+
+func newSession(name string, conn net.Conn, user *User, ignoreUserMap map[string]bool, authenticated bool) *session {
+	s := &session{name: name, user: user, ignoreUserMap: ignoreUserMap, authenticated: authenticated, stop: make(chan struct{}), conns: []net.Conn{conn}}
+	sessionsByName.Store(name, s)
+	return s
+}
+
+//updateIgnored runs update on the ignore list of the session
+func (s *session) updateIgnored(update func(ignoreUserMap map[string]bool)) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	update(s.ignoreUserMap)
+}
+
+//setChannel sets the channel the listener delivers, the last one a connection of the session sent to
+func (s *session) setChannel(channel int) {
+	s.stateMutex.Lock()
+	s.user.Channel = channel
+	s.stateMutex.Unlock()
+}
+
+//issueToken replaces the resume token of the session and returns the new one
+func (s *session) issueToken() (string, error) {
+	plain, hash, err := auth.NewSecret()
+	if err != nil {
+		return "", err
+	}
+	s.mutex.Lock()
+	if s.tokenHash != "" {
+		resumeTokens.Delete(s.tokenHash)
+	}
+	s.tokenHash = hash
+	s.mutex.Unlock()
+	resumeTokens.Store(hash, s)
+	return plain, nil
+}
+
+//Write sends p to every connection, or buffers it while the session is detached
+func (s *session) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	conns := s.conns
+	if len(conns) == 0 {
+		defer s.mutex.Unlock()
+		if s.ended {
+			return 0, errSessionEnded
+		}
+		limit := config.Cfg.ResumeBufferSize
+		if limit <= 0 {
+			limit = defaultResumeBufferSize
+		}
+		s.missed = append(s.missed, append([]byte{}, p...))
+		if len(s.missed) > limit {
+			s.lost += len(s.missed) - limit
+			s.missed = s.missed[len(s.missed)-limit:]
+		}
+		return len(p), nil
+	}
+	s.mutex.Unlock()
+	//written without the lock so a peer which stopped reading does not hold up a resume
+	for _, conn := range conns {
+		conn.Write(p)
+	}
+	return len(p), nil
+}
+
+//connections is the number of connections attached to the session
+func (s *session) connections() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.conns)
+}
+
+//release is called when conn, a connection of the session, has ended. when it was the last one a dropped connection detaches the session,
+//anything else ends it
+func (s *session) release(conn net.Conn, dropped bool) {
+	s.mutex.Lock()
+	index := -1
+	for i, attached := range s.conns {
+		if attached == conn {
+			index = i
+		}
+	}
+	if index < 0 {
+		//the session was resumed on another connection
+		s.mutex.Unlock()
+		return
+	}
+	s.conns = append(s.conns[:index:index], s.conns[index+1:]...)
+	if remaining := len(s.conns); remaining > 0 {
+		s.mutex.Unlock()
+		config.Log("server").Info("one connection of a session closed", config.User(s.name), config.F("remaining", remaining))
+		return
+	}
+	grace := config.Cfg.ResumeGraceSeconds
+	if !dropped || grace <= 0 || atomic.LoadInt32(&shuttingDown) == 1 {
+		s.mutex.Unlock()
+		s.end()
+		return
+	}
+	s.expiry = time.AfterFunc(seconds(grace), s.expire)
+	s.mutex.Unlock()
+	config.Log("server").Info("connection dropped, holding the session", config.User(s.name), config.F("grace_seconds", grace))
+}
+
+//attach adds conn to the session, or moves the session to it when multiSession is off. it returns the writes buffered while the session was
+//detached and how many were dropped from the buffer
+func (s *session) attach(conn net.Conn) ([][]byte, int, error) {
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return nil, 0, errSessionEnded
+	}
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+	previous := []net.Conn{}
+	if !config.Cfg.MultiSession {
+		previous = s.conns
+		s.conns = []net.Conn{}
+	}
+	s.conns = append(s.conns, conn)
+	missed, lost := s.missed, s.lost
+	s.missed, s.lost = nil, 0
+	s.mutex.Unlock()
+
+	for _, conn := range previous {
+		conn.Write([]byte("\r\nthis session has been resumed from another connection. closing connection\r\n"))
+		conn.Close()
+	}
+	return missed, lost, nil
+}
+
+//expire ends the session when it was not resumed during the grace period
+func (s *session) expire() {
+	if s.connections() > 0 {
+		return
+	}
+	config.Log("server").Info("session was not resumed in time", config.User(s.name))
+	s.end()
+}
+
+//end frees the name, stops the listener and tells the webhooks the user has left. it is safe to call more than once
+func (s *session) end() {
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	s.conns = nil
+	s.missed = nil
+	if s.expiry != nil {
+		s.expiry.Stop()
+	}
+	resumeTokens.Delete(s.tokenHash)
+	s.mutex.Unlock()
+
+	sessionsByName.Delete(s.name)
+	removeClient(s.name)
+	close(s.stop)
+	webhooks.Publish(webhooks.Event{Type: webhooks.EventLeave, User: s.name})
+}
+
+//resumeWithToken attaches the session of token to conn
+func resumeWithToken(plain string, conn net.Conn) (*session, error) {
+	value, ok := resumeTokens.Load(auth.Hash(plain))
+	if !ok {
+		return nil, errors.New("unknown or expired resume token")
+	}
+	return resume(value.(*session), conn)
+}
+
+//resumeByName attaches the session of an authenticated name to conn. nil when there is no session to resume
+func resumeByName(name string, conn net.Conn) *session {
+	value, ok := sessionsByName.Load(name)
+	if !ok {
+		return nil
+	}
+	s, err := resume(value.(*session), conn)
+	if err != nil {
+		return nil
+	}
+	return s
+}
+
+//resume attaches s to conn, replays what was missed and issues a new token
+func resume(s *session, conn net.Conn) (*session, error) {
+	missed, lost, err := s.attach(conn)
+	if err != nil {
+		return nil, err
+	}
+	config.Log("server").Info("session resumed", config.User(s.name), config.Remote(conn.RemoteAddr()))
+
+	if connections := s.connections(); connections > 1 {
+		conn.Write([]byte(fmt.Sprintf("\r\nwelcome %s. you are connected from %d places\r\n", s.name, connections)))
+	} else {
+		conn.Write([]byte(fmt.Sprintf("\r\nwelcome back %s. %d messages arrived while you were away\r\n", s.name, len(missed)+lost)))
+	}
+	if lost > 0 {
+		conn.Write([]byte(fmt.Sprintf("the first %d are no longer available\r\n", lost)))
+	}
+	for _, write := range missed {
+		conn.Write(write)
+	}
+	s.sendToken()
+	conn.Write([]byte("\r\n" + s.name + "#: "))
+	return s, nil
+}
+
+//sendToken issues a resume token and writes it to the session
+func (s *session) sendToken() {
+	if config.Cfg.ResumeGraceSeconds <= 0 {
+		return
+	}
+	plain, err := s.issueToken()
+	if err != nil {
+		config.Log("server").Error("failed to issue a resume token", config.User(s.name), config.Err(err))
+		return
+	}
+	s.Write([]byte(fmt.Sprintf("\r\nyour resume token is %s\r\nif your connection drops, reconnect and enter /resume %s within %d seconds to continue this session\r\n",
+		plain, plain, config.Cfg.ResumeGraceSeconds)))
+	if config.Cfg.MultiSession {
+		s.Write([]byte(fmt.Sprintf("enter /resume %s on another connection to use this session from there as well\r\n", plain)))
+	}
+}
@@ -2,22 +2,38 @@ package server
 
 /*
 	OVERVIEW: Server is the primary package in the application. This performs the majority of the work of the telnet server.
-	It uses a go 'net' listener, the port for this is defined in config.json.
+	It uses a go 'net' listener for every entry of the listeners config, or telnetPort when there are none. tls.go adds telnet over TLS and
+	ssh.go SSH listeners, the unix protocol serves telnet on a unix domain socket for local tooling.
 	There are a total of three files in this package. 1. server.go, 2. chat.go, 3. commands.go
 	server.go is intended to handle communication for the server.
 	chat.go is intended to handle communication for the client.
 	commands.go is intended to handle commands from the client.
+	reload.go reloads the config on SIGHUP and notifies the admins.
+	shutdown.go notifies and closes the sessions when the server shuts down.
+	connections.go counts the sessions and enforces maxClients, maxClientsPerIP and the accept rate.
+	proxy.go reads the PROXY protocol header of connections from a load balancer.
+	resume.go keeps the session of a dropped connection so it can be resumed.
+	ssh.go accepts SSH connections authenticated with public keys and runs the same session on their channel.
+	timeouts.go closes sessions that do not log in or stay idle and probes telnet clients with keepalives.
 	The telnet port
 */
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
-	"log"
+	"io"
 	"net"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"team-cymru-telnet/auth"
 	"team-cymru-telnet/config"
+	"team-cymru-telnet/webhooks"
 	"time"
+
+	"golang.org/x/crypto/ssh"
 )
 
 //Channel used to block the go routines from iterating infinitely without any control and consuming excessive CPU cycles
@@ -36,58 +52,234 @@ var loopController controller = controller{
 	continueLoop: make(chan int),
 }
 
-func Start() {
-	service := fmt.Sprintf(":%s", config.Cfg.TelnetPort)
-	tcpAddr, err := net.ResolveTCPAddr("tcp4", service)
-	config.CheckError(err)
+//Start - accepts connections on every listener of config.ListenerList until ctx is cancelled. call Shutdown afterwards to notify and close
+//the sessions
+func Start(ctx context.Context) {
+	listeners := sync.WaitGroup{}
+	var tlsCfg *tls.Config
+	var sshCfg *ssh.ServerConfig
+	for _, l := range config.Cfg.ListenerList() {
+		var prepare func(net.Conn) (net.Conn, error)
+		switch l.Protocol {
+		case config.ProtocolTelnets:
+			if tlsCfg == nil {
+				//loaded here so a certificate that cannot be used stops the server at start up and not at the first handshake
+				_, _, err := serverCertificates.current()
+				config.CheckError(err)
+				tlsCfg = tlsConfig(serverCertificates)
+			}
+			prepare = func(conn net.Conn) (net.Conn, error) {
+				return acceptTLS(conn, tlsCfg)
+			}
+		case config.ProtocolSSH:
+			if sshCfg == nil {
+				var err error
+				sshCfg, err = sshConfig(config.Cfg.SSHHostKeyFile)
+				config.CheckError(err)
+			}
+			prepare = func(conn net.Conn) (net.Conn, error) {
+				return acceptSSH(conn, sshCfg)
+			}
+		case config.ProtocolUnix:
+			prepare = func(conn net.Conn) (net.Conn, error) {
+				//the peer of a unix socket has no address, the socket path is shown instead
+				return &unixConn{Conn: conn, addr: conn.LocalAddr()}, nil
+			}
+		}
+
+		listener := listen(l)
+		listeners.Add(1)
+		go func(l config.Listener) {
+			defer listeners.Done()
+			serve(ctx, l, listener, prepare)
+		}(l)
+	}
+
+	reloadOnSignal()
+	config.Log("server").Info("chat server has started")
+	listeners.Wait()
+}
+
+//unixConn is a connection accepted on a unix domain socket
+type unixConn struct {
+	net.Conn
+	addr net.Addr
+}
 
-	listener, err := net.ListenTCP("tcp", tcpAddr)
+func (u *unixConn) RemoteAddr() net.Addr {
+	return u.addr
+}
+
+func listen(l config.Listener) net.Listener {
+	network, address := "tcp", net.JoinHostPort(l.Address, l.Port)
+	if l.Protocol == config.ProtocolUnix {
+		network, address = "unix", l.Address
+		//a socket left behind by a server that did not stop cleanly would make the listen fail
+		if info, err := os.Lstat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+
+	//an empty address listens on every interface, IPv4 and IPv6
+	listener, err := net.Listen(network, address)
 	config.CheckError(err)
+	config.Log("server").Info("listening", config.F("listener", l.String()), config.F("protocol", l.Protocol), config.F("address", listener.Addr().String()))
+	return listener
+}
+
+//serve accepts connections until ctx is cancelled. prepare, when set, runs before the session starts, e.g. the TLS handshake. the PROXY
+//header is read before prepare on listeners with proxyProtocol set
+func serve(ctx context.Context, l config.Listener, listener net.Listener, prepare func(net.Conn) (net.Conn, error)) {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
 
-	numClients := 0
-	config.Logs().Info("chat server has started")
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				config.Log("server").Info("listener has stopped accepting connections", config.F("listener", l.String()))
+				return
+			}
 			continue
 		}
-		addr := conn.RemoteAddr()
-		//num clients limits the number of clients BEFORE a user is added to connectedClients
-		numClients++
-
-		if numClients > config.Cfg.MaxClients {
-			conn.Write([]byte("Connection Refused. Too many current clients. Please try again later.\r\n"))
-			config.Logs().Info(fmt.Sprintf("new client %s attempted to connect. connection refused. too many current clients", addr.String()))
-			conn.Close()
+		if prepare == nil && !l.ProxyProtocol {
+			go serveConn(conn, l)
 			continue
 		}
 
-		config.Logs().Info(fmt.Sprintf("new client %s has connected", addr.String()))
+		go func() {
+			prepared, err := conn, error(nil)
+			//the PROXY header comes before anything else, the TLS or SSH handshake included
+			if l.ProxyProtocol {
+				prepared, err = acceptProxy(conn)
+			}
+			addr := conn.RemoteAddr()
+			if err == nil && prepare != nil {
+				addr = prepared.RemoteAddr()
+				prepared, err = prepare(prepared)
+			}
+			if err != nil {
+				config.Log("server").Error("connection failed", config.F("listener", l.String()), config.Remote(addr), config.Err(err))
+				conn.Close()
+				return
+			}
+			serveConn(prepared, l)
+		}()
+	}
+}
+
+//ServeConn - runs the chat session for a connection that has already been established. The listeners and the web terminal all use this
+//so that prompts and commands behave the same regardless of how the client connected
+func ServeConn(conn net.Conn) {
+	serveConn(conn, config.Listener{})
+}
 
-		go handleClient(conn, &numClients)
+//serveConn runs the session of a connection accepted by l. the zero Listener is for connections without one
+func serveConn(conn net.Conn, l config.Listener) {
+	addr := conn.RemoteAddr()
+	untrack := trackSession(conn)
+	if untrack == nil {
+		connections.refuseShuttingDown()
+		conn.Write([]byte("Connection Refused. The server is shutting down.\r\n"))
+		conn.Close()
+		return
+	}
+	defer untrack()
+	name := ""
+	if l.Protocol != "" {
+		name = l.String()
+	}
+	//the session is counted BEFORE a user is added to connectedClients so that clients still choosing a name count towards the limits
+	release, refusal := connections.admit(conn, name, l.MaxClients)
+	if release == nil {
+		conn.Write([]byte(refusal + "\r\n"))
+		config.Log("server").Info("new client was refused", config.Remote(addr), config.F("reason", strings.ToLower(refusal)))
+		conn.Close()
+		return
 	}
+	defer release()
+
+	//every entry about the connection carries its session id and address
+	logs := config.Log("server").With(config.Session(atomic.AddUint64(&sessionIDs, 1)), config.Remote(addr))
+	logs.Info("new client has connected", config.F("listener", name))
+
+	handleClient(conn, logs)
 }
 
-func handleClient(conn net.Conn, numClients *int) {
+//sessionIDs numbers the connections in the logs
+var sessionIDs uint64
+
+func handleClient(conn net.Conn, logs *config.Logger) {
+
 	// close connection on exit
 	defer conn.Close()
 
-	user := User{}
-	mutex := sync.Mutex{}
-	ignoreUserMap := make(map[string]bool)
-	buildIgnoreMap(ignoreUserMap)
-	nameChan := make(chan string, 1)
-	go messageListener(nameChan, ignoreUserMap, &user, conn)
+	//name is the name registered in connectedClients and s its session, see resume.go. a dropped connection detaches the session so it
+	//can be resumed, any other way out ends it
+	name := ""
+	var s *session
+	dropped := false
+	defer func() {
+		if s != nil {
+			s.release(conn, dropped)
+		}
+	}()
+
+	//user is the sender of this connection, a session resumed or joined from here gets its own copy
+	user := &User{}
+	adopt := func(resumed *session) {
+		s, name = resumed, resumed.name
+		user = &User{Name: name}
+	}
 
 	buf := [1024]byte{}
 	line := ""
 
-	conn.Write([]byte("Please enter name\r\n#:"))
+	enableKeepalive(conn)
+	timer := newSessionTimer(conn, time.Now())
+
+	start := func(newName string, authenticated bool) {
+		name = newName
+		user.Name = name
+		ignoreUserMap := make(map[string]bool)
+		buildIgnoreMap(ignoreUserMap)
+		s = newSession(name, conn, &User{Name: name}, ignoreUserMap, authenticated)
+		s.sendToken()
+		go messageListener(s)
+	}
+
+	//users authenticated by their connection, e.g. with a TLS client certificate, are not asked for a name
+	authenticated := authenticatedName(conn)
+	if resumed := resumeByName(authenticated, conn); resumed != nil {
+		adopt(resumed)
+	} else if authenticated != "" {
+		if !AddUniqueClient(authenticated) {
+			logs.Error("user already exists in chat", config.User(authenticated))
+			conn.Write([]byte(fmt.Sprintf("User %s already exists in chat. closing connection\r\n", authenticated)))
+			return
+		}
+		conn.Write([]byte(fmt.Sprintf("authenticated as %s\r\n", authenticated)))
+		start(authenticated, true)
+	} else {
+		conn.Write([]byte("Please enter name\r\n#:"))
+	}
 	for {
-		user.TimeStamp = time.Now().Local().Format(time.Stamp)
+		conn.SetReadDeadline(timer.deadline(name != "", *config.Cfg))
 		n, err := conn.Read(buf[0:])
+		if err != nil && isTimeout(err) && n == 0 {
+			if !handleTimeout(conn, timer, name, logs) {
+				return
+			}
+			continue
+		}
+		user.TimeStamp = time.Now().Local().Format(time.Stamp)
+		timer.activity(time.Now())
 		if err != nil {
-			config.CheckError(err)
+			//a dropped connection (telnet client killed, browser tab closed) must only end this session and not the whole server
+			logs.Error("client read failed", config.User(name), config.Err(err))
+			dropped = true
 			return
 		}
 
@@ -104,71 +296,87 @@ func handleClient(conn net.Conn, numClients *int) {
 		//the below
 		if strings.Contains(buff, "\r\n") { //once return is entered then send the message
 			line = newLineTrim(line)
-			if user.Name == "" {
-				name := line //look for the name first and set it
+			if name == "" {
+				candidate := line //look for the name first and set it
 				line = ""
-				if strings.Contains(name, " ") {
-					config.Logs().Error("Name cannot contain spaces.")
+				if match := resumeCommand.FindStringSubmatch(candidate); match != nil {
+					resumed, err := resumeWithToken(match[1], conn)
+					if err != nil {
+						conn.Write([]byte(fmt.Sprintf("could not resume. %v\r\n#:", err)))
+						conn.Write([]byte("Please enter name\r\n#:"))
+						continue
+					}
+					adopt(resumed)
+					continue
+				}
+				if strings.Contains(candidate, " ") {
+					logs.Warning("Name cannot contain spaces.")
 					conn.Write([]byte("Name cannot contain spaces\r\n#:"))
 					conn.Write([]byte("Please enter name\r\n#:"))
 					continue
 				}
 
-				if !AddUniqueClient(name) {
-					config.Logs().Error(fmt.Sprintf("User, %s, already exists in chat", name))
+				if reserved := reservedName(candidate); reserved != "" {
+					logs.Warning("client attempted to use a reserved name", config.User(candidate), config.F("required", reserved))
+					conn.Write([]byte(fmt.Sprintf("This name requires %s\r\n#:", reserved)))
+					conn.Write([]byte("Please enter name\r\n#:"))
+					continue
+				}
+
+				if !AddUniqueClient(candidate) {
+					logs.Warning("user already exists in chat", config.User(candidate))
 					conn.Write([]byte("User already exists in chat\r\n#:"))
+					if config.Cfg.MultiSession {
+						conn.Write([]byte("to connect as this user from here as well, enter /resume <token> with the token shown to them\r\n#:"))
+					}
 					conn.Write([]byte("Please enter name\r\n#:"))
 					continue
 				}
-				nameChan <- name
-				close(nameChan)
+				start(candidate, false)
 				continue
 			}
 			switch {
 			case Exit(line):
 				conn.Write([]byte("closing connection"))
-				config.Logs().Info(fmt.Sprintf("closing client %s", user.Name))
-
-				//Lock and unlock numClients since we could potentially have one connection exit simultaneously we want to
-				//lock this variable from being modified by multiple threads concurrently
-				mutex.Lock()
-				*numClients--
-				removeClient(user.Name)
-				mutex.Unlock()
+				logs.Info("closing client", config.User(user.Name))
 				return
 			case line == showUsers:
 				displayUsers(conn)
 			case ignore.MatchString(line):
-				//protect the ignoreUserMap variable from potentially reading and writing to ignoreUserMap in the listener
-				mutex.Lock()
-				updateIgnoreMap(ignoreUserMap, line, 1, conn)
-				mutex.Unlock()
+				//the ignore list is shared with the listener and the other connections of the session
+				s.updateIgnored(func(ignoreUserMap map[string]bool) {
+					updateIgnoreMap(ignoreUserMap, line, 1, conn)
+				})
 			case line == unIgnore:
-				mutex.Lock()
-				//protect ignoreUserMap
-				resetIgnoreUserMap(ignoreUserMap)
-				mutex.Unlock()
+				s.updateIgnored(resetIgnoreUserMap)
 				conn.Write([]byte("now allowing messages from all users"))
 			case channel.MatchString(line):
-				updateUserWithChannel(&user, line)
-				SendToChannel(user)
+				updateUserWithChannel(user, line)
+				s.setChannel(user.Channel)
+				SendToChannel(*user)
 				line = ""
 				continue
 			case pm.MatchString(line):
-				updateUserPM(&user, line)
-				sendPM(user)
+				updateUserPM(user, line)
+				sendPM(*user)
 			case subscribe.MatchString(line):
 				addChannel(user.Name, line, 1, conn)
 			case line == unsubscribe:
-				unsubscribeChannels(user)
+				unsubscribeChannels(*user)
 				conn.Write([]byte("ceased subscribing to all channels"))
 			case line == help:
-				displayHelp(conn)
+				displayHelp(user.Name, conn)
+			case searchCommand.MatchString(line):
+				searchHistory(user.Name, line, conn)
+			case token.MatchString(line):
+				tokenCommand(user.Name, line, conn)
+			case sshKey.MatchString(line):
+				sshKeyCommand(user.Name, line, conn)
 			default:
 				// fmt.Println(line)
 				if line != "" {
 					user.Message = line
-					SendBroadcast(user)
+					SendBroadcast(*user)
 					line = ""
 					continue
 				}
@@ -187,13 +395,29 @@ func newLineTrim(line string) string {
 	return line
 }
 
-func pmListener(name string, conn net.Conn) {
+//reservedName is what a user must log in with to use name, e.g. "an SSH key", empty when the name can be entered at the
+//prompt. a key lookup that fails reserves the name, it cannot be told apart from a registered key
+func reservedName(name string) string {
+	if certificateOnly(name) {
+		return "a client certificate"
+	}
+	owner, err := auth.SSHKeyOwner(name)
+	if err != nil {
+		config.Log("server").Error("failed to look up the ssh keys", config.User(name), config.Err(err))
+	}
+	if owner || err != nil {
+		return "an SSH key"
+	}
+	return ""
+}
+
+func pmListener(name string, conn io.Writer) {
 	if value, ok := privateMessage.Load(name); ok {
 		conn.Write([]byte("\r\n" + value.(string) + "\r\n" + name + "#: "))
 	}
 }
 
-func channelListener(user User, conn net.Conn) {
+func channelListener(user User, conn io.Writer) {
 	if user.Channel == 0 {
 		return
 	}
@@ -212,11 +436,12 @@ func channelListener(user User, conn net.Conn) {
 	}
 }
 
-func broadCastListener(name string, ignoreUserMap map[string]bool, conn net.Conn) {
+func broadCastListener(name string, ignoreUserMap map[string]bool, conn io.Writer) {
 	if value, ok := broadCastMessage.Load(name); ok {
 		sender := value.(User)
 		//if the sender of the msg is FALSE in the ignore list then continue and don't print to screen
-		if value := ignoreUserMap[sender.Name]; !value {
+		//senders that are not connected, like the identity of an API token, are never in the ignore list
+		if value, ok := ignoreUserMap[sender.Name]; ok && !value {
 			return
 		}
 		conn.Write([]byte("\r\n" + sender.Message + "\r\n" + name + "#: "))
@@ -225,32 +450,39 @@ func broadCastListener(name string, ignoreUserMap map[string]bool, conn net.Conn
 	}
 }
 
-//function to first grab the name of the user and once received begin listening for chat messages
-func messageListener(nameChan <-chan string, ignoreUserMap map[string]bool, user *User, conn net.Conn) {
-	//if name is empty still then we block until a name is received from the parent thread
-	log.Println("waiting for name...")
-	for user.Name = range nameChan {
-	}
-	config.Logs().Info(fmt.Sprintf("user %s has entered chat...", user.Name))
-	conn.Write([]byte("\r\n" + user.Name + "#: "))
+//announces the user once a name has been entered and begins listening for chat messages until the session ends
+func messageListener(s *session) {
+	config.Log("server").Info("user has entered chat", config.User(s.name))
+	webhooks.Publish(webhooks.Event{Type: webhooks.EventJoin, User: s.name})
+	s.Write([]byte("\r\n" + s.name + "#: "))
 
-	chatListener(ignoreUserMap, user, conn)
+	chatListener(s)
 }
 
-//listens for broadcast chat messages
-func chatListener(ignoreUserMap map[string]bool, user *User, conn net.Conn) {
-	keyCount := keyCounter(ignoreUserMap)
-	//block until a value can be discarded from the channel
-	for range loopController.start {
+//listens for broadcast chat messages and writes them to the session, which buffers the messages while its connections are gone
+func chatListener(s *session) {
+	s.stateMutex.Lock()
+	keyCount := keyCounter(s.ignoreUserMap)
+	s.stateMutex.Unlock()
+	for {
+		//block until a value can be discarded from the channel
+		select {
+		case <-loopController.start:
+		case <-s.stop:
+			return
+		}
+		//the connections of the session change the ignore list and the channel while the listener reads them
+		s.stateMutex.Lock()
 		//client has left chat or new client has joined
 		if keyCount != len(connectedClients) {
-			buildIgnoreMap(ignoreUserMap)
+			buildIgnoreMap(s.ignoreUserMap)
 		}
 
-		broadCastListener(user.Name, ignoreUserMap, conn)
-		channelListener(*user, conn)
-		pmListener(user.Name, conn)
-		keyCount = keyCounter(ignoreUserMap)
+		broadCastListener(s.user.Name, s.ignoreUserMap, s)
+		channelListener(*s.user, s)
+		pmListener(s.user.Name, s)
+		keyCount = keyCounter(s.ignoreUserMap)
+		s.stateMutex.Unlock()
 
 		loopController.done <- 1
 		<-loopController.continueLoop
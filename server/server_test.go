@@ -1,9 +1,21 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
 	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"team-cymru-telnet/auth"
+	"team-cymru-telnet/config"
+	"team-cymru-telnet/db"
 	"testing"
+	"time"
 )
 
 func TestRemoveFromSlice(t *testing.T) {
@@ -47,3 +59,601 @@ string
 		}
 	}
 }
+
+func TestCountdown(t *testing.T) {
+	for grace, expected := range map[int]string{0: "[]", 4: "[4 3 2 1]", 10: "[10 5 3 2 1]", 45: "[45 30 10 5 3 2 1]"} {
+		if marks := fmt.Sprint(countdown(grace)); marks != expected {
+			t.Errorf("countdown(%d) = %s, expected %s", grace, marks, expected)
+		}
+	}
+}
+
+func TestShutdownClosesSessions(t *testing.T) {
+	config.Cfg.LogFile = t.TempDir() + "/ChatServer"
+	config.Cfg.MaxClients = 4
+	config.Cfg.ShutdownGraceSeconds = 0
+	config.Logs()
+	defer atomic.StoreInt32(&shuttingDown, 0)
+
+	serverSide, clientSide := net.Pipe()
+	received := make(chan string)
+	go func() {
+		out, _ := ioutil.ReadAll(clientSide)
+		received <- string(out)
+	}()
+	go ServeConn(serverSide)
+	//wait for the session to be tracked
+	for i := 0; i < 100; i++ {
+		found := false
+		sessions.Range(func(key, value interface{}) bool {
+			found = true
+			return false
+		})
+		if found {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if out := <-received; !strings.Contains(out, "the server has shut down") {
+		t.Fatalf("the session was not told about the shutdown, got %q", out)
+	}
+}
+
+func TestShutdownEndsDetachedSessions(t *testing.T) {
+	config.Cfg.ResumeGraceSeconds = 60
+	config.Cfg.ShutdownGraceSeconds = 0
+	defer func() { config.Cfg.ResumeGraceSeconds = 0 }()
+	config.Logs()
+	defer atomic.StoreInt32(&shuttingDown, 0)
+
+	AddUniqueClient("erin")
+	conn, _ := net.Pipe()
+	s := newSession("erin", conn, &User{Name: "erin"}, map[string]bool{}, false)
+	s.release(conn, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-s.stop:
+	default:
+		t.Fatal("the detached session was not ended")
+	}
+	if untrack := trackSession(conn); untrack != nil {
+		untrack()
+		t.Fatal("a connection was tracked after the shutdown started")
+	}
+}
+
+type testAddr string
+
+func (a testAddr) Network() string { return "tcp" }
+func (a testAddr) String() string  { return string(a) }
+
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (a addrConn) RemoteAddr() net.Addr { return a.addr }
+
+func TestConnectionLimits(t *testing.T) {
+	config.Cfg.MaxClients = 3
+	config.Cfg.MaxClientsPerIP = 2
+	config.Cfg.AcceptRatePerSecond = 0
+	defer func() { config.Cfg.MaxClientsPerIP = 0 }()
+	manager := newConnectionManager()
+	from := func(addr string) net.Conn { return addrConn{addr: testAddr(addr)} }
+
+	first, _ := manager.admit(from("10.0.0.1:1000"), "", 0)
+	second, _ := manager.admit(from("10.0.0.1:1001"), "", 0)
+	if first == nil || second == nil {
+		t.Fatal("connections under the limits were refused")
+	}
+	if release, refusal := manager.admit(from("10.0.0.1:1002"), "", 0); release != nil || !strings.Contains(refusal, "your address") {
+		t.Fatalf("third connection from one address was admitted, refusal %q", refusal)
+	}
+	third, _ := manager.admit(from("10.0.0.2:1000"), "", 0)
+	if release, refusal := manager.admit(from("10.0.0.3:1000"), "", 0); third == nil || release != nil || !strings.Contains(refusal, "current clients") {
+		t.Fatalf("maxClients was not enforced, refusal %q", refusal)
+	}
+
+	first()
+	first()
+	stats := manager.snapshot()
+	if stats.Active != 2 || stats.PerIP["10.0.0.1"] != 1 || stats.Accepted != 3 || stats.RefusedPerIP != 1 || stats.RefusedMaxClients != 1 {
+		t.Fatalf("unexpected stats after release %+v", stats)
+	}
+	second()
+	third()
+	if stats = manager.snapshot(); stats.Active != 0 || len(stats.PerIP) != 0 {
+		t.Fatalf("sessions left after every release %+v", stats)
+	}
+}
+
+func TestListenerLimit(t *testing.T) {
+	config.Cfg.MaxClients = 10
+	config.Cfg.AcceptRatePerSecond = 0
+	manager := newConnectionManager()
+	from := func(addr string) net.Conn { return addrConn{addr: testAddr(addr)} }
+
+	local, _ := manager.admit(from("10.0.0.1:1000"), "telnet 127.0.0.1:23", 1)
+	if release, refusal := manager.admit(from("10.0.0.2:1000"), "telnet 127.0.0.1:23", 1); local == nil || release != nil || refusal == "" {
+		t.Fatal("the maxClients of the listener was not enforced")
+	}
+	public, _ := manager.admit(from("10.0.0.2:1000"), "telnet :2323", 0)
+	web, _ := manager.admit(from("10.0.0.3:1000"), "", 1)
+	if public == nil || web == nil {
+		t.Fatal("the limit of one listener refused connections of another")
+	}
+	stats := manager.snapshot()
+	if stats.RefusedListener != 1 || stats.PerListener["telnet 127.0.0.1:23"] != 1 || stats.PerListener["telnet :2323"] != 1 || len(stats.PerListener) != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	local()
+	if stats = manager.snapshot(); len(stats.PerListener) != 1 {
+		t.Fatalf("the released listener is still counted %+v", stats)
+	}
+}
+
+func TestUnixListener(t *testing.T) {
+	config.Cfg.LogFile = t.TempDir() + "/ChatServer"
+	config.Cfg.MaxClients = 10
+	config.Logs()
+	l := config.Listener{Protocol: config.ProtocolUnix, Address: filepath.Join(t.TempDir(), "chat.sock")}
+	//a socket file left behind must not stop the listener from starting
+	stale, err := net.Listen("unix", l.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener := listen(l)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go serve(ctx, l, listener, func(conn net.Conn) (net.Conn, error) {
+		return &unixConn{Conn: conn, addr: conn.LocalAddr()}, nil
+	})
+
+	conn, err := net.Dial("unix", l.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newPipeClient(conn)
+	client.readUntil(t, "Please enter name")
+	if count := Connections().PerListener[l.String()]; count != 1 {
+		t.Fatalf("the session is not counted for %s, got %d", l.String(), count)
+	}
+	if _, ok := Connections().PerIP[l.Address]; !ok {
+		t.Fatalf("the session is not counted by its socket path %+v", Connections())
+	}
+	conn.Close()
+	for i := 0; Connections().PerListener[l.String()] > 0; i++ {
+		if i == 100 {
+			t.Fatal("the session did not end after the connection closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAcceptRate(t *testing.T) {
+	manager := newConnectionManager()
+	now := time.Unix(0, 0)
+	manager.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if !manager.allowRate(2, 3) {
+			t.Fatalf("connection %d of the burst was refused", i+1)
+		}
+	}
+	if manager.allowRate(2, 3) {
+		t.Fatal("connection over the burst was allowed")
+	}
+	now = now.Add(500 * time.Millisecond)
+	if !manager.allowRate(2, 3) || manager.allowRate(2, 3) {
+		t.Fatal("half a second at 2 per second must allow exactly one connection")
+	}
+	if !manager.allowRate(0, 0) {
+		t.Fatal("a rate of 0 must disable the limit")
+	}
+}
+
+func TestSessionTimer(t *testing.T) {
+	cfg := config.Config{LoginTimeoutSeconds: 30, IdleTimeoutSeconds: 300, IdleWarningSeconds: 60, KeepaliveSeconds: 45}
+	start := time.Unix(1000, 0)
+	timer := &sessionTimer{started: start, lastActivity: start, lastWrite: start, telnet: true}
+
+	if deadline := timer.deadline(false, cfg); !deadline.Equal(start.Add(30 * time.Second)) {
+		t.Fatalf("login deadline %v", deadline)
+	}
+	if action := timer.expired(false, cfg, start.Add(30*time.Second)); action != closeLogin {
+		t.Fatalf("expected the login timeout, got %d", action)
+	}
+
+	if action := timer.expired(true, cfg, start.Add(45*time.Second)); action != sendKeepalive {
+		t.Fatalf("expected a keepalive, got %d", action)
+	}
+	cfg.KeepaliveSeconds = 0
+	if deadline := timer.deadline(true, cfg); !deadline.Equal(start.Add(240 * time.Second)) {
+		t.Fatalf("idle warning deadline %v", deadline)
+	}
+	if action := timer.expired(true, cfg, start.Add(240*time.Second)); action != warnIdle {
+		t.Fatalf("expected the idle warning, got %d", action)
+	}
+	if deadline := timer.deadline(true, cfg); !deadline.Equal(start.Add(300 * time.Second)) {
+		t.Fatalf("idle deadline after the warning %v", deadline)
+	}
+	timer.activity(start.Add(250 * time.Second))
+	if action := timer.expired(true, cfg, start.Add(300*time.Second)); action != noAction {
+		t.Fatalf("activity after the warning must restart the idle timeout, got %d", action)
+	}
+	if action := timer.expired(true, cfg, start.Add(550*time.Second)); action != closeIdle {
+		t.Fatalf("expected the idle timeout, got %d", action)
+	}
+
+	if deadline := (&sessionTimer{}).deadline(true, config.Config{}); !deadline.IsZero() {
+		t.Fatalf("no limits must not set a deadline, got %v", deadline)
+	}
+}
+
+func TestLoginTimeout(t *testing.T) {
+	config.Cfg.LogFile = t.TempDir() + "/ChatServer"
+	config.Cfg.MaxClients = 4
+	config.Cfg.LoginTimeoutSeconds = 1
+	defer func() { config.Cfg.LoginTimeoutSeconds = 0 }()
+	config.Logs()
+
+	serverSide, clientSide := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		ServeConn(serverSide)
+		close(done)
+	}()
+	out, _ := ioutil.ReadAll(clientSide)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session did not end after the login timeout")
+	}
+	if !strings.Contains(string(out), "No name was entered in time") {
+		t.Fatalf("the client was not told about the timeout, got %q", out)
+	}
+}
+
+//pipeClient is the client side of a net.Pipe, or an SSH session, whose output is read in the background, so writes from both sides never
+//block each other
+type pipeClient struct {
+	io.ReadWriteCloser
+	mutex sync.Mutex
+	out   string
+}
+
+func newPipeClient(conn io.ReadWriteCloser) *pipeClient {
+	client := &pipeClient{ReadWriteCloser: conn}
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			client.mutex.Lock()
+			client.out += string(buf[:n])
+			client.mutex.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return client
+}
+
+//readUntil waits until the output contains text and returns the output so far, which is then discarded
+func (c *pipeClient) readUntil(t *testing.T, text string) string {
+	t.Helper()
+	for i := 0; i < 500; i++ {
+		c.mutex.Lock()
+		out := c.out
+		if index := strings.Index(out, text); index >= 0 {
+			c.out = out[index+len(text):]
+			c.mutex.Unlock()
+			return out[:index+len(text)]
+		}
+		c.mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%q not received, got %q", text, c.out)
+	return ""
+}
+
+func TestResumeSession(t *testing.T) {
+	config.Cfg.LogFile = t.TempDir() + "/ChatServer"
+	config.Cfg.MaxClients = 10
+	config.Cfg.ResumeGraceSeconds = 5
+	defer func() { config.Cfg.ResumeGraceSeconds = 0 }()
+	config.Logs()
+	db.Messages = db.NewMemoryStore()
+	//the api registers web, without it a single user has nobody to hear them
+	AddUniqueClient("web")
+	defer removeClient("web")
+
+	serverSide, clientConn := net.Pipe()
+	clientSide := newPipeClient(clientConn)
+	go ServeConn(serverSide)
+	clientSide.readUntil(t, "Please enter name")
+	clientSide.Write([]byte("alice\r\n"))
+	out := clientSide.readUntil(t, "alice#: ")
+	match := regexp.MustCompile(`resume token is ([0-9a-f]+)`).FindStringSubmatch(out)
+	if match == nil {
+		t.Fatalf("no resume token in %q", out)
+	}
+	clientSide.Close()
+
+	value, _ := sessionsByName.Load("alice")
+	s := value.(*session)
+	for i := 0; ; i++ {
+		s.mutex.Lock()
+		detached := len(s.conns) == 0
+		s.mutex.Unlock()
+		if detached {
+			break
+		}
+		if i == 100 {
+			t.Fatal("the session was not detached after the connection dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if AddUniqueClient("alice") {
+		t.Fatal("the name of a detached session was given away")
+	}
+	SendBroadcast(User{Name: "bob", TimeStamp: "Oct 19 12:00:00", Message: "sent while away"})
+
+	serverSide, clientConn = net.Pipe()
+	clientSide = newPipeClient(clientConn)
+	defer clientSide.Close()
+	go ServeConn(serverSide)
+	clientSide.readUntil(t, "Please enter name")
+	clientSide.Write([]byte("/resume deadbeef\r\n"))
+	clientSide.readUntil(t, "unknown or expired resume token")
+	clientSide.Write([]byte("/resume " + match[1] + "\r\n"))
+	out = clientSide.readUntil(t, "sent while away")
+	if !strings.Contains(out, "1 messages arrived while you were away") {
+		t.Fatalf("unexpected resume output %q", out)
+	}
+	clientSide.readUntil(t, "your resume token is")
+	if _, ok := resumeTokens.Load(auth.Hash(match[1])); ok {
+		t.Fatal("the used resume token is still valid")
+	}
+
+	clientSide.Write([]byte("/exit\r\n"))
+	clientSide.readUntil(t, "closing connection")
+	for i := 0; ; i++ {
+		if _, ok := sessionsByName.Load("alice"); !ok {
+			break
+		}
+		if i == 100 {
+			t.Fatal("the session did not end after /exit")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDetachedSessionExpires(t *testing.T) {
+	config.Cfg.ResumeGraceSeconds = 1
+	defer func() { config.Cfg.ResumeGraceSeconds = 0 }()
+	config.Logs()
+
+	AddUniqueClient("dave")
+	conn, _ := net.Pipe()
+	s := newSession("dave", conn, &User{Name: "dave"}, map[string]bool{}, false)
+	s.release(conn, true)
+	s.Write([]byte("missed"))
+	select {
+	case <-s.stop:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the detached session did not expire")
+	}
+	if _, _, err := s.attach(conn); err == nil {
+		t.Fatal("an expired session was resumed")
+	}
+	if !AddUniqueClient("dave") {
+		t.Fatal("the name of an expired session was not freed")
+	}
+	removeClient("dave")
+}
+
+func TestMultiSession(t *testing.T) {
+	config.Cfg.LogFile = t.TempDir() + "/ChatServer"
+	config.Cfg.MaxClients = 10
+	config.Cfg.ResumeGraceSeconds = 5
+	config.Cfg.MultiSession = true
+	defer func() {
+		config.Cfg.ResumeGraceSeconds = 0
+		config.Cfg.MultiSession = false
+	}()
+	config.Logs()
+	db.Messages = db.NewMemoryStore()
+	AddUniqueClient("web")
+	defer removeClient("web")
+
+	serverSide, clientConn := net.Pipe()
+	desktop := newPipeClient(clientConn)
+	defer desktop.Close()
+	go ServeConn(serverSide)
+	desktop.readUntil(t, "Please enter name")
+	desktop.Write([]byte("erin\r\n"))
+	match := regexp.MustCompile(`resume token is ([0-9a-f]+)`).FindStringSubmatch(desktop.readUntil(t, "erin#: "))
+	if match == nil {
+		t.Fatal("no resume token")
+	}
+
+	serverSide, clientConn = net.Pipe()
+	jumpHost := newPipeClient(clientConn)
+	defer jumpHost.Close()
+	go ServeConn(serverSide)
+	jumpHost.readUntil(t, "Please enter name")
+	jumpHost.Write([]byte("erin\r\n"))
+	jumpHost.readUntil(t, "enter /resume <token>")
+	jumpHost.Write([]byte("/resume " + match[1] + "\r\n"))
+	jumpHost.readUntil(t, "you are connected from 2 places")
+	jumpHost.readUntil(t, "erin#: ")
+	jumpHost.Write([]byte("/showusers\r\n"))
+	jumpHost.readUntil(t, "erin (2 sessions)")
+
+	SendBroadcast(User{Name: "bob", TimeStamp: "Oct 19 12:00:00", Message: "hello both"})
+	sendPM(User{Name: "bob", Recipient: "erin", TimeStamp: "Oct 19 12:00:01", Message: "private to erin"})
+	for _, client := range []*pipeClient{desktop, jumpHost} {
+		client.readUntil(t, "hello both")
+		client.readUntil(t, "private to erin")
+	}
+
+	jumpHost.Write([]byte("/quit\r\n"))
+	jumpHost.readUntil(t, "closing connection")
+	value, _ := sessionsByName.Load("erin")
+	s := value.(*session)
+	for i := 0; s.connections() != 1; i++ {
+		if i == 100 {
+			t.Fatalf("/quit on one connection left %d connections", s.connections())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	desktop.Write([]byte("/exit\r\n"))
+	desktop.readUntil(t, "closing connection")
+	select {
+	case <-s.stop:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session did not end when its last connection exited")
+	}
+}
+
+//run with -race: the connections of a session and its listener share the ignore list and the channel
+func TestMultiSessionSharedState(t *testing.T) {
+	config.Cfg.LogFile = t.TempDir() + "/ChatServer"
+	config.Cfg.MaxClients = 10
+	config.Cfg.ResumeGraceSeconds = 5
+	config.Cfg.MultiSession = true
+	defer func() {
+		config.Cfg.ResumeGraceSeconds = 0
+		config.Cfg.MultiSession = false
+	}()
+	config.Logs()
+	db.Messages = db.NewMemoryStore()
+	AddUniqueClient("web")
+	defer removeClient("web")
+
+	serverSide, clientConn := net.Pipe()
+	desktop := newPipeClient(clientConn)
+	defer desktop.Close()
+	go ServeConn(serverSide)
+	desktop.readUntil(t, "Please enter name")
+	desktop.Write([]byte("gina\r\n"))
+	match := regexp.MustCompile(`resume token is ([0-9a-f]+)`).FindStringSubmatch(desktop.readUntil(t, "gina#: "))
+	if match == nil {
+		t.Fatal("no resume token")
+	}
+
+	serverSide, clientConn = net.Pipe()
+	laptop := newPipeClient(clientConn)
+	defer laptop.Close()
+	go ServeConn(serverSide)
+	laptop.readUntil(t, "Please enter name")
+	laptop.Write([]byte("/resume " + match[1] + "\r\n"))
+	laptop.readUntil(t, "you are connected from 2 places")
+
+	commands := map[*pipeClient][]string{
+		desktop: {"/ignore bob", "/pm bob from the desktop", "/channel 3 from the desktop"},
+		laptop:  {"/unignore", "/pm bob from the laptop", "/channel 4 from the laptop"},
+	}
+	wg := sync.WaitGroup{}
+	for client, lines := range commands {
+		wg.Add(1)
+		go func(client *pipeClient, lines []string) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				for _, line := range lines {
+					client.Write([]byte(line + "\r\n"))
+				}
+			}
+		}(client, lines)
+	}
+	for i := 0; i < 20; i++ {
+		SendBroadcast(User{Name: "bob", TimeStamp: "Oct 19 12:00:00", Message: "hello both"})
+	}
+	wg.Wait()
+
+	for _, client := range []*pipeClient{desktop, laptop} {
+		client.Write([]byte("/showusers\r\n"))
+		client.readUntil(t, "gina (2 sessions)")
+	}
+	value, _ := sessionsByName.Load("gina")
+	s := value.(*session)
+	for _, client := range []*pipeClient{desktop, laptop} {
+		client.Write([]byte("/exit\r\n"))
+		client.readUntil(t, "closing connection")
+	}
+	select {
+	case <-s.stop:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session did not end when its last connection exited")
+	}
+}
+
+//authenticatedPipe is a connection authenticated as name, like a TLS client certificate
+type authenticatedPipe struct {
+	net.Conn
+	name string
+}
+
+func (a authenticatedPipe) AuthenticatedName() string { return a.name }
+
+func TestAdminRequiresAuthentication(t *testing.T) {
+	config.Cfg.LogFile = t.TempDir() + "/ChatServer"
+	config.Cfg.MaxClients = 10
+	config.Cfg.Admins = []string{"root"}
+	defer func() { config.Cfg.Admins = nil }()
+	config.Logs()
+	db.Messages = db.NewMemoryStore()
+	AddUniqueClient("web")
+	defer removeClient("web")
+
+	serverSide, clientConn := net.Pipe()
+	typed := newPipeClient(clientConn)
+	go ServeConn(serverSide)
+	typed.readUntil(t, "Please enter name")
+	typed.Write([]byte("root\r\n"))
+	typed.readUntil(t, "root#: ")
+	typed.Write([]byte("/token list\r\n"))
+	typed.readUntil(t, "permission denied")
+	typed.Write([]byte("/sshkey list\r\n"))
+	typed.readUntil(t, "permission denied")
+	typed.Write([]byte("/exit\r\n"))
+	typed.readUntil(t, "closing connection")
+	typed.Close()
+	for i := 0; ; i++ {
+		if _, ok := sessionsByName.Load("root"); !ok {
+			break
+		}
+		if i == 100 {
+			t.Fatal("the session did not end after /exit")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	serverSide, clientConn = net.Pipe()
+	authenticated := newPipeClient(clientConn)
+	defer authenticated.Close()
+	go ServeConn(authenticatedPipe{Conn: serverSide, name: "root"})
+	authenticated.readUntil(t, "root#: ")
+	authenticated.Write([]byte("/token list\r\n"))
+	if out := authenticated.readUntil(t, "root#: "); strings.Contains(out, "permission denied") {
+		t.Fatalf("an authenticated admin was refused, got %q", out)
+	}
+	authenticated.Write([]byte("/exit\r\n"))
+	authenticated.readUntil(t, "closing connection")
+}
@@ -0,0 +1,122 @@
+package server
+
+/*
+	OVERVIEW: Graceful shutdown of the telnet sessions. Once the root context passed to Start is cancelled the listener stops accepting and
+	Shutdown counts down shutdownGraceSeconds, sending shutdownNotice with the time left to every session, so users can finish what they are typing.
+	Messages sent during the countdown are delivered and saved as usual. The sessions are then told the server has shut down and closed,
+	and detached sessions waiting to be resumed are ended. Connections arriving after Shutdown has started are refused.
+*/
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"team-cymru-telnet/config"
+	"time"
+)
+
+//seconds left at which the shutdown notice is repeated
+var countdownMarks = []int{60, 30, 10, 5, 3, 2, 1}
+
+//Shutdown - returns ctx.Err() when the sessions did not close before ctx expired
+func Shutdown(ctx context.Context) error {
+	//under sessionsMutex so no session is added to sessionsWG once Wait may have started
+	sessionsMutex.Lock()
+	atomic.StoreInt32(&shuttingDown, 1)
+	sessionsMutex.Unlock()
+
+	grace := config.Cfg.ShutdownGraceSeconds
+	deadline := time.Now().Add(time.Duration(grace) * time.Second)
+	for _, remaining := range countdown(grace) {
+		if err := sleepUntil(ctx, deadline.Add(-time.Duration(remaining)*time.Second)); err != nil {
+			break
+		}
+		sendSystemNotice(fmt.Sprintf("%s in %d seconds", config.Cfg.ShutdownNotice, remaining))
+	}
+	sleepUntil(ctx, deadline)
+
+	config.Log("server").Info("closing all chat sessions")
+	sessions.Range(func(key, value interface{}) bool {
+		conn := key.(net.Conn)
+		conn.Write([]byte("\r\nthe server has shut down. goodbye\r\n"))
+		conn.Close()
+		return true
+	})
+	//sessions of dropped connections have no connection to close
+	sessionsByName.Range(func(key, value interface{}) bool {
+		if s := value.(*session); s.connections() == 0 {
+			s.end()
+		}
+		return true
+	})
+
+	done := make(chan struct{})
+	go func() {
+		sessionsWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//countdown returns the seconds left at which to send the notice, starting with the full grace period
+func countdown(grace int) []int {
+	if grace <= 0 {
+		return []int{}
+	}
+	marks := []int{grace}
+	for _, mark := range countdownMarks {
+		if mark < grace {
+			marks = append(marks, mark)
+		}
+	}
+	return marks
+}
+
+func sleepUntil(ctx context.Context, t time.Time) error {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//sendSystemNotice delivers a line to every session in the same way a broadcast is delivered, without saving it or sending webhooks
+func sendSystemNotice(text string) {
+	msg := fmt.Sprint("[system] " + time.Now().Local().Format(time.Stamp) + "#: " + text)
+	notice := User{Name: "[system]", Message: msg}
+	for _, client := range connectedClients {
+		broadCastMessage.Store(client.name, notice)
+	}
+	threadController()
+}
+
+//trackSession registers conn so Shutdown can close it. the returned func must be called when the session ends. nil when the server is
+//shutting down and conn must be refused
+func trackSession(conn net.Conn) func() {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	if atomic.LoadInt32(&shuttingDown) == 1 {
+		return nil
+	}
+	sessionsWG.Add(1)
+	sessions.Store(conn, struct{}{})
+	return func() {
+		sessions.Delete(conn)
+		sessionsWG.Done()
+	}
+}
+
+var sessions sync.Map = sync.Map{}
+var sessionsWG sync.WaitGroup
+var sessionsMutex sync.Mutex
+var shuttingDown int32
@@ -0,0 +1,304 @@
+package server
+
+/*
+	OVERVIEW: The SSH listener (sshPort 2222 by default, or the listeners of the ssh protocol). It runs when sshHostKeyFile is set, the host key
+	is generated on first start when the file does not exist. Clients log in with a public key registered for the user they connect as,
+	see auth/sshkeys.go. There are no passwords.
+	The user is authenticated by the key so there is no name prompt, like a TLS client certificate. A name with a key cannot be entered at the prompt. Each connection gets one "session" channel
+	with a shell, exec and subsystems are refused.
+	The channel is handed to handleClient through a net.Pipe, so prompts, commands, timeouts and resuming are the same as for telnet.
+	The telnet client does the line editing and echo for telnet, here the lineDiscipline does it when the client asked for a pty:
+	it echoes what is typed, handles backspace, Ctrl-C clears the line and Ctrl-D on an empty line exits. Without a pty the input is
+	passed on a line at a time. Output has lone newlines turned into CRLF and the padding NUL bytes written by handleClient removed.
+*/
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"team-cymru-telnet/auth"
+	"team-cymru-telnet/config"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//the Permissions extension carrying the user name from the key check to the session
+const sshUserExtension = "chat-user"
+
+//sshConn is the server end of the pipe a chat session over SSH reads and writes. it reports the addresses of the SSH connection
+type sshConn struct {
+	net.Conn
+	name       string
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+func (s *sshConn) AuthenticatedName() string {
+	return s.name
+}
+
+func (s *sshConn) LocalAddr() net.Addr {
+	return s.localAddr
+}
+
+func (s *sshConn) RemoteAddr() net.Addr {
+	return s.remoteAddr
+}
+
+//sshConfig builds the server config with the host key in hostKeyFile, generating the key when the file does not exist
+func sshConfig(hostKeyFile string) (*ssh.ServerConfig, error) {
+	signer, err := hostKey(hostKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint := ssh.FingerprintSHA256(signer.PublicKey())
+	config.Log("server").Info("SSH host key loaded", config.F("fingerprint", fingerprint))
+	sshCfg := &ssh.ServerConfig{PublicKeyCallback: publicKeyUser}
+	sshCfg.AddHostKey(signer)
+	return sshCfg, nil
+}
+
+func hostKey(path string) (ssh.Signer, error) {
+	pemBytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(private)
+		if err != nil {
+			return nil, err
+		}
+		pemBytes = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := ioutil.WriteFile(path, pemBytes, 0600); err != nil {
+			return nil, err
+		}
+		config.Log("server").Info("generated the SSH host key", config.F("path", path))
+	} else if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(pemBytes)
+}
+
+//publicKeyUser accepts a key registered for the user the client connects as
+func publicKeyUser(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	user, err := auth.SSHKeyUser(key)
+	if err != nil {
+		if err != auth.ErrUnknownKey {
+			config.Log("server").Error("could not look up the ssh key", config.User(meta.User()), config.Remote(meta.RemoteAddr()), config.Err(err))
+		}
+		return nil, fmt.Errorf("key %s is not registered", ssh.FingerprintSHA256(key))
+	}
+	if user != meta.User() {
+		return nil, fmt.Errorf("key %s is registered for %s, not %s", ssh.FingerprintSHA256(key), user, meta.User())
+	}
+	return &ssh.Permissions{Extensions: map[string]string{sshUserExtension: user}}, nil
+}
+
+//acceptSSH performs the handshake on a connection accepted by the SSH listener and waits for the client to start a shell
+func acceptSSH(conn net.Conn, sshCfg *ssh.ServerConfig) (net.Conn, error) {
+	enableKeepalive(conn)
+	//covers the handshake and the shell request so a client which stops half way does not hold a goroutine forever
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, sshCfg)
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(requests)
+
+	ready := make(chan net.Conn, 1)
+	closed := make(chan struct{})
+	go func() {
+		handleChannels(serverConn, channels, ready)
+		close(closed)
+	}()
+	select {
+	case prepared := <-ready:
+		conn.SetDeadline(time.Time{})
+		return prepared, nil
+	case <-closed:
+		serverConn.Close()
+		return nil, errors.New("the connection closed before a shell was started")
+	}
+}
+
+//handleChannels accepts the first session channel of the connection and refuses any other
+func handleChannels(serverConn *ssh.ServerConn, channels <-chan ssh.NewChannel, ready chan<- net.Conn) {
+	name := serverConn.Permissions.Extensions[sshUserExtension]
+	accepted := false
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		if accepted {
+			newChannel.Reject(ssh.Prohibited, "one chat session per connection")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		accepted = true
+		shell := make(chan bool, 1)
+		go serveRequests(requests, shell)
+		go func() {
+			pty, ok := <-shell
+			if !ok {
+				channel.Close()
+				return
+			}
+			ready <- bridge(serverConn, channel, pty, name)
+		}()
+	}
+}
+
+//serveRequests answers the requests of the session channel. shell receives whether a pty was requested once the shell starts, and is
+//closed when the channel ends
+func serveRequests(requests <-chan *ssh.Request, shell chan<- bool) {
+	defer close(shell)
+	pty, started := false, false
+	for req := range requests {
+		ok := false
+		switch req.Type {
+		case "pty-req":
+			pty, ok = true, true
+		case "window-change", "env":
+			ok = true
+		case "shell":
+			ok = !started
+		}
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+		if req.Type == "shell" && ok {
+			started = true
+			shell <- pty
+		}
+	}
+}
+
+//bridge connects the channel to a pipe and returns the end handleClient uses. the session reads io.EOF, and detaches, when the client goes
+//away, and the SSH connection is closed when the session closes its end
+func bridge(serverConn *ssh.ServerConn, channel ssh.Channel, pty bool, name string) net.Conn {
+	local, remote := net.Pipe()
+	discipline := &lineDiscipline{pty: pty, echo: channel}
+	go func() {
+		defer remote.Close()
+		buf := make([]byte, 1024)
+		for {
+			n, err := channel.Read(buf)
+			if input := discipline.input(buf[:n]); len(input) > 0 {
+				if _, err := remote.Write(input); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer serverConn.Close()
+		io.Copy(&terminalWriter{w: channel}, remote)
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+		channel.Close()
+	}()
+	return &sshConn{Conn: local, name: name, localAddr: serverConn.LocalAddr(), remoteAddr: serverConn.RemoteAddr()}
+}
+
+//lineDiscipline turns what the SSH client sends into the CRLF terminated lines handleClient expects
+type lineDiscipline struct {
+	pty  bool
+	echo io.Writer
+	line []byte
+	//escape is 1 after ESC and 2 inside a control sequence, e.g. the arrow keys. those are dropped
+	escape int
+	lastCR bool
+}
+
+//input returns the complete lines in p, with the line currently typed kept back
+func (l *lineDiscipline) input(p []byte) []byte {
+	out := []byte{}
+	echo := []byte{}
+	for _, b := range p {
+		cr := b == '\r'
+		switch {
+		case l.escape == 1:
+			l.escape = 0
+			if b == '[' || b == 'O' {
+				l.escape = 2
+			}
+		case l.escape == 2:
+			if b >= 0x40 && b <= 0x7e {
+				l.escape = 0
+			}
+		case b == 0x1b:
+			l.escape = 1
+		case b == '\n' && l.lastCR:
+		case b == '\r' || b == '\n':
+			out = append(append(out, l.line...), '\r', '\n')
+			l.line = l.line[:0]
+			echo = append(echo, '\r', '\n')
+		case !l.pty:
+			l.line = append(l.line, b)
+		case b == 0x7f || b == '\b':
+			if len(l.line) > 0 {
+				_, size := utf8.DecodeLastRune(l.line)
+				l.line = l.line[:len(l.line)-size]
+				echo = append(echo, "\b \b"...)
+			}
+		case b == 0x03:
+			l.line = l.line[:0]
+			echo = append(echo, "^C\r\n"...)
+		case b == 0x04:
+			if len(l.line) == 0 {
+				out = append(out, exit+"\r\n"...)
+			}
+		case b < 0x20:
+		default:
+			l.line = append(l.line, b)
+			echo = append(echo, b)
+		}
+		l.lastCR = cr
+	}
+	if l.pty && len(echo) > 0 {
+		l.echo.Write(echo)
+	}
+	return out
+}
+
+//terminalWriter writes the session output with lone newlines turned into CRLF and NUL bytes removed
+type terminalWriter struct {
+	w      io.Writer
+	lastCR bool
+}
+
+func (t *terminalWriter) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p))
+	for _, b := range p {
+		if b == 0 {
+			continue
+		}
+		if b == '\n' && !t.lastCR {
+			out = append(out, '\r')
+		}
+		out = append(out, b)
+		t.lastCR = b == '\r'
+	}
+	if len(out) > 0 {
+		if _, err := t.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"team-cymru-telnet/config"
+	"team-cymru-telnet/db"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//sshShell is a shell session of an in-process SSH client
+type sshShell struct {
+	io.Reader
+	io.WriteCloser
+	session *ssh.Session
+	client  *ssh.Client
+}
+
+func (s *sshShell) Close() error {
+	s.session.Close()
+	return s.client.Close()
+}
+
+func dialSSH(t *testing.T, addr string, user string, signer ssh.Signer, pty bool) (*sshShell, error) {
+	t.Helper()
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pty {
+		if err := session.RequestPty("xterm", 24, 80, ssh.TerminalModes{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stdin, _ := session.StdinPipe()
+	stdout, _ := session.StdoutPipe()
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	return &sshShell{Reader: stdout, WriteCloser: stdin, session: session, client: client}, nil
+}
+
+func TestSSHListener(t *testing.T) {
+	dir := t.TempDir()
+	config.Cfg.LogFile = filepath.Join(dir, "ChatServer")
+	config.Cfg.MaxClients = 10
+	config.Logs()
+	db.Messages = db.NewMemoryStore()
+	AddUniqueClient("web")
+	defer removeClient("web")
+
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := ssh.NewSignerFromKey(private)
+	sshPublic, _ := ssh.NewPublicKey(public)
+	config.Cfg.SSHAuthorizedKeysFile = filepath.Join(dir, "authorized_keys")
+	defer func() { config.Cfg.SSHAuthorizedKeysFile = "" }()
+	authorized := "# chat users\n" + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPublic))) + " frank\n"
+	if err := ioutil.WriteFile(config.Cfg.SSHAuthorizedKeysFile, []byte(authorized), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	hostKeyFile := filepath.Join(dir, "ssh_host_key")
+	sshCfg, err := sshConfig(hostKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(hostKeyFile); err != nil {
+		t.Fatalf("the host key was not generated. %v", err)
+	}
+	generated, _ := hostKey(hostKeyFile)
+	loaded, _ := hostKey(hostKeyFile)
+	if ssh.FingerprintSHA256(generated.PublicKey()) != ssh.FingerprintSHA256(loaded.PublicKey()) {
+		t.Fatal("the host key changed although the file exists")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go serve(ctx, config.Listener{Protocol: config.ProtocolSSH}, listener, func(conn net.Conn) (net.Conn, error) {
+		return acceptSSH(conn, sshCfg)
+	})
+	addr := listener.Addr().String()
+
+	if _, err := dialSSH(t, addr, "mallory", signer, true); err == nil {
+		t.Fatal("the key of frank logged in as mallory")
+	}
+
+	//the name of a key owner cannot be typed at the telnet prompt
+	serverSide, clientConn := net.Pipe()
+	impostor := newPipeClient(clientConn)
+	served := make(chan struct{})
+	go func() {
+		ServeConn(serverSide)
+		close(served)
+	}()
+	impostor.readUntil(t, "Please enter name")
+	impostor.Write([]byte("frank\r\n"))
+	impostor.readUntil(t, "This name requires an SSH key")
+	impostor.readUntil(t, "Please enter name")
+	impostor.Close()
+	<-served
+
+	shell, err := dialSSH(t, addr, "frank", signer, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shell.Close()
+	frank := newPipeClient(shell)
+	frank.readUntil(t, "authenticated as frank")
+	frank.readUntil(t, "frank#: ")
+
+	frank.Write([]byte("/helq\x7fp\r"))
+	out := frank.readUntil(t, "/help: displays this information")
+	if !strings.Contains(out, "/helq\b \bp\r\n") {
+		t.Fatalf("the typed line was not echoed and edited, got %q", out)
+	}
+	if strings.Contains(out, "\x00") {
+		t.Fatalf("NUL bytes were written to the SSH client, got %q", out)
+	}
+	if value, ok := sessionsByName.Load("frank"); !ok || value.(*session).connections() != 1 {
+		t.Fatal("frank has no chat session")
+	}
+
+	frank.Write([]byte("\x04"))
+	frank.readUntil(t, "closing connection")
+	if err := shell.session.Wait(); err != nil {
+		t.Fatalf("the shell did not exit cleanly. %v", err)
+	}
+	for i := 0; ; i++ {
+		if _, ok := sessionsByName.Load("frank"); !ok {
+			break
+		}
+		if i == 100 {
+			t.Fatal("the session did not end after Ctrl-D")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLineDiscipline(t *testing.T) {
+	for _, test := range []struct {
+		pty      bool
+		input    []string
+		expected string
+		echoed   string
+	}{
+		{pty: true, input: []string{"hel", "lo\r"}, expected: "hello\r\n", echoed: "hello\r\n"},
+		{pty: true, input: []string{"ab\x7f\x7f\x7fc\r"}, expected: "c\r\n", echoed: "ab\b \b\b \bc\r\n"},
+		{pty: true, input: []string{"caf\xc3\xa9\x7f\r"}, expected: "caf\r\n", echoed: "caf\xc3\xa9\b \b\r\n"},
+		{pty: true, input: []string{"x\x1b[A\x1b[1;5Dy\r\n"}, expected: "xy\r\n", echoed: "xy\r\n"},
+		{pty: true, input: []string{"oops\x03", "\x04"}, expected: "/exit\r\n", echoed: "oops^C\r\n"},
+		{pty: false, input: []string{"/pm bob hi\n/help\n"}, expected: "/pm bob hi\r\n/help\r\n"},
+		{pty: false, input: []string{"one\r\ntw", "o\r\n"}, expected: "one\r\ntwo\r\n"},
+	} {
+		echo := &strings.Builder{}
+		discipline := &lineDiscipline{pty: test.pty, echo: echo}
+		out := ""
+		for _, input := range test.input {
+			out += string(discipline.input([]byte(input)))
+		}
+		if out != test.expected || echo.String() != test.echoed {
+			t.Errorf("input %q: expected %q echoing %q, got %q echoing %q", test.input, test.expected, test.echoed, out, echo.String())
+		}
+	}
+}
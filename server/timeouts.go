@@ -0,0 +1,154 @@
+package server
+
+/*
+	OVERVIEW: Timeouts of the telnet sessions, so a dead or silent peer does not keep its name reserved forever.
+	loginTimeoutSeconds: a connection that has not entered a name in time is closed.
+	idleTimeoutSeconds: a named session that sends nothing for this long is closed. idleWarningSeconds before that the user is warned,
+	anything typed afterwards, even a single character, counts as activity again. 0 disables the idle timeout.
+	keepaliveSeconds: the TCP keepalive period of telnet connections, which makes the read of a dead peer fail, and the interval of the
+	telnet NOP (IAC NOP) written to the session, which does the same for peers behind a NAT or proxy that answers the TCP keepalives.
+	NOP is only sent to telnet clients, the web terminal would show it. 0 disables both.
+	The limits are read from config.Cfg before every read so a reload applies them to the running sessions.
+*/
+
+import (
+	"fmt"
+	"net"
+	"team-cymru-telnet/config"
+	"time"
+)
+
+//telnet IAC NOP, ignored by telnet clients
+var telnetNOP = []byte{255, 241}
+
+//sessionTimer decides how long the next read of a session may block and what to do when it times out
+type sessionTimer struct {
+	started      time.Time
+	lastActivity time.Time
+	lastWrite    time.Time
+	warned       bool
+	telnet       bool
+}
+
+func newSessionTimer(conn net.Conn, now time.Time) *sessionTimer {
+	return &sessionTimer{started: now, lastActivity: now, lastWrite: now, telnet: isTelnet(conn)}
+}
+
+//timeoutAction is what a session does when its read deadline passes
+type timeoutAction int
+
+const (
+	noAction timeoutAction = iota
+	sendKeepalive
+	warnIdle
+	closeLogin
+	closeIdle
+)
+
+//activity is called whenever the client sends something
+func (s *sessionTimer) activity(now time.Time) {
+	s.lastActivity = now
+	s.warned = false
+}
+
+//deadline returns the next time the session needs attention, the zero time when no limit applies
+func (s *sessionTimer) deadline(loggedIn bool, cfg config.Config) time.Time {
+	next := time.Time{}
+	earliest := func(t time.Time) {
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+
+	if !loggedIn && cfg.LoginTimeoutSeconds > 0 {
+		earliest(s.started.Add(seconds(cfg.LoginTimeoutSeconds)))
+	}
+	if loggedIn && cfg.IdleTimeoutSeconds > 0 {
+		closeAt := s.lastActivity.Add(seconds(cfg.IdleTimeoutSeconds))
+		if !s.warned && cfg.IdleWarningSeconds > 0 && cfg.IdleWarningSeconds < cfg.IdleTimeoutSeconds {
+			earliest(closeAt.Add(-seconds(cfg.IdleWarningSeconds)))
+		} else {
+			earliest(closeAt)
+		}
+	}
+	if s.telnet && cfg.KeepaliveSeconds > 0 {
+		earliest(s.lastWrite.Add(seconds(cfg.KeepaliveSeconds)))
+	}
+	return next
+}
+
+//expired returns the most important action that is due at now
+func (s *sessionTimer) expired(loggedIn bool, cfg config.Config, now time.Time) timeoutAction {
+	if !loggedIn && cfg.LoginTimeoutSeconds > 0 && !now.Before(s.started.Add(seconds(cfg.LoginTimeoutSeconds))) {
+		return closeLogin
+	}
+	if loggedIn && cfg.IdleTimeoutSeconds > 0 {
+		closeAt := s.lastActivity.Add(seconds(cfg.IdleTimeoutSeconds))
+		if !now.Before(closeAt) {
+			return closeIdle
+		}
+		if !s.warned && cfg.IdleWarningSeconds > 0 && !now.Before(closeAt.Add(-seconds(cfg.IdleWarningSeconds))) {
+			s.warned = true
+			return warnIdle
+		}
+	}
+	if s.telnet && cfg.KeepaliveSeconds > 0 && !now.Before(s.lastWrite.Add(seconds(cfg.KeepaliveSeconds))) {
+		s.lastWrite = now
+		return sendKeepalive
+	}
+	return noAction
+}
+
+//handleTimeout performs the action due after a read timed out. it returns false when the session has to end
+func handleTimeout(conn net.Conn, timer *sessionTimer, name string, logs *config.Logger) bool {
+	switch timer.expired(name != "", *config.Cfg, time.Now()) {
+	case closeLogin:
+		conn.Write([]byte("\r\nNo name was entered in time. closing connection\r\n"))
+		logs.Info("client did not enter a name in time, closing connection", config.F("seconds", config.Cfg.LoginTimeoutSeconds))
+		return false
+	case closeIdle:
+		conn.Write([]byte("\r\nYou have been idle for too long. closing connection\r\n"))
+		logs.Info("client was idle for too long, closing connection", config.User(name), config.F("seconds", config.Cfg.IdleTimeoutSeconds))
+		return false
+	case warnIdle:
+		conn.Write([]byte(fmt.Sprintf("\r\nYou will be disconnected in %d seconds unless you type something\r\n%s#: ", config.Cfg.IdleWarningSeconds, name)))
+	case sendKeepalive:
+		if _, err := conn.Write(telnetNOP); err != nil {
+			logs.Error("client keepalive failed", config.Err(err))
+			return false
+		}
+	}
+	return true
+}
+
+//enableKeepalive turns on TCP keepalive probes for telnet connections
+func enableKeepalive(conn net.Conn) {
+	if proxied, ok := conn.(*proxyConn); ok {
+		conn = proxied.Conn
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok || config.Cfg.KeepaliveSeconds <= 0 {
+		return
+	}
+	tcp.SetKeepAlive(true)
+	tcp.SetKeepAlivePeriod(seconds(config.Cfg.KeepaliveSeconds))
+}
+
+//isTelnet is true for connections from a telnet client, plain, over TLS or through a load balancer, as opposed to the web terminal
+func isTelnet(conn net.Conn) bool {
+	switch conn.(type) {
+	case *net.TCPConn, *tlsConn, *proxyConn:
+		return true
+	}
+	return false
+}
+
+//isTimeout is true for the error of a read whose deadline passed
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func seconds(n int) time.Duration {
+	return time.Duration(n) * time.Second
+}
@@ -0,0 +1,177 @@
+package server
+
+/*
+	OVERVIEW: Telnet over TLS (telnets, tlsPort 992 by default). The listener runs next to the plain one when tlsCertFile and tlsKeyFile are set,
+	an empty telnetPort turns the plain one off. With the listeners config every listener of the telnets protocol uses these certificates.
+	The certificate, key and client CA files are checked before every handshake and loaded again when they changed or were replaced in the
+	config, so a renewed certificate is used without a restart. When the new files cannot be loaded the previous ones stay in use.
+	With tlsClientCAFile set clients may present a certificate signed by one of those CAs, with tlsRequireClientCert they must.
+	A verified client certificate logs the user in without a name prompt: the name is the tlsClientUsers entry of the certificate's common name,
+	or the common name itself. Names listed in tlsClientUsers cannot be taken by connections without the certificate.
+*/
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"team-cymru-telnet/config"
+	"time"
+)
+
+//time allowed for the TLS handshake, so a client which connects and sends nothing does not hold a goroutine forever
+const handshakeTimeout = 10 * time.Second
+
+//tlsConn is a telnet connection over TLS. name is the user name of its verified client certificate, empty without one
+type tlsConn struct {
+	*tls.Conn
+	name string
+}
+
+func (t *tlsConn) AuthenticatedName() string {
+	return t.name
+}
+
+//fileVersion identifies the content a certificate was loaded from
+type fileVersion struct {
+	path    string
+	modTime time.Time
+}
+
+//certificates is the server certificate and client CA pool of the TLS listener
+type certificates struct {
+	mutex      sync.Mutex
+	loadedFrom []fileVersion
+	cert       *tls.Certificate
+	clientCAs  *x509.CertPool
+}
+
+var serverCertificates = &certificates{}
+
+//versions stats the configured files. a missing file has the zero time so it counts as a change once it appears
+func versions(cfg config.Config) []fileVersion {
+	list := []fileVersion{}
+	for _, path := range []string{cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSClientCAFile} {
+		version := fileVersion{path: path}
+		if info, err := os.Stat(path); path != "" && err == nil {
+			version.modTime = info.ModTime()
+		}
+		list = append(list, version)
+	}
+	return list
+}
+
+//current returns the certificate and client CAs, loading them again when the files changed
+func (c *certificates) current() (*tls.Certificate, *x509.CertPool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	cfg := *config.Cfg
+	files := versions(cfg)
+	if c.cert != nil && sameVersions(files, c.loadedFrom) {
+		return c.cert, c.clientCAs, nil
+	}
+	//remembered even when loading fails so a broken file is reported once and not on every handshake
+	c.loadedFrom = files
+
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err == nil && cfg.TLSClientCAFile != "" {
+		var pool *x509.CertPool
+		if pool, err = config.LoadCertPool(cfg.TLSClientCAFile); err == nil {
+			c.clientCAs = pool
+		}
+	} else if err == nil {
+		c.clientCAs = nil
+	}
+	if err != nil {
+		if c.cert == nil {
+			return nil, nil, err
+		}
+		config.Log("server").Error("could not load the TLS certificates, the previous ones stay in use", config.F("cert", cfg.TLSCertFile), config.Err(err))
+		return c.cert, c.clientCAs, nil
+	}
+	if c.cert != nil {
+		config.Log("server").Info("TLS certificate reloaded", config.F("cert", cfg.TLSCertFile))
+	}
+	c.cert = &cert
+	return c.cert, c.clientCAs, nil
+}
+
+func sameVersions(a []fileVersion, b []fileVersion) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].path != b[i].path || !a[i].modTime.Equal(b[i].modTime) {
+			return false
+		}
+	}
+	return true
+}
+
+//tlsConfig builds the config of every handshake from the current certificates and settings
+func tlsConfig(certs *certificates) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, clientCAs, err := certs.current()
+			if err != nil {
+				return nil, err
+			}
+			clientAuth := tls.NoClientCert
+			if clientCAs != nil {
+				clientAuth = tls.VerifyClientCertIfGiven
+				if config.Cfg.TLSRequireClientCert {
+					clientAuth = tls.RequireAndVerifyClientCert
+				}
+			}
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				ClientCAs:    clientCAs,
+				ClientAuth:   clientAuth,
+			}, nil
+		},
+	}
+}
+
+//acceptTLS performs the handshake on a connection accepted by the TLS listener
+func acceptTLS(conn net.Conn, tlsCfg *tls.Config) (net.Conn, error) {
+	enableKeepalive(conn)
+	secure := tls.Server(conn, tlsCfg)
+	secure.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := secure.Handshake(); err != nil {
+		return nil, err
+	}
+	secure.SetDeadline(time.Time{})
+	return &tlsConn{Conn: secure, name: certificateUser(secure.ConnectionState())}, nil
+}
+
+//certificateUser is the user name of a verified client certificate
+func certificateUser(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	commonName := state.PeerCertificates[0].Subject.CommonName
+	name, ok := config.Cfg.TLSClientUsers[commonName]
+	if !ok {
+		name = commonName
+	}
+	if name == "" || strings.ContainsAny(name, " \t") {
+		config.Log("server").Error("client certificate does not map to a valid user name, continuing without it", config.F("common_name", commonName))
+		return ""
+	}
+	return name
+}
+
+//certificateOnly is true for names which are reserved for a client certificate
+func certificateOnly(name string) bool {
+	for _, user := range config.Cfg.TLSClientUsers {
+		if user == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"team-cymru-telnet/config"
+	"testing"
+	"time"
+)
+
+//issue creates a certificate for commonName signed by parent, or self signed when parent is nil
+func issue(t *testing.T, commonName string, serial int64, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent, parentKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeFile(t *testing.T, path string, body []byte, modTime time.Time) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, body, 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, modTime, modTime)
+}
+
+func TestTLSListener(t *testing.T) {
+	dir := t.TempDir()
+	config.Cfg.LogFile = filepath.Join(dir, "ChatServer")
+	config.Logs()
+
+	ca, caKey, caPEM, _ := issue(t, "chat ca", 1, nil, nil)
+	_, _, serverPEM, serverKeyPEM := issue(t, "chat server", 2, ca, caKey)
+	_, _, clientPEM, clientKeyPEM := issue(t, "frank", 3, ca, caKey)
+	clientCert, _ := tls.X509KeyPair(clientPEM, clientKeyPEM)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	stamp := time.Now().Add(-time.Minute)
+	config.Cfg.TLSCertFile = filepath.Join(dir, "cert.pem")
+	config.Cfg.TLSKeyFile = filepath.Join(dir, "key.pem")
+	config.Cfg.TLSClientCAFile = filepath.Join(dir, "ca.pem")
+	config.Cfg.TLSClientUsers = map[string]string{"frank": "francis"}
+	defer func() {
+		config.Cfg.TLSCertFile, config.Cfg.TLSKeyFile, config.Cfg.TLSClientCAFile = "", "", ""
+		config.Cfg.TLSRequireClientCert = false
+		config.Cfg.TLSClientUsers = nil
+	}()
+	writeFile(t, config.Cfg.TLSCertFile, serverPEM, stamp)
+	writeFile(t, config.Cfg.TLSKeyFile, serverKeyPEM, stamp)
+	writeFile(t, config.Cfg.TLSClientCAFile, caPEM, stamp)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	tlsCfg := tlsConfig(&certificates{})
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			prepared, err := acceptTLS(conn, tlsCfg)
+			if err != nil {
+				conn.Close()
+				prepared = nil
+			}
+			accepted <- prepared
+		}
+	}()
+
+	dial := func(certs []tls.Certificate) (*tls.Conn, net.Conn) {
+		client, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: roots, Certificates: certs})
+		served := <-accepted
+		if err != nil {
+			return nil, served
+		}
+		return client, served
+	}
+
+	client, served := dial([]tls.Certificate{clientCert})
+	if client == nil || served == nil {
+		t.Fatal("handshake with a client certificate failed")
+	}
+	if name := authenticatedName(served); name != "francis" {
+		t.Fatalf("client certificate frank mapped to %q, expected francis", name)
+	}
+	if !isTelnet(served) {
+		t.Fatal("a TLS connection must be treated as a telnet client")
+	}
+	client.Close()
+
+	client, served = dial(nil)
+	if client == nil || authenticatedName(served) != "" {
+		t.Fatal("a client without a certificate must connect anonymously")
+	}
+	client.Close()
+
+	_, _, renewedPEM, renewedKeyPEM := issue(t, "chat server", 4, ca, caKey)
+	writeFile(t, config.Cfg.TLSCertFile, renewedPEM, stamp.Add(time.Second))
+	writeFile(t, config.Cfg.TLSKeyFile, renewedKeyPEM, stamp.Add(time.Second))
+	client, _ = dial(nil)
+	if client == nil {
+		t.Fatal("handshake after the certificate was renewed failed")
+	}
+	if serial := client.ConnectionState().PeerCertificates[0].SerialNumber.Int64(); serial != 4 {
+		t.Fatalf("the renewed certificate was not loaded, served serial %d", serial)
+	}
+	client.Close()
+
+	config.Cfg.TLSRequireClientCert = true
+	if client, served = dial(nil); served != nil {
+		t.Fatal("a client without a certificate was accepted although one is required")
+	}
+	if client != nil {
+		client.Close()
+	}
+}
@@ -0,0 +1,407 @@
+package webhooks
+
+/*
+	OVERVIEW: Outgoing webhooks. The server calls Publish() whenever a message is sent or a user joins or leaves the chat.
+	Publish never blocks the sender, not even on the database. Every matching subscription gets a job on a bounded queue, the workers save its
+	delivery record and POST the JSON payload signed with the subscription secret (X-Chat-Signature: sha256=<hex HMAC-SHA256 of the body>).
+	Failed deliveries are retried with exponential backoff. Once MaxAttempts is reached the delivery is marked dead and is kept as the dead letter record.
+	When the queue is full the delivery is marked dead straight away. Deliveries still pending or retrying at a restart are queued again by Start.
+	Private messages are never sent to webhooks.
+*/
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"team-cymru-telnet/config"
+	"team-cymru-telnet/db"
+	"team-cymru-telnet/models/webhook"
+	"time"
+)
+
+//event types a subscription can listen for
+const (
+	EventMessage = "message"
+	EventJoin    = "join"
+	EventLeave   = "leave"
+	EventKeyword = "keyword"
+)
+
+var validEvents []string = []string{EventMessage, EventJoin, EventLeave, EventKeyword}
+
+type Event struct {
+	Type        string    `json:"event"`
+	User        string    `json:"user"`
+	Channel     int       `json:"channel,omitempty"`
+	Message     string    `json:"message,omitempty"`
+	MessageType string    `json:"message_type,omitempty"`
+	Keyword     string    `json:"keyword,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+type job struct {
+	subscription webhook.Subscription
+	delivery     *webhook.Delivery
+}
+
+type Dispatcher struct {
+	Client      *http.Client
+	MaxAttempts int
+	//delay before the first retry, doubled after every failed attempt up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	queue         chan job
+	mutex         sync.RWMutex
+	subscriptions []webhook.Subscription
+	//save persists a delivery record. it is replaced in tests so no database is needed
+	save func(*webhook.Delivery) error
+}
+
+func NewDispatcher(workers int, queueSize int) *Dispatcher {
+	d := &Dispatcher{
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		MaxAttempts: 6,
+		Backoff:     time.Second,
+		MaxBackoff:  5 * time.Minute,
+		queue:       make(chan job, queueSize),
+		save:        saveDelivery,
+	}
+	for i := 0; i < workers; i++ {
+		go d.worker()
+	}
+	return d
+}
+
+//SetSubscriptions - replaces the subscriptions events are matched against
+func (d *Dispatcher) SetSubscriptions(subscriptions []webhook.Subscription) {
+	d.mutex.Lock()
+	d.subscriptions = subscriptions
+	d.mutex.Unlock()
+}
+
+//Publish - queues a delivery for every subscription interested in the event. keyword events are generated here for message events
+func (d *Dispatcher) Publish(event Event) {
+	if event.MessageType == "pm" {
+		return
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+
+	d.mutex.RLock()
+	subscriptions := d.subscriptions
+	d.mutex.RUnlock()
+
+	for _, sub := range subscriptions {
+		if event.Type == EventMessage && sub.Channel.Valid && int64(event.Channel) != sub.Channel.Int64 {
+			continue
+		}
+		if subscribed(sub, event.Type) {
+			d.enqueue(sub, event)
+		}
+		if event.Type == EventMessage && subscribed(sub, EventKeyword) {
+			if keyword := matchKeyword(sub, event.Message); keyword != "" {
+				keywordEvent := event
+				keywordEvent.Type = EventKeyword
+				keywordEvent.Keyword = keyword
+				d.enqueue(sub, keywordEvent)
+			}
+		}
+	}
+}
+
+func (d *Dispatcher) enqueue(sub webhook.Subscription, event Event) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		config.Log("webhooks").Error("failed to encode webhook event", config.F("event", event.Type), config.Err(err))
+		return
+	}
+	delivery := &webhook.Delivery{
+		SubscriptionID: sub.ID,
+		Event:          event.Type,
+		Payload:        string(payload),
+		Status:         webhook.StatusPending,
+	}
+	//the worker saves the record, the sender does not wait for the database
+	d.offer(job{subscription: sub, delivery: delivery})
+}
+
+//offer queues j without blocking. a full queue means the receivers are far behind, the delivery goes straight to the dead letter record
+//instead of holding up the chat or piling up retries
+func (d *Dispatcher) offer(j job) {
+	select {
+	case d.queue <- j:
+	default:
+		j.delivery.Status = webhook.StatusDead
+		j.delivery.LastError = "delivery queue is full"
+		config.Log("webhooks").Error("webhook queue is full, delivery dropped", config.F("event", j.delivery.Event), config.F("subscription", j.subscription.ID))
+		//offer runs on the sender's goroutine
+		go d.record(j.delivery)
+	}
+}
+
+//resume queues the deliveries which were pending or retrying when the server stopped. it blocks until they are queued
+func (d *Dispatcher) resume(deliveries []webhook.Delivery) {
+	d.mutex.RLock()
+	subscriptions := d.subscriptions
+	d.mutex.RUnlock()
+
+	for i := range deliveries {
+		delivery := &deliveries[i]
+		sub, ok := findSubscription(subscriptions, delivery.SubscriptionID)
+		if !ok {
+			delivery.Status = webhook.StatusDead
+			delivery.LastError = "the subscription has been deleted"
+			d.record(delivery)
+			continue
+		}
+		d.queue <- job{subscription: sub, delivery: delivery}
+	}
+}
+
+func findSubscription(subscriptions []webhook.Subscription, id int) (webhook.Subscription, bool) {
+	for _, sub := range subscriptions {
+		if sub.ID == id {
+			return sub, true
+		}
+	}
+	return webhook.Subscription{}, false
+}
+
+func (d *Dispatcher) worker() {
+	for j := range d.queue {
+		d.attempt(j)
+	}
+}
+
+func (d *Dispatcher) attempt(j job) {
+	if j.delivery.ID == 0 {
+		//saved before the first attempt so the receiver gets the delivery id
+		d.record(j.delivery)
+	}
+	j.delivery.Attempts++
+	code, err := d.post(j.subscription, j.delivery)
+	j.delivery.ResponseCode = code
+
+	if err == nil {
+		j.delivery.Status = webhook.StatusDelivered
+		j.delivery.LastError = ""
+		d.record(j.delivery)
+		return
+	}
+
+	j.delivery.LastError = err.Error()
+	if j.delivery.Attempts >= d.MaxAttempts {
+		j.delivery.Status = webhook.StatusDead
+		config.Log("webhooks").Error("webhook delivery failed after the last attempt", config.F("delivery", j.delivery.ID), config.F("subscription", j.subscription.ID), config.F("url", j.subscription.URL), config.F("attempts", j.delivery.Attempts), config.Err(err))
+		d.record(j.delivery)
+		return
+	}
+
+	j.delivery.Status = webhook.StatusRetrying
+	d.record(j.delivery)
+	time.AfterFunc(d.backoff(j.delivery.Attempts), func() {
+		d.offer(j)
+	})
+}
+
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	wait := d.Backoff
+	for i := 1; i < attempts; i++ {
+		wait *= 2
+		if wait >= d.MaxBackoff {
+			return d.MaxBackoff
+		}
+	}
+	return wait
+}
+
+func (d *Dispatcher) post(sub webhook.Subscription, delivery *webhook.Delivery) (int, error) {
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequest("POST", sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Chat-Event", delivery.Event)
+	req.Header.Set("X-Chat-Delivery", strconv.Itoa(delivery.ID))
+	req.Header.Set("X-Chat-Signature", "sha256="+Sign(sub.Secret, body))
+
+	res, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("receiver responded with %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+func (d *Dispatcher) record(delivery *webhook.Delivery) {
+	if err := d.save(delivery); err != nil {
+		config.Log("webhooks").Error("failed to save webhook delivery", config.F("delivery", delivery.ID), config.F("subscription", delivery.SubscriptionID), config.Err(err))
+	}
+}
+
+//Sign - hex encoded HMAC-SHA256 of body. receivers compute the same value to verify the X-Chat-Signature header
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func subscribed(sub webhook.Subscription, eventType string) bool {
+	for _, e := range strings.Split(sub.Events, ",") {
+		if strings.TrimSpace(e) == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func matchKeyword(sub webhook.Subscription, message string) string {
+	lower := strings.ToLower(message)
+	for _, keyword := range strings.Split(sub.Keywords, ",") {
+		keyword = strings.TrimSpace(keyword)
+		if keyword != "" && strings.Contains(lower, strings.ToLower(keyword)) {
+			return keyword
+		}
+	}
+	return ""
+}
+
+func saveDelivery(delivery *webhook.Delivery) error {
+	return db.DB.Conn.Save(delivery).Error
+}
+
+//unfinishedDeliveries - the deliveries which were pending or retrying, oldest first
+func unfinishedDeliveries() ([]webhook.Delivery, error) {
+	deliveries := []webhook.Delivery{}
+	err := db.DB.Conn.Where("status in (?)", []string{webhook.StatusPending, webhook.StatusRetrying}).Order("id").Find(&deliveries).Error
+	return deliveries, err
+}
+
+//Start - loads the subscriptions from the database and starts the delivery workers
+func Start() {
+	if !db.DB.Connected {
+		config.Log("webhooks").Info("webhooks are disabled. they need a database to store subscriptions and deliveries")
+		return
+	}
+	dispatcher = NewDispatcher(4, 1024)
+	if err := Reload(); err != nil {
+		config.Log("webhooks").Error("failed to load webhook subscriptions", config.Err(err))
+	}
+	deliveries, err := unfinishedDeliveries()
+	if err != nil {
+		config.Log("webhooks").Error("failed to load the unfinished webhook deliveries", config.Err(err))
+	}
+	go dispatcher.resume(deliveries)
+	config.Log("webhooks").Info("webhook dispatcher has started")
+}
+
+//Publish - sends the event to the running dispatcher. does nothing until Start has been called
+func Publish(event Event) {
+	if dispatcher != nil {
+		dispatcher.Publish(event)
+	}
+}
+
+//Reload - refreshes the in memory subscriptions after they have been changed in the database
+func Reload() error {
+	if !db.DB.Connected {
+		return db.ErrNoDatabase
+	}
+	subscriptions := []webhook.Subscription{}
+	if err := db.DB.Conn.Find(&subscriptions).Error; err != nil {
+		return err
+	}
+	if dispatcher != nil {
+		dispatcher.SetSubscriptions(subscriptions)
+	}
+	return nil
+}
+
+func CreateSubscription(sub *webhook.Subscription) error {
+	if !db.DB.Connected {
+		return db.ErrNoDatabase
+	}
+	if !strings.HasPrefix(sub.URL, "http://") && !strings.HasPrefix(sub.URL, "https://") {
+		return errors.New("url must start with http:// or https://")
+	}
+	if sub.Events == "" {
+		return errors.New("at least one event is required")
+	}
+	for _, e := range strings.Split(sub.Events, ",") {
+		if !validEvent(strings.TrimSpace(e)) {
+			return fmt.Errorf("unknown event %s. valid events are %s", e, strings.Join(validEvents, ", "))
+		}
+	}
+	if subscribed(*sub, EventKeyword) && strings.TrimSpace(sub.Keywords) == "" {
+		return errors.New("keyword events require at least one keyword")
+	}
+	if err := db.DB.Conn.Save(sub).Error; err != nil {
+		return err
+	}
+	return Reload()
+}
+
+func DeleteSubscription(id int) error {
+	if !db.DB.Connected {
+		return db.ErrNoDatabase
+	}
+	result := db.DB.Conn.Where("id = ?", id).Delete(&webhook.Subscription{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("subscription %d does not exist", id)
+	}
+	return Reload()
+}
+
+func ListSubscriptions() ([]webhook.Subscription, error) {
+	if !db.DB.Connected {
+		return nil, db.ErrNoDatabase
+	}
+	subscriptions := []webhook.Subscription{}
+	err := db.DB.Conn.Order("id").Find(&subscriptions).Error
+	return subscriptions, err
+}
+
+//ListDeliveries - latest deliveries first. subscriptionID and status are optional filters
+func ListDeliveries(subscriptionID int, status string, limit int) ([]webhook.Delivery, error) {
+	if !db.DB.Connected {
+		return nil, db.ErrNoDatabase
+	}
+	deliveries := []webhook.Delivery{}
+	query := db.DB.Conn.Order("id desc").Limit(limit)
+	if subscriptionID != 0 {
+		query = query.Where("subscription_id = ?", subscriptionID)
+	}
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	err := query.Find(&deliveries).Error
+	return deliveries, err
+}
+
+func validEvent(eventType string) bool {
+	for _, e := range validEvents {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+var dispatcher *Dispatcher
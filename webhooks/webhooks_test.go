@@ -0,0 +1,189 @@
+package webhooks
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"team-cymru-telnet/config"
+	"team-cymru-telnet/models/webhook"
+	"testing"
+	"time"
+)
+
+func newTestDispatcher(workers int) (*Dispatcher, chan webhook.Delivery) {
+	d := NewDispatcher(workers, 16)
+	d.Backoff = 10 * time.Millisecond
+	saved := make(chan webhook.Delivery, 64)
+	id := 0
+	mutex := sync.Mutex{}
+	d.save = func(delivery *webhook.Delivery) error {
+		mutex.Lock()
+		if delivery.ID == 0 {
+			id++
+			delivery.ID = id
+		}
+		mutex.Unlock()
+		saved <- *delivery
+		return nil
+	}
+	return d, saved
+}
+
+func waitForStatus(t *testing.T, saved chan webhook.Delivery, status string) webhook.Delivery {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case delivery := <-saved:
+			if delivery.Status == status {
+				return delivery
+			}
+		case <-timeout:
+			t.Fatalf("delivery never reached status %s", status)
+		}
+	}
+}
+
+func TestDeliveryRetriesAndSigns(t *testing.T) {
+	requests := 0
+	received := make(chan Event, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		requests++
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.Header.Get("X-Chat-Signature") != "sha256="+Sign("secret", body) {
+			t.Errorf("bad signature %s", req.Header.Get("X-Chat-Signature"))
+		}
+		//fail the first attempt so the retry path is used
+		if requests == 1 {
+			res.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		event := Event{}
+		json.Unmarshal(body, &event)
+		received <- event
+	}))
+	defer receiver.Close()
+
+	d, saved := newTestDispatcher(1)
+	d.SetSubscriptions([]webhook.Subscription{{ID: 1, URL: receiver.URL, Events: EventMessage, Secret: "secret"}})
+	d.Publish(Event{Type: EventMessage, User: "stuart", Message: "hello all", MessageType: "broadcast"})
+
+	delivery := waitForStatus(t, saved, webhook.StatusDelivered)
+	if delivery.Attempts != 2 {
+		t.Fatalf("expected 2 attempts got %d", delivery.Attempts)
+	}
+	event := <-received
+	if event.User != "stuart" || event.Message != "hello all" {
+		t.Fatalf("unexpected event %+v", event)
+	}
+}
+
+func TestDeadLetterAfterMaxAttempts(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+
+	d, saved := newTestDispatcher(1)
+	d.MaxAttempts = 3
+	d.SetSubscriptions([]webhook.Subscription{{ID: 1, URL: receiver.URL, Events: EventJoin}})
+	//the dead letter path logs an error so keep the log file out of the source tree
+	config.Cfg.LogFile = filepath.Join(t.TempDir(), "ChatServer")
+	d.Publish(Event{Type: EventJoin, User: "andrew"})
+
+	delivery := waitForStatus(t, saved, webhook.StatusDead)
+	if delivery.Attempts != 3 || delivery.ResponseCode != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected dead letter %+v", delivery)
+	}
+}
+
+func TestPublishFilters(t *testing.T) {
+	//without workers the queue is never drained so the queued jobs can be inspected
+	d, _ := newTestDispatcher(0)
+	d.SetSubscriptions([]webhook.Subscription{
+		{ID: 1, URL: "http://localhost", Events: "message,keyword", Channel: sql.NullInt64{Valid: true, Int64: 2}, Keywords: "deploy"},
+	})
+
+	d.Publish(Event{Type: EventMessage, User: "stuart", Channel: 1, Message: "deploy now", MessageType: "channel"})
+	d.Publish(Event{Type: EventMessage, User: "stuart", Message: "private deploy", MessageType: "pm"})
+	d.Publish(Event{Type: EventMessage, User: "stuart", Channel: 2, Message: "Deploy now", MessageType: "channel"})
+
+	events := []string{}
+	for len(d.queue) > 0 {
+		events = append(events, (<-d.queue).delivery.Event)
+	}
+	if len(events) != 2 || events[0] != EventMessage || events[1] != EventKeyword {
+		t.Fatalf("unexpected deliveries %v", events)
+	}
+}
+
+func TestPublishDoesNotWaitForTheDatabase(t *testing.T) {
+	config.Cfg.LogFile = filepath.Join(t.TempDir(), "ChatServer")
+	d, _ := newTestDispatcher(1)
+	//a stalled database
+	stalled := make(chan struct{})
+	defer close(stalled)
+	d.save = func(delivery *webhook.Delivery) error {
+		<-stalled
+		return nil
+	}
+	d.SetSubscriptions([]webhook.Subscription{{ID: 1, URL: "http://localhost", Events: "message,keyword", Keywords: "hello"}})
+
+	published := make(chan struct{})
+	go func() {
+		//more events than the queue holds so the dead letter path is taken as well
+		for i := 0; i < 20; i++ {
+			d.Publish(Event{Type: EventMessage, User: "stuart", Message: "hello all", MessageType: "broadcast"})
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Publish waited for the database")
+	}
+}
+
+func TestRetryWithFullQueue(t *testing.T) {
+	config.Cfg.LogFile = filepath.Join(t.TempDir(), "ChatServer")
+	d, saved := newTestDispatcher(0)
+	d.queue = make(chan job, 1)
+	d.queue <- job{delivery: &webhook.Delivery{}}
+
+	retry := job{subscription: webhook.Subscription{ID: 1}, delivery: &webhook.Delivery{ID: 7, Status: webhook.StatusRetrying}}
+	done := make(chan struct{})
+	go func() {
+		d.offer(retry)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("a retry blocked on the full queue")
+	}
+	if delivery := waitForStatus(t, saved, webhook.StatusDead); delivery.ID != 7 || delivery.LastError != "delivery queue is full" {
+		t.Fatalf("unexpected dead letter %+v", delivery)
+	}
+}
+
+func TestResumeDeliveries(t *testing.T) {
+	d, saved := newTestDispatcher(0)
+	d.SetSubscriptions([]webhook.Subscription{{ID: 1, URL: "http://localhost", Events: EventJoin}})
+	d.resume([]webhook.Delivery{
+		{ID: 3, SubscriptionID: 1, Event: EventJoin, Status: webhook.StatusRetrying, Attempts: 2},
+		{ID: 4, SubscriptionID: 2, Event: EventJoin, Status: webhook.StatusPending},
+	})
+
+	if len(d.queue) != 1 {
+		t.Fatalf("expected the delivery of the existing subscription to be queued, %d jobs", len(d.queue))
+	}
+	if j := <-d.queue; j.delivery.ID != 3 || j.delivery.Attempts != 2 || j.subscription.ID != 1 {
+		t.Fatalf("unexpected job %+v", j.delivery)
+	}
+	if delivery := waitForStatus(t, saved, webhook.StatusDead); delivery.ID != 4 {
+		t.Fatalf("the delivery of a deleted subscription was not marked dead %+v", delivery)
+	}
+}